@@ -3,6 +3,7 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"log"
 	"os"
@@ -32,7 +33,7 @@ func toCSV(snapshots []*snapshot.Snapshot, wtr io.Writer) error {
 // openFile either opens a file, or opens and unzips a file that ends with .zst
 func openFile(fn string) (io.ReadCloser, error) {
 	if strings.HasSuffix(fn, ".zst") {
-		return zstd.NewReader(fn), nil
+		return zstd.NewReader(fn)
 	}
 	return os.Open(fn)
 }
@@ -40,7 +41,9 @@ func openFile(fn string) (io.ReadCloser, error) {
 // TODO handle gs: filenames.
 // TODO filter a single file from a tar file.
 func main() {
-	args := os.Args[1:]
+	flag.Parse()
+	rtx.Must(zstd.LoadDictionaries(), "Could not load zstd dictionaries")
+	args := flag.Args()
 
 	var source io.ReadCloser
 	var err error
@@ -11,6 +11,7 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
 )
 
 func TestMainTooManyArgs(t *testing.T) {
@@ -102,3 +103,34 @@ func TestFileToCSV(t *testing.T) {
 		t.Error(record[12])
 	}
 }
+
+func TestMainDictionary(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+	}(os.Args)
+	dir, err := ioutil.TempDir("", "TestMainDictionary")
+	rtx.Must(err, "Could not make tempdir")
+	defer os.RemoveAll(dir)
+
+	// Recompress the test data with a trained dictionary.
+	src, err := openFile("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	data, err := ioutil.ReadAll(src)
+	rtx.Must(err, "Could not read file")
+	src.Close()
+	dict, err := zstd.TrainDictionary(bytes.SplitAfter(data, []byte("\n")), 7, 4096)
+	rtx.Must(err, "Could not train dictionary")
+	rtx.Must(ioutil.WriteFile(dir+"/v7.dict", dict, 0644), "Could not write dictionary")
+	rtx.Must(zstd.DictionaryFiles.Set(dir+"/v7.dict"), "Could not set flag")
+	rtx.Must(zstd.LoadDictionaries(), "Could not load dictionary")
+	*zstd.UseDictionary = true
+	w, err := zstd.NewWriter(dir + "/dict.jsonl.zst")
+	*zstd.UseDictionary = false
+	rtx.Must(err, "Could not create file")
+	_, err = w.Write(data)
+	rtx.Must(err, "Could not write file")
+	rtx.Must(w.Close(), "Could not close file")
+
+	os.Args = []string{"test_csvtool", "-zstd.dictionary-file=" + dir + "/v7.dict", dir + "/dict.jsonl.zst"}
+	main()
+}
@@ -0,0 +1,123 @@
+// Main package in dicttool implements a command line tool for training zstd
+// dictionaries from existing ArchiveRecord files.
+// See cmd/dicttool/README.md for more information.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	kzstd "github.com/klauspost/compress/zstd"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var (
+	version    = flag.Int("version", 0, "Version of the new dictionary.  It must be greater than the versions of all dictionaries in use.")
+	output     = flag.String("output", "", "File to write the dictionary to.  Default is tcp-info-v<version>.dict")
+	size       = flag.Int("size", 32*1024, "Maximum size of the dictionary, in bytes.")
+	sampleSize = flag.Int("sample-size", 32*1024, "How much of the beginning of each file to train on, in bytes.")
+
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+// readSample returns the beginning of the uncompressed contents of fn.
+func readSample(fn string) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	if strings.HasSuffix(fn, ".zst") {
+		r, err = zstd.NewReader(fn)
+	} else {
+		r, err = os.Open(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(io.LimitReader(r, int64(*sampleSize)))
+}
+
+// readSamples reads a sample from every file named in args, and from every
+// .jsonl or .jsonl.zst file in the directories named in args.
+func readSamples(args []string) ([][]byte, error) {
+	samples := [][]byte{}
+	for _, arg := range args {
+		err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if path != arg && !strings.HasSuffix(path, ".jsonl") && !strings.HasSuffix(path, ".jsonl.zst") {
+				return nil
+			}
+			sample, err := readSample(path)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if len(sample) > 0 {
+				samples = append(samples, sample)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// compressedSize returns the total size of the samples, each compressed on its
+// own, as they would be in separate files.
+func compressedSize(samples [][]byte, opts ...kzstd.EOption) int {
+	enc, err := kzstd.NewWriter(nil, opts...)
+	rtx.Must(err, "Could not create encoder")
+	defer enc.Close()
+	total := 0
+	for _, s := range samples {
+		total += len(enc.EncodeAll(s, nil))
+	}
+	return total
+}
+
+func main() {
+	flag.Parse()
+	if *version < 1 {
+		logFatal("The -version flag must be set to a positive version.")
+		return
+	}
+	if flag.NArg() == 0 {
+		logFatal("No files or directories to train on.")
+		return
+	}
+	if *output == "" {
+		*output = fmt.Sprintf("tcp-info-v%d.dict", *version)
+	}
+
+	samples, err := readSamples(flag.Args())
+	rtx.Must(err, "Could not read samples")
+	dict, err := zstd.TrainDictionary(samples, *version, *size)
+	rtx.Must(err, "Could not train dictionary")
+	rtx.Must(ioutil.WriteFile(*output, dict, 0644), "Could not write %s", *output)
+
+	total := 0
+	for _, s := range samples {
+		total += len(s)
+	}
+	log.Printf("Wrote %d byte dictionary version %d to %s", len(dict), *version, *output)
+	log.Printf("%d samples, %d bytes, compress to %d bytes without the dictionary, and %d bytes with it",
+		len(samples), total, compressedSize(samples), compressedSize(samples, kzstd.WithEncoderDict(dict)))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func TestMainMissingArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	for _, args := range [][]string{
+		{"test_dicttool", "-version=0", "../../netlink/testdata"},
+		{"test_dicttool", "-version=1"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Should have panicked for", args)
+				}
+			}()
+			os.Args = args
+			main()
+		}()
+	}
+}
+
+func TestMain(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+	}(os.Args)
+	dir, err := ioutil.TempDir("", "TestMain")
+	rtx.Must(err, "Could not make tempdir")
+	defer os.RemoveAll(dir)
+
+	os.Args = []string{"test_dicttool", "-version=3", "-size=8192", "-output=" + dir + "/v3.dict",
+		"../../netlink/testdata", "../csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"}
+	main()
+
+	dict, err := ioutil.ReadFile(dir + "/v3.dict")
+	rtx.Must(err, "Could not read dictionary")
+	version, err := zstd.AddDictionary(dict)
+	rtx.Must(err, "Not a usable dictionary")
+	if version != 3 {
+		t.Error("Wrong version", version)
+	}
+}
@@ -5,83 +5,243 @@ package collector
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/vishvananda/netns"
+
+	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/metrics"
 
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/saver"
 )
 
+var (
+	// AllNamespaces is a command-line flag enabling collection from every
+	// network namespace on the host, e.g. from Kubernetes pods that do not use
+	// host networking.
+	AllNamespaces = flag.Bool("collector.all-namespaces", false, "Collect connections from every network namespace found in /var/run/netns and /proc/*/ns/net, not just the one tcp-info runs in.")
+
+	// Filter is a command-line flag holding an inet_diag socket filter, so
+	// that the kernel only reports connections we are interested in.  See
+	// inetdiag/filter.go for the syntax.
+	Filter inetdiag.FilterFlag
+
+	// Protocols is a command-line flag listing the transport protocols to collect.
+	Protocols = ProtocolList{inetdiag.Protocol_IPPROTO_TCP}
+
+	// How often the host is rescanned for new or deleted network namespaces.
+	namespaceScanInterval = time.Second
+)
+
+func init() {
+	flag.Var(&Filter, "collector.filter", "Only collect connections matching this filter, evaluated by the kernel, e.g. 'dport == 443 or (sport >= 3000 and sport <= 3010) and not dst 10.0.0.0/8'.  Default is all connections.")
+	flag.Var(&Protocols, "collector.protocols", "Comma separated list of protocols to collect, from tcp, udp, dccp and sctp.  Sockets other than TCP are saved in separate directory trees, e.g. udp/2006/01/02/.")
+}
+
+// protocolNames maps the names accepted by ProtocolList to protocols.
+var protocolNames = map[string]inetdiag.Protocol{
+	"tcp":  inetdiag.Protocol_IPPROTO_TCP,
+	"udp":  inetdiag.Protocol_IPPROTO_UDP,
+	"dccp": inetdiag.Protocol_IPPROTO_DCCP,
+	"sctp": inetdiag.Protocol_IPPROTO_SCTP,
+}
+
+// ProtocolList is a flag.Value holding a comma separated list of protocol names.
+type ProtocolList []inetdiag.Protocol
+
+// Set replaces the list with the protocols in s.
+func (pl *ProtocolList) Set(s string) error {
+	list := ProtocolList{}
+	for _, name := range strings.Split(s, ",") {
+		p, ok := protocolNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return fmt.Errorf("unknown protocol %q", name)
+		}
+		list = append(list, p)
+	}
+	*pl = list
+	return nil
+}
+
+// String returns the comma separated protocol names.
+func (pl ProtocolList) String() string {
+	names := make([]string, 0, len(pl))
+	for _, p := range pl {
+		for name, q := range protocolNames {
+			if p == q {
+				names = append(names, name)
+			}
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Get returns the []inetdiag.Protocol.
+func (pl ProtocolList) Get() interface{} {
+	return []inetdiag.Protocol(pl)
+}
+
 var (
 	errCount   = 0
 	localCount = 0
 )
 
-// collectDefaultNamespace collects all AF_INET6 and AF_INET connection stats, and sends them
-// to svr.
-func collectDefaultNamespace(svr chan<- netlink.MessageBlock, skipLocal bool) (int, int) {
-	// Preallocate space for up to 500 connections.  We may want to adjust this upwards if profiling
-	// indicates a lot of reallocation.
-	buffer := netlink.MessageBlock{}
+// collectType collects connections of one address family and protocol.
+func collectType(m *Monitor, inetType uint8, protocol inetdiag.Protocol) ([]*netlink.NetlinkMessage, error) {
+	if protocol == inetdiag.Protocol_IPPROTO_TCP {
+		return m.OneType(inetType)
+	}
+	return m.Dump(inetType, protocol)
+}
+
+// send sends a block to the saver, accounting for the time spent waiting when the
+// saver falls behind.
+func send(svrChan chan<- netlink.MessageBlock, block netlink.MessageBlock) {
+	metrics.QueueDepth.WithLabelValues("saver").Set(float64(len(svrChan)))
+	start := time.Now()
+	svrChan <- block
+	metrics.QueueBlockedSeconds.WithLabelValues("saver").Add(time.Since(start).Seconds())
+}
 
+// collectNamespace collects all AF_INET6 and AF_INET connection stats from the
+// network namespace ns, and sends them to svr, in one block per protocol.
+func collectNamespace(svr chan<- netlink.MessageBlock, ns *Namespace, skipLocal bool) (int, int) {
+	total := 0
 	remoteCount := 0
-	res6, err := OneType(syscall.AF_INET6)
-	buffer.V6Time = time.Now()
-	if err != nil {
-		// Properly handle errors
-		// TODO add metric
-		log.Println(err)
-	} else {
-		buffer.V6Messages = res6
-	}
-	res4, err := OneType(syscall.AF_INET)
-	buffer.V4Time = time.Now()
-	if err != nil {
-		// Properly handle errors
-		// TODO add metric
-		log.Println(err)
-	} else {
-		buffer.V4Messages = res4
-	}
+	for _, protocol := range Protocols {
+		// Preallocate space for up to 500 connections.  We may want to adjust this upwards if profiling
+		// indicates a lot of reallocation.
+		buffer := netlink.MessageBlock{Namespace: ns.ID, Protocol: protocol}
 
-	// Submit full set of message to the marshalling service.
-	svr <- buffer
+		res6, err6 := collectType(ns.Monitor(), syscall.AF_INET6, protocol)
+		buffer.V6Time = time.Now()
+		if err6 != nil {
+			// Properly handle errors
+			// TODO add metric
+			if err6 != ErrNotSupported {
+				log.Println(err6)
+			}
+		} else {
+			buffer.V6Messages = res6
+		}
+		res4, err4 := collectType(ns.Monitor(), syscall.AF_INET, protocol)
+		buffer.V4Time = time.Now()
+		if err4 != nil {
+			// Properly handle errors
+			// TODO add metric
+			if err4 != ErrNotSupported {
+				log.Println(err4)
+			}
+		} else {
+			buffer.V4Messages = res4
+		}
+		if err4 == ErrNotSupported && err6 == ErrNotSupported {
+			continue
+		}
 
-	return len(res4) + len(res6), remoteCount
+		// Submit full set of message to the marshalling service.
+		send(svr, buffer)
+		total += len(res4) + len(res6)
+	}
+
+	return total, remoteCount
 }
 
 // Run the collector, either for the specified number of loops, or, if the
-// number specified is infinite, run forever.
+// number specified is infinite, run forever.  The time between cycles is set by
+// the collector flags.  In adaptive mode, cl should also be a saver.ChangeCounter,
+// otherwise the shortest interval is always used.
 func Run(ctx context.Context, reps int, svrChan chan<- netlink.MessageBlock, cl saver.CacheLogger, skipLocal bool) (localCount, errCount int) {
 	totalCount := 0
 	remoteCount := 0
 	loops := 0
 
-	// TODO - make this interval programmable.
-	ticker := time.NewTicker(10 * time.Millisecond)
-	defer ticker.Stop()
+	// The sockets used to query the kernel are kept open across cycles.
+	self := &Namespace{handle: netns.None()}
+	defer self.Close()
+	namespaces := []*Namespace{self}
+	var tracker *namespaceTracker
+	if *AllNamespaces {
+		var err error
+		tracker, err = newNamespaceTracker()
+		if err != nil {
+			log.Println("Could not track network namespaces, collecting only the default namespace:", err)
+		} else {
+			defer tracker.Close()
+		}
+	}
+	lastScanTime := time.Time{}
+
+	counter, _ := cl.(saver.ChangeCounter)
+	var lastChangeCount int64
+	if counter != nil {
+		lastChangeCount = counter.ChangeCount()
+	}
+	polling := newPollingInterval(*Interval, *MaxInterval, *BusyChanges, *Adaptive && counter != nil)
+	interval := *Interval
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+	metrics.PollingIntervalGauge.Set(interval.Seconds())
 
-	lastCollectionTime := time.Now().Add(-10 * time.Millisecond)
+	lastCollectionTime := time.Now().Add(-interval)
+	lastStatsTime := time.Time{}
 
 	for loops = 0; (reps == 0 || loops < reps) && (ctx.Err() == nil); loops++ {
-		total, remote := collectDefaultNamespace(svrChan, skipLocal)
-		totalCount += total
-		remoteCount += remote
-		// print stats roughly once per minute.
-		if loops%6000 == 0 {
+		if tracker != nil && time.Since(lastScanTime) >= namespaceScanInterval {
+			gone, err := tracker.Update()
+			if err != nil {
+				log.Println(err)
+			}
+			// An empty block tells the saver that all connections in a
+			// deleted namespace are gone.
+			for _, ns := range gone {
+				now := time.Now()
+				for _, protocol := range Protocols {
+					send(svrChan, netlink.MessageBlock{Namespace: ns.ID, Protocol: protocol, V4Time: now, V6Time: now})
+				}
+			}
+			namespaces = tracker.Namespaces()
+			lastScanTime = time.Now()
+		}
+		for _, ns := range namespaces {
+			total, remote := collectNamespace(svrChan, ns, skipLocal)
+			totalCount += total
+			remoteCount += remote
+		}
+		// print stats once per minute.
+		if time.Since(lastStatsTime) >= time.Minute {
 			cl.LogCacheStats(localCount, errCount)
+			lastStatsTime = time.Now()
 		}
 
 		now := time.Now()
-		interval := now.Sub(lastCollectionTime)
+		metrics.PollingHistogram.Observe(now.Sub(lastCollectionTime).Seconds())
 		lastCollectionTime = now
-		metrics.PollingHistogram.Observe(interval.Seconds())
 
-		// Wait for next tick.
-		<-ticker.C
+		// The saver lags a cycle or two behind, which is fine for adapting the interval.
+		if counter != nil {
+			count := counter.ChangeCount()
+			next := polling.Update(count - lastChangeCount)
+			lastChangeCount = count
+			if next != interval {
+				interval = next
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+				metrics.PollingIntervalGauge.Set(interval.Seconds())
+			}
+		}
+
+		// Wait for next tick, or stop right away if the context is canceled.
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
 	}
 
 	if loops > 0 {
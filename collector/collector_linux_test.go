@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/netlink"
 )
 
@@ -154,3 +156,21 @@ func TestRun(t *testing.T) {
 	t.Log("Waiting for goroutines to exit")
 	wg.Wait()
 }
+
+func TestProtocolList(t *testing.T) {
+	pl := collector.ProtocolList{}
+	rtx.Must(pl.Set("tcp, UDP,sctp"), "Could not set protocols")
+	want := []inetdiag.Protocol{inetdiag.Protocol_IPPROTO_TCP, inetdiag.Protocol_IPPROTO_UDP, inetdiag.Protocol_IPPROTO_SCTP}
+	if !reflect.DeepEqual(pl.Get(), want) {
+		t.Error("Wrong protocols", pl)
+	}
+	if pl.String() != "tcp,udp,sctp" {
+		t.Error("Wrong string", pl.String())
+	}
+	if pl.Set("tcp,quic") == nil {
+		t.Error("Should reject unknown protocols")
+	}
+	if len(pl) != 3 {
+		t.Error("A failed Set should not change the list", pl)
+	}
+}
@@ -1,3 +1,13 @@
 package collector
 
+import "github.com/vishvananda/netlink/nl"
+
 var ProcessSingleMessage = processSingleMessage
+
+var FindNamespaces = findNamespaces
+
+var MakeReq = makeReq
+
+func (m *Monitor) Socket(inetType uint8) (*nl.NetlinkSocket, uint32, error) {
+	return m.socket(inetType)
+}
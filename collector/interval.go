@@ -0,0 +1,70 @@
+package collector
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	// Interval is a command-line flag holding the (minimum) time between polling cycles.
+	Interval = flag.Duration("collector.interval", 10*time.Millisecond, "Time between polling cycles. In adaptive mode, this is the shortest interval used.")
+	// Adaptive is a command-line flag enabling adaptive polling.
+	Adaptive = flag.Bool("collector.adaptive", false, "Poll less frequently while no connections are changing, and more frequently when many are.")
+	// MaxInterval is a command-line flag holding the longest interval used in adaptive mode.
+	MaxInterval = flag.Duration("collector.max-interval", time.Second, "Longest time between polling cycles in adaptive mode.")
+	// BusyChanges is a command-line flag holding the number of changed records per
+	// cycle that causes adaptive mode to return to the shortest interval.
+	BusyChanges = flag.Int64("collector.busy-changes", 100, "Number of changed records in a cycle that makes adaptive mode return to the shortest interval.")
+)
+
+// Number of consecutive cycles without any changes before adaptive polling backs off.
+const idleCyclesBeforeBackoff = 10
+
+// pollingInterval computes the interval between polling cycles.  In adaptive
+// mode, the interval doubles (up to max) after idleCyclesBeforeBackoff cycles
+// without any changed records, halves whenever records change, and returns to
+// min as soon as a cycle has busy or more changed records.
+type pollingInterval struct {
+	current  time.Duration
+	min, max time.Duration
+	busy     int64
+	adaptive bool
+
+	idleCycles int
+}
+
+func newPollingInterval(min, max time.Duration, busy int64, adaptive bool) *pollingInterval {
+	if max < min {
+		max = min
+	}
+	return &pollingInterval{current: min, min: min, max: max, busy: busy, adaptive: adaptive}
+}
+
+// Update records the number of records that changed in the most recent cycle,
+// and returns the interval to use before the next one.
+func (p *pollingInterval) Update(changes int64) time.Duration {
+	if !p.adaptive {
+		return p.current
+	}
+	switch {
+	case changes >= p.busy:
+		p.idleCycles = 0
+		p.current = p.min
+	case changes > 0:
+		p.idleCycles = 0
+		p.current /= 2
+	default:
+		p.idleCycles++
+		if p.idleCycles >= idleCyclesBeforeBackoff {
+			p.idleCycles = 0
+			p.current *= 2
+		}
+	}
+	if p.current < p.min {
+		p.current = p.min
+	}
+	if p.current > p.max {
+		p.current = p.max
+	}
+	return p.current
+}
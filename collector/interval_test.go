@@ -0,0 +1,46 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollingInterval(t *testing.T) {
+	p := newPollingInterval(10*time.Millisecond, 80*time.Millisecond, 100, false)
+	for i := 0; i < 100; i++ {
+		if got := p.Update(0); got != 10*time.Millisecond {
+			t.Fatal("Non-adaptive interval should never change, got", got)
+		}
+	}
+
+	p = newPollingInterval(10*time.Millisecond, 80*time.Millisecond, 100, true)
+	tests := []struct {
+		name    string
+		cycles  int
+		changes int64
+		want    time.Duration
+	}{
+		{"not yet idle", idleCyclesBeforeBackoff - 1, 0, 10 * time.Millisecond},
+		{"first backoff", 1, 0, 20 * time.Millisecond},
+		{"second backoff", idleCyclesBeforeBackoff, 0, 40 * time.Millisecond},
+		{"capped at max", 10 * idleCyclesBeforeBackoff, 0, 80 * time.Millisecond},
+		{"few changes halve", 1, 5, 40 * time.Millisecond},
+		{"changes reset idle count", idleCyclesBeforeBackoff - 1, 0, 40 * time.Millisecond},
+		{"busy returns to min", 1, 100, 10 * time.Millisecond},
+		{"never below min", 1, 5, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		var got time.Duration
+		for i := 0; i < tt.cycles; i++ {
+			got = p.Update(tt.changes)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	p = newPollingInterval(time.Second, time.Millisecond, 1, true)
+	if p.max != time.Second {
+		t.Error("max should never be less than min", p.max)
+	}
+}
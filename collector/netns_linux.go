@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Locations searched for network namespaces.  Named namespaces (as created by
+// "ip netns add" and most CNI plugins) are bind mounted in netnsDir, and every
+// process exposes the namespace it runs in under procDir.
+var (
+	netnsDir = "/var/run/netns"
+	procDir  = "/proc"
+)
+
+// Namespace describes a network namespace from which connections are collected.
+type Namespace struct {
+	// ID uniquely identifies the namespace on this host.  It is derived from
+	// the namespace inode, and is empty for the namespace tcp-info runs in, so
+	// that records from the default namespace are unchanged.
+	ID string
+	// Path is the file that was used to open the namespace.
+	Path string
+
+	inode   uint64
+	handle  netns.NsHandle // Closed handle for the default namespace.
+	monitor *Monitor       // Created on first use.
+}
+
+// Monitor returns the Monitor used to query the namespace.
+func (ns *Namespace) Monitor() *Monitor {
+	if ns.monitor == nil {
+		ns.monitor = NewMonitor(ns.handle)
+	}
+	return ns.monitor
+}
+
+// Close releases the handle on the namespace and its sockets, allowing the
+// kernel to free it.
+func (ns *Namespace) Close() {
+	if ns.monitor != nil {
+		ns.monitor.Close()
+	}
+	if ns.handle.IsOpen() {
+		ns.handle.Close()
+	}
+}
+
+func namespaceID(inode uint64) string {
+	return fmt.Sprintf("netns-%d", inode)
+}
+
+func nsInode(path string) (uint64, error) {
+	var st unix.Stat_t
+	err := unix.Stat(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return st.Ino, nil
+}
+
+// findNamespaces returns the paths of all distinct network namespaces found in
+// nsDir and under pDir, keyed by namespace inode.  Named namespaces are
+// preferred over /proc paths when both refer to the same namespace.
+func findNamespaces(nsDir, pDir string) (map[uint64]string, error) {
+	named, err := filepath.Glob(filepath.Join(nsDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	procs, err := filepath.Glob(filepath.Join(pDir, "[0-9]*", "ns", "net"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(named)
+	found := make(map[uint64]string, len(named)+10)
+	for _, path := range append(named, procs...) {
+		inode, err := nsInode(path)
+		if err != nil {
+			// Processes come and go, and we may not have permission for some of them.
+			continue
+		}
+		if _, ok := found[inode]; !ok {
+			found[inode] = path
+		}
+	}
+	return found, nil
+}
+
+// namespaceTracker keeps open handles for all network namespaces currently
+// present on the host.
+type namespaceTracker struct {
+	self  uint64
+	known map[uint64]*Namespace
+}
+
+func newNamespaceTracker() (*namespaceTracker, error) {
+	self, err := nsInode(filepath.Join(procDir, "self", "ns", "net"))
+	if err != nil {
+		return nil, err
+	}
+	t := &namespaceTracker{
+		self:  self,
+		known: map[uint64]*Namespace{self: {Path: filepath.Join(procDir, "self", "ns", "net"), inode: self, handle: netns.None()}},
+	}
+	return t, nil
+}
+
+// Update rescans the host for network namespaces.  It returns the namespaces
+// that disappeared since the previous scan, after closing them.
+func (t *namespaceTracker) Update() ([]*Namespace, error) {
+	found, err := findNamespaces(netnsDir, procDir)
+	if err != nil {
+		return nil, err
+	}
+	var gone []*Namespace
+	for inode, ns := range t.known {
+		if _, ok := found[inode]; !ok && inode != t.self {
+			ns.Close()
+			delete(t.known, inode)
+			gone = append(gone, ns)
+		}
+	}
+	for inode, path := range found {
+		if _, ok := t.known[inode]; ok {
+			continue
+		}
+		h, err := netns.GetFromPath(path)
+		if err != nil {
+			log.Println("Could not open network namespace", path, err)
+			continue
+		}
+		// The file may have been replaced between the scan and the open.
+		if id, err := nsInode(filepath.Join(procDir, "self", "fd", strconv.Itoa(int(h)))); err != nil || id != inode {
+			h.Close()
+			continue
+		}
+		t.known[inode] = &Namespace{ID: namespaceID(inode), Path: path, inode: inode, handle: h}
+	}
+	return gone, nil
+}
+
+// Namespaces returns all currently known namespaces, with the default namespace first.
+func (t *namespaceTracker) Namespaces() []*Namespace {
+	result := make([]*Namespace, 0, len(t.known))
+	result = append(result, t.known[t.self])
+	for inode, ns := range t.known {
+		if inode != t.self {
+			result = append(result, ns)
+		}
+	}
+	rest := result[1:]
+	sort.Slice(rest, func(i, j int) bool { return rest[i].inode < rest[j].inode })
+	return result
+}
+
+// Close closes all namespace handles.
+func (t *namespaceTracker) Close() {
+	for _, ns := range t.known {
+		ns.Close()
+	}
+}
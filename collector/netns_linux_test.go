@@ -0,0 +1,56 @@
+package collector_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/collector"
+)
+
+func TestFindNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFindNamespaces")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	// Regular files stand in for namespace files; only their inodes matter.
+	mustCreate := func(path string) {
+		rtx.Must(os.MkdirAll(filepath.Dir(path), 0755), "Could not create dir for %s", path)
+		rtx.Must(ioutil.WriteFile(path, nil, 0644), "Could not create %s", path)
+	}
+	mustCreate(dir + "/netns/cni-1234")
+	mustCreate(dir + "/proc/1/ns/net")
+	mustCreate(dir + "/proc/self/ns/net")
+	mustCreate(dir + "/proc/notapid/ns/net")
+	// Process 2 shares the namespace of process 1, and process 3 is in the named namespace.
+	rtx.Must(os.MkdirAll(dir+"/proc/2/ns", 0755), "Could not create dir")
+	rtx.Must(os.Link(dir+"/proc/1/ns/net", dir+"/proc/2/ns/net"), "Could not link")
+	rtx.Must(os.MkdirAll(dir+"/proc/3/ns", 0755), "Could not create dir")
+	rtx.Must(os.Link(dir+"/netns/cni-1234", dir+"/proc/3/ns/net"), "Could not link")
+
+	found, err := collector.FindNamespaces(dir+"/netns", dir+"/proc")
+	rtx.Must(err, "Could not find namespaces")
+	if len(found) != 2 {
+		t.Fatal("Expected 2 distinct namespaces, got", found)
+	}
+	named := false
+	for _, path := range found {
+		if path == dir+"/netns/cni-1234" {
+			named = true
+		}
+		if path == dir+"/proc/3/ns/net" {
+			t.Error("The named path should be preferred over", path)
+		}
+	}
+	if !named {
+		t.Error("Did not find the named namespace in", found)
+	}
+
+	found, err = collector.FindNamespaces(dir+"/nonexistent", dir+"/nonexistent")
+	rtx.Must(err, "Missing directories should not be an error")
+	if len(found) != 0 {
+		t.Error("Should have found nothing, not", found)
+	}
+}
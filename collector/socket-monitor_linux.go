@@ -3,12 +3,15 @@ package collector
 // This package is only meaningful in Linux.
 
 import (
+	"errors"
 	"log"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 
 	"github.com/m-lab/tcp-info/inetdiag"
@@ -16,22 +19,25 @@ import (
 	"github.com/m-lab/tcp-info/tcp"
 )
 
+// ErrNotSupported is returned when the kernel can not dump sockets of a protocol,
+// typically because the corresponding sock_diag module is not available.
+var ErrNotSupported = errors.New("protocol not supported by sock_diag")
+
 // TODO - Figure out why we aren't seeing INET_DIAG_DCTCPINFO or INET_DIAG_BBRINFO messages.
-func makeReq(inetType uint8) *nl.NetlinkRequest {
+func makeReq(inetType uint8, protocol inetdiag.Protocol) *nl.NetlinkRequest {
 	req := nl.NewNetlinkRequest(inetdiag.SOCK_DIAG_BY_FAMILY, syscall.NLM_F_DUMP|syscall.NLM_F_REQUEST)
-	msg := inetdiag.NewReqV2(inetType, syscall.IPPROTO_TCP,
-		tcp.AllFlags & ^((1<<uint(tcp.SYN_RECV))|(1<<uint(tcp.TIME_WAIT))|(1<<uint(tcp.CLOSE))))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_MEMINFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_INFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_VEGASINFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_CONG - 1))
-
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_TCLASS - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_TOS - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_SKMEMINFO - 1))
-	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_SHUTDOWN - 1))
+	states := uint32(tcp.AllFlags & ^((1 << uint(tcp.SYN_RECV)) | (1 << uint(tcp.TIME_WAIT)) | (1 << uint(tcp.CLOSE))))
+	if protocol == inetdiag.Protocol_IPPROTO_UDP {
+		// Unconnected UDP sockets, e.g. most QUIC servers, are in the CLOSE state.
+		states = tcp.AllFlags
+	}
+	msg := inetdiag.NewReqV2(inetType, uint8(protocol), states)
+	msg.IDiagExt |= inetdiag.RequestedExtensions
 
 	req.AddData(msg)
+	if len(Filter.Bytecode) > 0 {
+		req.AddData(nl.NewRtAttr(inetdiag.INET_DIAG_REQ_BYTECODE, Filter.Bytecode))
+	}
 	req.NlMsghdr.Type = inetdiag.SOCK_DIAG_BY_FAMILY
 	req.NlMsghdr.Flags |= syscall.NLM_F_DUMP | syscall.NLM_F_REQUEST
 	return req
@@ -69,69 +75,253 @@ func processSingleMessage(m *syscall.NetlinkMessage, seq uint32, pid uint32) (*s
 	return m, true, nil
 }
 
-// OneType handles the request and response for a single type, e.g. INET or INET6
-// TODO maybe move this to top level?
-func OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
-	var res []*syscall.NetlinkMessage
+// Receive buffer sizes.  Netlink dumps are truncated if the buffer passed to
+// recvfrom is smaller than the kernel's dump message, which may be up to 32KB.
+const (
+	recvBufferSize  = nl.RECEIVE_BUFFER_SIZE
+	arenaChunkSize  = 16 * recvBufferSize
+	messageSlabSize = 1024
+)
 
-	start := time.Now()
-	defer func() {
-		af := "unknown"
-		switch inetType {
-		case syscall.AF_INET:
-			af = "ipv4"
-		case syscall.AF_INET6:
-			af = "ipv6"
-		}
-		metrics.SyscallTimeHistogram.With(prometheus.Labels{"af": af}).Observe(time.Since(start).Seconds())
-		metrics.ConnectionCountHistogram.With(prometheus.Labels{"af": af}).Observe(float64(len(res)))
-	}()
+// Monitor is a long-lived source of socket stats from one network namespace.
+// It keeps one NETLINK_INET_DIAG socket per address family open across calls.
+//
+// Responses are received directly into large chunks of memory that are shared
+// by all the messages they contain, and the unused remainder of each chunk is
+// used by subsequent calls, so there is no allocation or copy per message.  The
+// returned messages remain valid indefinitely; a chunk is freed by the GC once
+// no message in it is referenced.
+//
+// Monitor is NOT threadsafe.
+type Monitor struct {
+	ns        netns.NsHandle
+	sockets   map[uint8]*nl.NetlinkSocket
+	pids      map[uint8]uint32
+	lastCount map[dumpKey]int
+
+	unsupported map[inetdiag.Protocol]bool // Protocols the kernel can't dump.
 
-	req := makeReq(inetType)
+	arena     []byte                   // Free space for receiving messages.
+	chunkSize int                      // Size of the next arena chunk.
+	slab      []syscall.NetlinkMessage // Free message headers.
+}
+
+// NewMonitor creates a Monitor for the network namespace ns.  If ns is not
+// open, the namespace of the calling thread is used.  Sockets are opened on
+// first use.
+func NewMonitor(ns netns.NsHandle) *Monitor {
+	return &Monitor{
+		ns:        ns,
+		sockets:   make(map[uint8]*nl.NetlinkSocket, 2),
+		pids:      make(map[uint8]uint32, 2),
+		lastCount: make(map[dumpKey]int, 2),
+		chunkSize: recvBufferSize,
+
+		unsupported: make(map[inetdiag.Protocol]bool),
+	}
+}
 
-	// Copied this from req.Execute in nl_linux.go
-	sockType := syscall.NETLINK_INET_DIAG
-	s, err := nl.Subscribe(sockType)
+// Close closes all sockets.  The Monitor may still be used afterwards, and
+// will open new sockets as needed.
+func (m *Monitor) Close() {
+	for inetType := range m.sockets {
+		m.reset(inetType)
+	}
+}
+
+// reset closes the socket for inetType, so that a fresh one is created on the next call.
+func (m *Monitor) reset(inetType uint8) {
+	if s, ok := m.sockets[inetType]; ok {
+		s.Close()
+		delete(m.sockets, inetType)
+		delete(m.pids, inetType)
+	}
+}
+
+func (m *Monitor) socket(inetType uint8) (*nl.NetlinkSocket, uint32, error) {
+	if s, ok := m.sockets[inetType]; ok {
+		return s, m.pids[inetType], nil
+	}
+	// The socket stays bound to the namespace it was created in, so only the
+	// creation needs to happen inside ns.
+	s, err := nl.SubscribeAt(m.ns, netns.None(), syscall.NETLINK_INET_DIAG)
 	if err != nil {
-		// TODO - all these logs should be metrics instead.
-		log.Println(err)
-		return nil, err
+		return nil, 0, err
+	}
+	pid, err := s.GetPid()
+	if err != nil {
+		s.Close()
+		return nil, 0, err
 	}
-	defer s.Close()
+	m.sockets[inetType] = s
+	m.pids[inetType] = pid
+	return s, pid, nil
+}
 
-	if err := s.Send(req); err != nil {
-		log.Println(err)
+// recv receives the next batch of messages from fd into the arena.
+func (m *Monitor) recv(fd int) ([]byte, error) {
+	if cap(m.arena) < recvBufferSize {
+		// Start small, so that short lived monitors stay cheap.
+		m.arena = make([]byte, m.chunkSize)
+		if m.chunkSize < arenaChunkSize {
+			m.chunkSize *= 2
+		}
+	}
+	n, _, err := unix.Recvfrom(fd, m.arena[:recvBufferSize], 0)
+	if err != nil {
 		return nil, err
 	}
+	if n < unix.NLMSG_HDRLEN {
+		return nil, inetdiag.ErrBadMsgData
+	}
+	// Keep the received bytes, and leave the rest for the next receive.
+	b := m.arena[:n:n]
+	m.arena = m.arena[nlmAlignOf(n):]
+	return b, nil
+}
 
-	pid, err := s.GetPid()
+func nlmAlignOf(l int) int {
+	return (l + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
+
+// parseMessage parses the netlink message at the start of b, without copying,
+// and returns it with the remaining bytes.
+func (m *Monitor) parseMessage(b []byte) (*syscall.NetlinkMessage, []byte, error) {
+	if len(b) < unix.NLMSG_HDRLEN {
+		return nil, nil, inetdiag.ErrBadMsgData
+	}
+	h := (*syscall.NlMsghdr)(unsafe.Pointer(&b[0]))
+	l := int(h.Len)
+	if l < unix.NLMSG_HDRLEN || l > len(b) {
+		return nil, nil, inetdiag.ErrBadMsgData
+	}
+	if len(m.slab) == 0 {
+		m.slab = make([]syscall.NetlinkMessage, messageSlabSize)
+	}
+	msg := &m.slab[0]
+	m.slab = m.slab[1:]
+	msg.Header = *h
+	msg.Data = b[unix.NLMSG_HDRLEN:l:l]
+	if next := nlmAlignOf(l); next < len(b) {
+		return msg, b[next:], nil
+	}
+	return msg, nil, nil
+}
+
+type dumpKey struct {
+	inetType uint8
+	protocol inetdiag.Protocol
+}
+
+// dump sends a dump request for inetType and protocol, and collects the responses.
+// Sockets of all protocols share the socket for inetType.
+func (m *Monitor) dump(inetType uint8, protocol inetdiag.Protocol) ([]*syscall.NetlinkMessage, error) {
+	s, pid, err := m.socket(inetType)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+	req := makeReq(inetType, protocol)
+	if err := s.Send(req); err != nil {
 		return nil, err
 	}
 
-	// Adapted this from req.Execute in nl_linux.go
+	key := dumpKey{inetType, protocol}
+	res := make([]*syscall.NetlinkMessage, 0, m.lastCount[key]+m.lastCount[key]/10+10)
 	for {
-		msgs, _, err := s.Receive()
+		b, err := m.recv(s.GetFd())
 		if err != nil {
-			log.Println(err)
-			return nil, err
+			return res, err
 		}
-		// TODO avoid the copy.
-		for i := range msgs {
-			m, shouldContinue, err := processSingleMessage(&msgs[i], req.Seq, pid)
+		for len(b) > 0 {
+			var msg *syscall.NetlinkMessage
+			msg, b, err = m.parseMessage(b)
 			if err != nil {
 				return res, err
 			}
-			if m != nil {
-				res = append(res, m)
+			msg, shouldContinue, err := processSingleMessage(msg, req.Seq, pid)
+			if err != nil {
+				return res, err
+			}
+			if msg != nil && msg.Header.Type == unix.NLMSG_ERROR {
+				// The kernel rejected the request, so there is nothing more to read.
+				errno := syscall.Errno(-int32(nl.NativeEndian().Uint32(msg.Data[0:4])))
+				if errno == syscall.ENOENT {
+					return nil, ErrNotSupported
+				}
+				return nil, errno
+			}
+			if msg != nil {
+				res = append(res, msg)
 			}
 			if !shouldContinue {
+				m.lastCount[key] = len(res)
 				return res, nil
 			}
-			//	if resType != 0 && m.Header.Type != resType {
-			//		continue
-			//	}
 		}
 	}
 }
+
+// OneType handles the request and response for TCP sockets of a single type,
+// e.g. INET or INET6.
+func (m *Monitor) OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
+	var res []*syscall.NetlinkMessage
+
+	start := time.Now()
+	defer func() {
+		af := "unknown"
+		switch inetType {
+		case syscall.AF_INET:
+			af = "ipv4"
+		case syscall.AF_INET6:
+			af = "ipv6"
+		}
+		metrics.SyscallTimeHistogram.With(prometheus.Labels{"af": af}).Observe(time.Since(start).Seconds())
+		metrics.ConnectionCountHistogram.With(prometheus.Labels{"af": af}).Observe(float64(len(res)))
+	}()
+
+	res, err := m.Dump(inetType, inetdiag.Protocol_IPPROTO_TCP)
+	return res, err
+}
+
+// Dump handles the request and response for sockets of a single type and
+// protocol, e.g. INET and UDP.
+//
+// After an error, the socket may still hold part of the failed dump, or the
+// kernel may have dropped messages (ENOBUFS), so the socket is replaced and the
+// request retried once.  If the kernel can't dump the protocol, ErrNotSupported
+// is returned, and the kernel is not asked again.
+func (m *Monitor) Dump(inetType uint8, protocol inetdiag.Protocol) ([]*syscall.NetlinkMessage, error) {
+	if m.unsupported[protocol] {
+		return nil, ErrNotSupported
+	}
+	res, err := m.dump(inetType, protocol)
+	if err == ErrNotSupported {
+		log.Println("Can not collect", inetdiag.ProtocolName[int32(protocol)], "sockets:", err)
+		m.unsupported[protocol] = true
+		return nil, err
+	}
+	if err != nil {
+		// TODO - all these logs should be metrics instead.
+		log.Println(err)
+		if err == syscall.ENOBUFS {
+			metrics.ErrorCount.With(prometheus.Labels{"type": "ENOBUFS"}).Inc()
+		}
+		metrics.ErrorCount.With(prometheus.Labels{"type": "socket reset"}).Inc()
+		m.reset(inetType)
+		res, err = m.dump(inetType, protocol)
+		if err != nil {
+			log.Println(err)
+			m.reset(inetType)
+		}
+	}
+	return res, err
+}
+
+// OneType handles the request and response for a single type, e.g. INET or
+// INET6, using a new socket that is closed before returning.  Callers that
+// poll repeatedly should use a Monitor instead.
+func OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
+	m := NewMonitor(netns.None())
+	defer m.Close()
+	return m.OneType(inetType)
+}
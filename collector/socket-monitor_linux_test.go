@@ -1,6 +1,8 @@
 package collector_test
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -11,6 +13,7 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/collector"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 )
 
@@ -64,6 +67,175 @@ func TestOneType(t *testing.T) {
 	}
 }
 
+func TestOneTypeFilter(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	rtx.Must(err, "Could not dial")
+	defer c.Close()
+	s, err := l.Accept()
+	rtx.Must(err, "Could not accept")
+	defer s.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	rtx.Must(collector.Filter.Set(fmt.Sprintf("sport == %d or dport == %d", port, port)), "Could not set filter")
+	defer collector.Filter.Set("")
+
+	// The listener, and both ends of the connection.
+	res, err := collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not query sockets")
+	if len(res) != 3 {
+		t.Error("Expected 3 sockets, got", len(res))
+	}
+
+	rtx.Must(collector.Filter.Set(fmt.Sprintf("src 127.0.0.0/8 and not dst 10.0.0.0/8 and (sport == %d or dport == %d)", port, port)), "Could not set filter")
+	res, err = collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not query sockets")
+	if len(res) != 3 {
+		t.Error("Expected 3 sockets, got", len(res))
+	}
+
+	rtx.Must(collector.Filter.Set(fmt.Sprintf("sport == %d and dport == %d", port, port)), "Could not set filter")
+	res, err = collector.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not query sockets")
+	if len(res) != 0 {
+		t.Error("Expected no sockets, got", len(res))
+	}
+}
+
+// openConnections opens n TCP connections over localhost, and returns a
+// function that closes them.
+func openConnections(n int) func() {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		c, err := net.Dial("tcp4", l.Addr().String())
+		rtx.Must(err, "Could not dial")
+		s, err := l.Accept()
+		rtx.Must(err, "Could not accept")
+		conns = append(conns, c, s)
+	}
+	return func() {
+		l.Close()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	defer openConnections(5)()
+
+	m := collector.NewMonitor(netns.None())
+	defer m.Close()
+	first, err := m.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not query sockets")
+	if len(first) < 11 {
+		t.Error("Expected at least 11 sockets, got", len(first))
+	}
+	saved := make([][]byte, len(first))
+	for i := range first {
+		saved[i] = append([]byte{}, first[i].Data...)
+	}
+
+	s1, _, err := m.Socket(syscall.AF_INET)
+	rtx.Must(err, "Could not get socket")
+	_, err = m.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not query sockets")
+	s2, _, err := m.Socket(syscall.AF_INET)
+	rtx.Must(err, "Could not get socket")
+	if s1 != s2 {
+		t.Error("Socket should be reused")
+	}
+
+	// Leave the response to an abandoned request in the socket.  The next
+	// query should see the wrong sequence number, and recover with a new socket.
+	rtx.Must(s1.Send(collector.MakeReq(syscall.AF_INET, inetdiag.Protocol_IPPROTO_TCP)), "Could not send")
+	res, err := m.OneType(syscall.AF_INET)
+	rtx.Must(err, "Monitor should have recovered")
+	if len(res) < 11 {
+		t.Error("Expected at least 11 sockets, got", len(res))
+	}
+	s3, _, err := m.Socket(syscall.AF_INET)
+	rtx.Must(err, "Could not get socket")
+	if s3 == s1 {
+		t.Error("Socket should have been replaced")
+	}
+
+	// Messages returned earlier must not be overwritten by later receives.
+	for i := 0; i < 100; i++ {
+		_, err = m.OneType(syscall.AF_INET)
+		rtx.Must(err, "Could not query sockets")
+	}
+	for i := range first {
+		if !bytes.Equal(saved[i], first[i].Data) {
+			t.Fatal("Message", i, "was overwritten")
+		}
+	}
+
+	// A closed monitor opens new sockets as needed.
+	m.Close()
+	_, err = m.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not query sockets")
+}
+
+func TestDumpUDP(t *testing.T) {
+	// An unconnected server socket, and a connected client.
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen")
+	defer server.Close()
+	client, err := net.Dial("udp4", server.LocalAddr().String())
+	rtx.Must(err, "Could not dial")
+	defer client.Close()
+
+	port := server.LocalAddr().(*net.UDPAddr).Port
+	rtx.Must(collector.Filter.Set(fmt.Sprintf("sport == %d or dport == %d", port, port)), "Could not set filter")
+	defer collector.Filter.Set("")
+
+	m := collector.NewMonitor(netns.None())
+	defer m.Close()
+	res, err := m.Dump(syscall.AF_INET, inetdiag.Protocol_IPPROTO_UDP)
+	if err == collector.ErrNotSupported {
+		t.Skip("Kernel can not dump UDP sockets")
+	}
+	rtx.Must(err, "Could not dump UDP sockets")
+	if len(res) != 2 {
+		t.Error("Expected 2 UDP sockets, got", len(res))
+	}
+	// The TCP dump with the same filter should find nothing.
+	res, err = m.OneType(syscall.AF_INET)
+	rtx.Must(err, "Could not query sockets")
+	if len(res) != 0 {
+		t.Error("Expected no TCP sockets, got", len(res))
+	}
+}
+
+// BenchmarkOneType uses a new socket, and new buffers, for every query.
+func BenchmarkOneType(b *testing.B) {
+	defer openConnections(100)()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := collector.OneType(syscall.AF_INET)
+		rtx.Must(err, "Could not query sockets")
+	}
+}
+
+// BenchmarkMonitorOneType reuses the socket and buffers.
+func BenchmarkMonitorOneType(b *testing.B) {
+	defer openConnections(100)()
+	m := collector.NewMonitor(netns.None())
+	defer m.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := m.OneType(syscall.AF_INET)
+		rtx.Must(err, "Could not query sockets")
+	}
+}
+
 func TestProcessSingleMessageErrorPaths(t *testing.T) {
 	var m syscall.NetlinkMessage
 	m.Header.Seq = 1
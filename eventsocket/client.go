@@ -5,8 +5,8 @@ import (
 	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
-	"net"
 	"strings"
 	"time"
 
@@ -15,27 +15,86 @@ import (
 )
 
 var (
-	// Filename is a command-line flag holding the name of the unix-domain
-	// socket that should be used by the client and server. It is put here in an
-	// attempt to have just one standard flag name.
-	Filename = flag.String("tcpinfo.eventsocket", "", "The filename of the unix-domain socket on which events are served.")
+	// Filename is a command-line flag holding the address that should be used
+	// by the client and server. It is put here in an attempt to have just one
+	// standard flag name.
+	Filename = flag.String("tcpinfo.eventsocket", "", "The address on which events are served: the filename of a unix-domain socket, or unix:///path, tcp://host:port or ws://host:port/path.  ws:// clients are not authenticated, so ws:// addresses must be loopback addresses, as must tcp:// addresses without TLS client certificates.")
 )
 
 // Handler is the interface that all interested users of the event socket
 // notifications should implement. It has two methods, one called on Open events
-// and one called on Close events.
+// and one called on Close events.  Open is first called for the flows that were
+// already open when the client connected.  Handlers may also implement
+// StateHandler and StatsHandler, to get the other kinds of events.
 type Handler interface {
 	Open(ctx context.Context, timestamp time.Time, uuid string, ID *inetdiag.SockID)
 	Close(ctx context.Context, timestamp time.Time, uuid string)
 }
 
-// MustRun will read from the passed-in socket filename until the context is
-// cancelled. Any errors are fatal.
-func MustRun(ctx context.Context, socket string, handler Handler) {
+// StateHandler is an optional interface for Handlers that also want StateChange
+// events.  Handlers that do not implement it never see them.
+type StateHandler interface {
+	StateChange(ctx context.Context, timestamp time.Time, uuid string, state string)
+}
+
+// StatsHandler is an optional interface for Handlers that also want Stats events.
+// Handlers that do not implement it never see them.
+type StatsHandler interface {
+	Stats(ctx context.Context, timestamp time.Time, uuid string, stats *FlowStats)
+}
+
+// Option configures MustRun.
+type Option func(*runConfig)
+
+type runConfig struct {
+	subscription *Subscription
+	tls          TLSFiles
+}
+
+// WithSubscription makes MustRun subscribe to the events matching sub, so that
+// the handler only sees those.
+func WithSubscription(sub Subscription) Option {
+	return func(rc *runConfig) {
+		rc.subscription = &sub
+	}
+}
+
+// WithTLS makes MustRun use files, rather than the -tcpinfo.eventsocket.tls-*
+// flags, to configure TLS for tcp:// addresses.
+func WithTLS(files TLSFiles) Option {
+	return func(rc *runConfig) {
+		rc.tls = files
+	}
+}
+
+// MustRun will read from the passed-in socket address, as described by the
+// -tcpinfo.eventsocket flag, until the context is cancelled. Any errors are
+// fatal.
+func MustRun(ctx context.Context, socket string, handler Handler, opts ...Option) {
+	rc := runConfig{tls: tlsFlags()}
+	for _, opt := range opts {
+		opt(&rc)
+	}
+	var f *filter
+	if rc.subscription != nil {
+		var err error
+		f, err = rc.subscription.filter()
+		rtx.Must(err, "Bad subscription")
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	c, err := net.Dial("unix", socket)
+	c, err := dial(socket, rc.tls)
 	rtx.Must(err, "Could not connect to %q", socket)
+	// Subscribe even to everything, so that the server does not wait for it.
+	sub := rc.subscription
+	if sub == nil {
+		sub = &Subscription{}
+	}
+	b, err := json.Marshal(sub)
+	rtx.Must(err, "Could not marshal the subscription")
+	_, err = fmt.Fprintln(c, string(b))
+	rtx.Must(err, "Could not subscribe")
 	go func() {
 		// Close the connection when the context is done. Closing the underlying
 		// connection means that the scanner will soon terminate.
@@ -48,11 +107,23 @@ func MustRun(ctx context.Context, socket string, handler Handler) {
 	for s.Scan() {
 		var event FlowEvent
 		rtx.Must(json.Unmarshal(s.Bytes(), &event), "Could not unmarshall")
+		// Older servers may send other events before they get the subscription.
+		if !f.matches(&event) {
+			continue
+		}
 		switch event.Event {
 		case Open:
 			handler.Open(ctx, event.Timestamp, event.UUID, event.ID)
 		case Close:
 			handler.Close(ctx, event.Timestamp, event.UUID)
+		case StateChange:
+			if h, ok := handler.(StateHandler); ok {
+				h.StateChange(ctx, event.Timestamp, event.UUID, event.State)
+			}
+		case Stats:
+			if h, ok := handler.(StatsHandler); ok && event.Stats != nil {
+				h.Stats(ctx, event.Timestamp, event.UUID, event.Stats)
+			}
 		default:
 			log.Println("Unknown event type:", event.Event)
 		}
@@ -2,6 +2,7 @@ package eventsocket
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 type testHandler struct {
@@ -27,6 +29,41 @@ func (t *testHandler) Close(ctx context.Context, timestamp time.Time, uuid strin
 	t.wg.Done()
 }
 
+// waitForClients busy waits until the server has registered n clients, as events
+// sent before then are not received.
+func waitForClients(srv *server, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		srv.mutex.Lock()
+		length := len(srv.clients)
+		srv.mutex.Unlock()
+		if length >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Sprintf("timed out waiting for %d clients, got %d", n, length))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fullHandler also implements the optional handler interfaces.
+type fullHandler struct {
+	testHandler
+	states []string
+	stats  []*FlowStats
+}
+
+func (t *fullHandler) StateChange(ctx context.Context, timestamp time.Time, uuid string, state string) {
+	t.states = append(t.states, state)
+	t.wg.Done()
+}
+
+func (t *fullHandler) Stats(ctx context.Context, timestamp time.Time, uuid string, stats *FlowStats) {
+	t.stats = append(t.stats, stats)
+	t.wg.Done()
+}
+
 func TestClient(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -48,6 +85,7 @@ func TestClient(t *testing.T) {
 		clientWg.Done()
 	}()
 	th.wg.Add(2)
+	waitForClients(srv, 1)
 
 	// Send an open event
 	srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
@@ -57,6 +95,9 @@ func TestClient(t *testing.T) {
 		Timestamp: time.Now(),
 		UUID:      "fakeuuid",
 	}
+	// Events the handler does not handle are skipped.
+	srv.FlowStateChanged(time.Now(), "fakeuuid", tcp.FIN_WAIT1)
+	srv.FlowStatsUpdated(time.Now(), "fakeuuid", FlowStats{})
 	// Send a deletion event
 	srv.FlowDeleted(time.Now(), "fakeuuid")
 	th.wg.Wait() // Wait until the handler gets two events!
@@ -65,3 +106,80 @@ func TestClient(t *testing.T) {
 	cancel()
 	clientWg.Wait()
 }
+
+func TestClientOptionalHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestEventSocketClientOptionalHandlers")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	srv := New(dir + "/tcpevents.sock").(*server)
+	srv.Listen()
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	go srv.Serve(srvCtx)
+	defer srvCancel()
+
+	fh := &fullHandler{}
+	clientWg := sync.WaitGroup{}
+	clientWg.Add(1)
+	go func() {
+		MustRun(ctx, dir+"/tcpevents.sock", fh)
+		clientWg.Done()
+	}()
+	fh.wg.Add(4)
+	waitForClients(srv, 1)
+
+	srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
+	srv.FlowStateChanged(time.Now(), "fakeuuid", tcp.FIN_WAIT1)
+	srv.FlowStatsUpdated(time.Now(), "fakeuuid", FlowStats{RTT: 1000})
+	srv.FlowDeleted(time.Now(), "fakeuuid")
+	fh.wg.Wait()
+
+	if len(fh.states) != 1 || fh.states[0] != "FIN_WAIT1" {
+		t.Error("Wrong states:", fh.states)
+	}
+	if len(fh.stats) != 1 || fh.stats[0].RTT != 1000 {
+		t.Error("Wrong stats:", fh.stats)
+	}
+	cancel()
+	clientWg.Wait()
+}
+
+func TestClientSubscription(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestEventSocketClientSubscription")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	srv := New(dir + "/tcpevents.sock").(*server)
+	srv.Listen()
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	go srv.Serve(srvCtx)
+	defer srvCancel()
+
+	th := &testHandler{}
+	clientWg := sync.WaitGroup{}
+	clientWg.Add(1)
+	go func() {
+		MustRun(ctx, dir+"/tcpevents.sock", th, WithSubscription(Subscription{UUIDs: []string{"mine"}}))
+		clientWg.Done()
+	}()
+	th.wg.Add(2)
+	waitForClients(srv, 1)
+
+	// Events for other flows are never handled, even if they are sent before the
+	// server gets the subscription.
+	srv.FlowCreated(time.Now(), "other", inetdiag.SockID{})
+	srv.FlowCreated(time.Now(), "mine", inetdiag.SockID{})
+	srv.FlowDeleted(time.Now(), "other")
+	srv.FlowDeleted(time.Now(), "mine")
+	th.wg.Wait()
+	if th.opens != 1 || th.closes != 1 {
+		t.Error("Wrong events handled:", th.opens, th.closes)
+	}
+
+	cancel()
+	clientWg.Wait()
+}
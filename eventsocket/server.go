@@ -1,22 +1,28 @@
 package eventsocket
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
-	"fmt"
+	"flag"
 	"log"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/m-lab/go/flagx"
+
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 //go:generate stringer -type=TCPEvent
 
-// TCPEvent refers to the kind of socket event that has occurred. Right now, we
-// support Open and Close events, but it is not impossible to imagine future
-// versions that do more.
+// TCPEvent refers to the kind of socket event that has occurred.  Clients should
+// ignore kinds they do not know about, as future versions may add more.
 type TCPEvent int
 
 const (
@@ -24,16 +30,41 @@ const (
 	Open = TCPEvent(iota)
 	// Close is sent when a TCP connection is closed.
 	Close
+	// StateChange is sent when a saved record of a TCP connection has a different
+	// state than the previous one.
+	StateChange
+	// Stats is sent with the latest stats of a TCP connection, whenever a record
+	// of it is saved.
+	Stats
 )
 
+// FlowStats are the stats of a TCP connection sent with Stats events.  They come
+// from its TCPInfo.
+type FlowStats struct {
+	BytesAcked    uint64
+	BytesReceived uint64
+	BytesSent     uint64
+	RTT           uint32 // Smoothed RTT, in microseconds.
+	RTTVar        uint32 // RTT variance, in microseconds.
+	MinRTT        uint32 // In microseconds.
+	SndCwnd       uint32 // Congestion window, in segments.
+	DeliveryRate  uint64 // Most recent delivery rate, in bytes per second.
+}
+
 // FlowEvent is the data that is sent down the socket in JSONL form to the
 // clients. The UUID, Timestamp, and Event fields will always be filled in, all
-// other fields are optional.
+// other fields are optional.  The ID is filled in for all the events of flows
+// whose Open event was sent.
 type FlowEvent struct {
 	Event     TCPEvent
 	Timestamp time.Time
 	UUID      string
 	ID        *inetdiag.SockID //`json:",omitempty"`
+	State     string           `json:",omitempty"` // The new state, e.g. FIN_WAIT1, for StateChange events.
+	Stats     *FlowStats       `json:",omitempty"` // For Stats events.
+	// Replay is set on the Open events of the flows that were already open when
+	// the client connected.  They are sent before any other event.
+	Replay bool `json:",omitempty"`
 }
 
 // Server is the interface that has the methods that actually serve the events
@@ -46,48 +77,246 @@ type Server interface {
 	FlowDeleted(timestamp time.Time, uuid string)
 }
 
+// StateServer is an optional interface for Servers that also serve StateChange
+// events.  Servers that do not implement it are not told about state changes.
+type StateServer interface {
+	FlowStateChanged(timestamp time.Time, uuid string, state tcp.State)
+}
+
+// StatsServer is an optional interface for Servers that also serve Stats events.
+// Servers that do not implement it are not told about stats.
+type StatsServer interface {
+	FlowStatsUpdated(timestamp time.Time, uuid string, stats FlowStats)
+}
+
+// Command-line flags setting how the server treats clients that fall behind.
+var (
+	ClientQueueSize = flag.Int("tcpinfo.eventsocket.client-queue", 1000, "How many events may wait to be sent to each client of the event socket.")
+	SlowClients     = flagx.Enum{
+		Options: []string{"drop", "disconnect"},
+		Value:   "drop",
+	}
+)
+
+func init() {
+	flag.Var(&SlowClients, "tcpinfo.eventsocket.slow-clients", "What to do with events for a client whose queue is full: \"drop\" them, or \"disconnect\" the client.")
+}
+
+// client is a connected client.  Its events are queued, and written by a
+// goroutine of its own, so that slow clients do not hold up the others.
+type client struct {
+	conn   net.Conn
+	id     string  // Identifies the client in metrics.
+	filter *filter // The subscription of the client, if any.
+	queue  chan []byte
+}
+
 type server struct {
-	eventC       chan *FlowEvent
-	filename     string
-	clients      map[net.Conn]struct{}
-	unixListener net.Listener
-	mutex        sync.Mutex
-	servingWG    sync.WaitGroup
+	eventC         chan *FlowEvent
+	address        string
+	tls            TLSFiles // For tcp:// addresses.
+	clients        map[net.Conn]*client
+	pending        map[net.Conn]*filter  // The subscriptions of clients that are not added yet.
+	flows          map[string]*FlowEvent // The Open events of the flows that are still open.
+	closed         bool                  // Set once Serve shuts down, after which no clients are added.
+	listener       net.Listener
+	mutex          sync.Mutex
+	servingWG      sync.WaitGroup
+	queueSize      int  // The capacity of the queue of each client.
+	disconnectSlow bool // Disconnect clients whose queue is full, rather than drop events.
+	lastID         int
 }
 
+// subscriptionWait is how long the server waits for the subscription of a new
+// client, before it sends it the events of the flows already open.
+var subscriptionWait = 100 * time.Millisecond
+
+// serveClient waits for the subscription of a new client, or for subscriptionWait,
+// and then adds it, so that its subscription applies to the replayed flows too.
+func (s *server) serveClient(c net.Conn) {
+	subscribed := make(chan struct{})
+	go s.readSubscriptions(c, subscribed)
+	timer := time.NewTimer(subscriptionWait)
+	defer timer.Stop()
+	select {
+	case <-subscribed:
+	case <-timer.C:
+	}
+	s.addClient(c)
+}
+
+// addClient adds a client, with its subscription, if it has sent one, and queues
+// the replay of the open flows that match it.
 func (s *server) addClient(c net.Conn) {
-	log.Println("Adding new TCP event client", c)
+	log.Println("Adding new TCP event client", c.RemoteAddr())
+	// Marshal the replay of the flows that are open without holding the mutex, so
+	// that events are not held up while there are many.
+	s.mutex.Lock()
+	snapshot := make([]*FlowEvent, 0, len(s.flows))
+	for _, open := range s.flows {
+		snapshot = append(snapshot, open)
+	}
+	s.mutex.Unlock()
+	replays := make(map[*FlowEvent][]byte, len(snapshot))
+	for _, open := range snapshot {
+		replays[open] = marshalReplay(open)
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.clients[c] = struct{}{}
+	if s.closed {
+		c.Close()
+		return
+	}
+	s.lastID++
+	cl := &client{conn: c, id: strconv.Itoa(s.lastID), filter: s.pending[c], queue: make(chan []byte, s.queueSize+len(s.flows))}
+	delete(s.pending, c)
+	// Replay the flows that are open now, oldest first, marshalling only those that
+	// opened since the snapshot.  As sendToAllListeners holds the mutex too, every
+	// later event is queued after them, and every earlier one is reflected in them.
+	opens := make([]*FlowEvent, 0, len(s.flows))
+	for _, open := range s.flows {
+		if cl.filter.matches(open) {
+			opens = append(opens, open)
+		}
+	}
+	sort.Slice(opens, func(i, j int) bool {
+		return opens[i].Timestamp.Before(opens[j].Timestamp)
+	})
+	for _, open := range opens {
+		b, ok := replays[open]
+		if !ok {
+			b = marshalReplay(open)
+		}
+		if b != nil {
+			cl.queue <- b
+		}
+	}
+	s.clients[c] = cl
+	go s.writeToClient(cl)
 }
 
-func (s *server) removeClient(c net.Conn) {
-	s.servingWG.Add(1)
-	defer s.servingWG.Done()
+// marshalReplay returns the line replaying the Open event of a flow, or nil if it
+// can not be marshalled.
+func marshalReplay(open *FlowEvent) []byte {
+	replay := *open
+	replay.Replay = true
+	b, err := json.Marshal(replay)
+	if err != nil {
+		log.Printf("WARNING: Bad event received %v (err: %v)\n", open, err)
+		return nil
+	}
+	return append(b, '\n')
+}
+
+// writeToClient writes the queued events to a client, until its queue is closed, or
+// a write fails.
+func (s *server) writeToClient(cl *client) {
+	defer metrics.EventClientLag.DeleteLabelValues(cl.id)
+	for b := range cl.queue {
+		metrics.EventClientLag.WithLabelValues(cl.id).Set(float64(len(cl.queue)))
+		_, err := cl.conn.Write(b)
+		if err != nil {
+			log.Println("Write to client", cl.conn.RemoteAddr(), "failed with error", err, " - removing the client.")
+			s.mutex.Lock()
+			if s.clients[cl.conn] == cl {
+				s.removeClientLocked(cl)
+			}
+			s.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// readSubscriptions reads the subscriptions sent by a client until it disconnects,
+// and then removes the client.  Each subscription replaces the previous one.
+// subscribed is closed after the first line, or once the client disconnects.
+func (s *server) readSubscriptions(c net.Conn, subscribed chan struct{}) {
+	defer func() {
+		if subscribed != nil {
+			close(subscribed)
+		}
+	}()
+	r := bufio.NewScanner(c)
+	for r.Scan() {
+		s.subscribe(c, r.Bytes())
+		if subscribed != nil {
+			close(subscribed)
+			subscribed = nil
+		}
+	}
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	_, ok := s.clients[c]
-	if !ok {
-		log.Println("Tried to remove TCP event client", c, "that was not present")
+	if cl, ok := s.clients[c]; ok {
+		s.removeClientLocked(cl)
+	}
+	delete(s.pending, c)
+	s.mutex.Unlock()
+}
+
+// subscribe applies a line of subscription from a client, or keeps it for
+// addClient if the client is not added yet.
+func (s *server) subscribe(c net.Conn, line []byte) {
+	var sub Subscription
+	err := json.Unmarshal(line, &sub)
+	if err != nil {
+		log.Println("Bad subscription from TCP event client", c.RemoteAddr(), err)
 		return
 	}
-	delete(s.clients, c)
+	f, err := sub.filter()
+	if err != nil {
+		log.Println("Bad subscription from TCP event client", c.RemoteAddr(), err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if cl, ok := s.clients[c]; ok {
+		cl.filter = f
+	} else {
+		s.pending[c] = f
+	}
 }
 
-func (s *server) sendToAllListeners(data string) {
+// removeClientLocked removes a client, and closes its connection.  The caller must
+// hold the mutex.
+func (s *server) removeClientLocked(cl *client) {
+	delete(s.clients, cl.conn)
+	close(cl.queue)
+	cl.conn.Close()
+}
+
+func (s *server) sendToAllListeners(event *FlowEvent) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	for c := range s.clients {
-		_, err := fmt.Fprintln(c, data)
-		if err != nil {
-			log.Println("Write to client", c, "failed with error", err, " - removing the client.")
-			// Remove in a goroutine because removeClient needs to grab the
-			// mutex, so let the goroutine block until the mutex is released
-			// when this method returns. This also prevents mid-iteration
-			// modification of s.clients.
-			go s.removeClient(c)
-			go c.Close()
+	// Remember the open flows, to replay them to new clients, and so that their
+	// other events can be filtered by port and address too.
+	if event.Event == Open {
+		s.flows[event.UUID] = event
+	} else if open, ok := s.flows[event.UUID]; ok && event.ID == nil {
+		event.ID = open.ID
+	}
+	if event.Event == Close {
+		delete(s.flows, event.UUID)
+	}
+	b, err := json.Marshal(*event)
+	if err != nil {
+		log.Printf("WARNING: Bad event received %v (err: %v)\n", event, err)
+		return
+	}
+	b = append(b, '\n')
+	for _, cl := range s.clients {
+		if !cl.filter.matches(event) {
+			continue
+		}
+		select {
+		case cl.queue <- b:
+			metrics.EventClientLag.WithLabelValues(cl.id).Set(float64(len(cl.queue)))
+		default:
+			metrics.EventsDropped.Inc()
+			if s.disconnectSlow {
+				log.Println("TCP event client", cl.conn.RemoteAddr(), "fell behind - removing the client.")
+				metrics.EventClientsDisconnected.Inc()
+				s.removeClientLocked(cl)
+			}
 		}
 	}
 }
@@ -97,16 +326,11 @@ func (s *server) notifyClients(ctx context.Context) {
 	defer s.servingWG.Done()
 	for ctx.Err() == nil {
 		event := <-s.eventC
-		var b []byte
-		var err error
-		if event != nil {
-			b, err = json.Marshal(*event)
-		}
-		if event == nil || err != nil {
-			log.Printf("WARNING: Bad event received %v (err: %v)\n", event, err)
+		if event == nil {
+			log.Printf("WARNING: Bad event received %v\n", event)
 			continue
 		}
-		s.sendToAllListeners(string(b))
+		s.sendToAllListeners(event)
 	}
 }
 
@@ -120,7 +344,7 @@ func (s *server) Listen() error {
 	// definitely wait for Serve() to finish.
 	s.servingWG.Add(1)
 	var err error
-	s.unixListener, err = net.Listen("unix", s.filename)
+	s.listener, err = listen(s.address, s.tls)
 	return err
 }
 
@@ -141,20 +365,26 @@ func (s *server) Serve(ctx context.Context) error {
 	s.servingWG.Add(1) // Add this cleanup goroutine to the waitgroup.
 	go func() {
 		<-derivedCtx.Done()
-		s.unixListener.Close()
+		s.listener.Close()
 		close(s.eventC)
+		s.mutex.Lock()
+		s.closed = true
+		for _, cl := range s.clients {
+			s.removeClientLocked(cl)
+		}
+		s.mutex.Unlock()
 		s.servingWG.Done()
 	}()
 
 	var err error
 	for derivedCtx.Err() == nil {
 		var conn net.Conn
-		conn, err = s.unixListener.Accept()
+		conn, err = s.listener.Accept()
 		if err != nil {
-			log.Printf("Could not Accept on socket %q: %s\n", s.filename, err)
+			log.Printf("Could not Accept on socket %q: %s\n", s.address, err)
 			continue
 		}
-		s.addClient(conn)
+		go s.serveClient(conn)
 	}
 	return err
 }
@@ -178,13 +408,60 @@ func (s *server) FlowDeleted(timestamp time.Time, uuid string) {
 	}
 }
 
-// New makes a new server that serves clients on the provided Unix domain socket.
-func New(filename string) Server {
+// sendOptional queues an event that clients can do without, such as Stats, without
+// waiting.  It is dropped if the queue is half full, so that room is left for the
+// Open and Close events that clients track flows with, and so that the caller is
+// never held up by them.
+func (s *server) sendOptional(event *FlowEvent) {
+	if len(s.eventC) < cap(s.eventC)/2 {
+		select {
+		case s.eventC <- event:
+			return
+		default:
+		}
+	}
+	metrics.EventsDropped.Inc()
+}
+
+// FlowStateChanged should be called whenever tcpinfo saves a record of a flow with
+// a different state than the previous one.  The event is dropped if the server
+// falls behind.
+func (s *server) FlowStateChanged(timestamp time.Time, uuid string, state tcp.State) {
+	s.sendOptional(&FlowEvent{
+		Event:     StateChange,
+		Timestamp: timestamp,
+		UUID:      uuid,
+		State:     state.String(),
+	})
+}
+
+// FlowStatsUpdated should be called whenever tcpinfo saves a record of a flow.  The
+// event is dropped if the server falls behind.
+func (s *server) FlowStatsUpdated(timestamp time.Time, uuid string, stats FlowStats) {
+	s.sendOptional(&FlowEvent{
+		Event:     Stats,
+		Timestamp: timestamp,
+		UUID:      uuid,
+		Stats:     &stats,
+	})
+}
+
+// New makes a new server that serves clients on the provided address: the filename
+// of a Unix domain socket, or a unix://, tcp:// or ws:// URL.  tcp:// addresses use
+// TLS as configured by the -tcpinfo.eventsocket.tls-* flags.  ws:// clients are not
+// authenticated, so Listen fails for ws:// addresses, and tcp:// addresses without
+// client certificates, that are not loopback addresses.
+func New(address string) Server {
 	c := make(chan *FlowEvent, 100)
 	return &server{
-		filename: filename,
-		eventC:   c,
-		clients:  make(map[net.Conn]struct{}),
+		address:        address,
+		tls:            tlsFlags(),
+		eventC:         c,
+		clients:        make(map[net.Conn]*client),
+		pending:        make(map[net.Conn]*filter),
+		flows:          make(map[string]*FlowEvent),
+		queueSize:      *ClientQueueSize,
+		disconnectSlow: SlowClients.Value == "disconnect",
 	}
 }
 
@@ -4,17 +4,23 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 func TestServer(t *testing.T) {
@@ -66,23 +72,41 @@ func TestServer(t *testing.T) {
 		t.Error("It should be true that", before, "<", event.Timestamp, "<", after)
 	}
 	event.Timestamp = time.Time{}
-	if diff := deep.Equal(event, FlowEvent{Open, time.Time{}, "fakeuuid2", &emptyID}); diff != nil {
+	if diff := deep.Equal(event, FlowEvent{Event: Open, UUID: "fakeuuid2", ID: &emptyID}); diff != nil {
 		t.Error("Event differed from expected:", diff)
 	}
 
-	// Close down things on the client side. When the server next tries to send
-	// something to the client, the client should get removed from the set of
-	// active clients.
+	// State changes and stats have their own fields.
+	srv.FlowStateChanged(time.Now(), "fakeuuid2", tcp.FIN_WAIT1)
+	if !r.Scan() {
+		t.Error("Should have been able to scan until the next newline, but couldn't")
+	}
+	event = FlowEvent{}
+	rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshall")
+	event.Timestamp = time.Time{}
+	if diff := deep.Equal(event, FlowEvent{Event: StateChange, UUID: "fakeuuid2", ID: &emptyID, State: "FIN_WAIT1"}); diff != nil {
+		t.Error("Event differed from expected:", diff)
+	}
+	stats := FlowStats{BytesAcked: 1, BytesReceived: 2, BytesSent: 3, RTT: 4, RTTVar: 5, MinRTT: 6, SndCwnd: 7, DeliveryRate: 8}
+	srv.FlowStatsUpdated(time.Now(), "fakeuuid2", stats)
+	if !r.Scan() {
+		t.Error("Should have been able to scan until the next newline, but couldn't")
+	}
+	event = FlowEvent{}
+	rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshall")
+	event.Timestamp = time.Time{}
+	if diff := deep.Equal(event, FlowEvent{Event: Stats, UUID: "fakeuuid2", ID: &emptyID, Stats: &stats}); diff != nil {
+		t.Error("Event differed from expected:", diff)
+	}
+
+	// Close down things on the client side. The server should notice that the
+	// client disconnected, and remove it from the set of active clients.
 	c.Close()
 
 	// Now verify some internal error handling:
 	srv.eventC <- nil
-	srv.removeClient(nil)
 	// No SIGSEGV == success!
 
-	// Send an event to ensure that cleanup should occur.
-	srv.FlowDeleted(time.Now(), "fakeuuid")
-
 	// Busy wait until the server has unregistered the client
 	for {
 		srv.mutex.Lock()
@@ -99,6 +123,281 @@ func TestServer(t *testing.T) {
 	// No timeout == success!
 }
 
+func TestServerSubscription(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestEventSocketServerSubscription")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	srv := New(dir + "/tcpevents.sock").(*server)
+	srv.Listen()
+	go srv.Serve(ctx)
+	c, err := net.Dial("unix", dir+"/tcpevents.sock")
+	rtx.Must(err, "Could not open UNIX domain socket")
+	defer c.Close()
+	_, err = c.Write([]byte(`{"Events":[0,1],"Ports":[{"Min":443,"Max":443}]}` + "\n"))
+	rtx.Must(err, "Could not subscribe")
+
+	// Busy wait until the server has the subscription.
+	for {
+		srv.mutex.Lock()
+		subscribed := false
+		for _, cl := range srv.clients {
+			subscribed = cl.filter != nil
+		}
+		srv.mutex.Unlock()
+		if subscribed {
+			break
+		}
+	}
+
+	srv.FlowCreated(time.Now(), "http", inetdiag.SockID{SPort: 80})
+	srv.FlowCreated(time.Now(), "https", inetdiag.SockID{SPort: 443})
+	srv.FlowStateChanged(time.Now(), "https", tcp.FIN_WAIT1)
+	srv.FlowDeleted(time.Now(), "http")
+	srv.FlowDeleted(time.Now(), "https")
+	srv.FlowCreated(time.Now(), "https2", inetdiag.SockID{DPort: 443})
+
+	r := bufio.NewScanner(c)
+	var got []string
+	for len(got) < 3 && r.Scan() {
+		var event FlowEvent
+		rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshall")
+		got = append(got, event.Event.String()+" "+event.UUID)
+	}
+	if diff := deep.Equal(got, []string{"Open https", "Close https", "Open https2"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// gatedConn is a client connection whose writes wait for the gate to open.
+type gatedConn struct {
+	net.Conn
+	gate    chan struct{}
+	writing chan struct{} // Receives a value whenever a write starts.
+	mutex   sync.Mutex
+	lines   []string
+	closed  bool
+}
+
+func newGatedConn() *gatedConn {
+	return &gatedConn{gate: make(chan struct{}), writing: make(chan struct{}, 100)}
+}
+
+func (gc *gatedConn) Write(b []byte) (int, error) {
+	gc.writing <- struct{}{}
+	<-gc.gate
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+	gc.lines = append(gc.lines, string(b))
+	return len(b), nil
+}
+
+func (gc *gatedConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: "gated", Net: "unix"}
+}
+
+func (gc *gatedConn) Close() error {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+	gc.closed = true
+	return nil
+}
+
+func (gc *gatedConn) state() (int, bool) {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+	return len(gc.lines), gc.closed
+}
+
+func TestReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestEventSocketReplay")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	srv := New(dir + "/tcpevents.sock").(*server)
+	srv.Listen()
+	go srv.Serve(ctx)
+
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	srv.FlowCreated(start.Add(2*time.Second), "b", inetdiag.SockID{SPort: 2})
+	srv.FlowCreated(start, "a", inetdiag.SockID{SPort: 1})
+	srv.FlowCreated(start.Add(time.Second), "c", inetdiag.SockID{SPort: 3})
+	srv.FlowDeleted(start.Add(3*time.Second), "c")
+	// Wait until the server has handled the events.
+	for {
+		srv.mutex.Lock()
+		length := len(srv.flows)
+		srv.mutex.Unlock()
+		if length == 2 {
+			break
+		}
+	}
+
+	// Flows keep opening while the client connects.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			srv.FlowCreated(time.Now(), fmt.Sprint("d", i), inetdiag.SockID{SPort: 4})
+		}
+		close(done)
+	}()
+	c, err := net.Dial("unix", dir+"/tcpevents.sock")
+	rtx.Must(err, "Could not open UNIX domain socket")
+	defer c.Close()
+	waitForClients(srv, 1)
+	<-done
+	srv.FlowDeleted(time.Now(), "a")
+
+	// The flows that were open are replayed oldest first, then all the later
+	// events are sent.  Every flow is opened exactly once before it is closed.
+	r := bufio.NewScanner(c)
+	opened := map[string]bool{}
+	var replayed []string
+	for r.Scan() {
+		var event FlowEvent
+		rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshall")
+		if event.Replay {
+			if len(opened) != len(replayed) {
+				t.Error("Replayed event after live events:", event)
+			}
+			replayed = append(replayed, event.UUID)
+		}
+		switch event.Event {
+		case Open:
+			if opened[event.UUID] {
+				t.Error("Duplicate open:", event)
+			}
+			opened[event.UUID] = true
+		case Close:
+			if !opened[event.UUID] {
+				t.Error("Close without open:", event)
+			}
+		}
+		if event.Event == Close && event.UUID == "a" {
+			break
+		}
+	}
+	if len(replayed) < 2 || replayed[0] != "a" || replayed[1] != "b" {
+		t.Error("Wrong replay:", replayed)
+	}
+	if len(opened) != 102 {
+		t.Error("Missing opens:", len(opened))
+	}
+}
+
+func TestSubscribedReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestEventSocketSubscribedReplay")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	// The subscription is sent right away, so the server never waits this long.
+	oldWait := subscriptionWait
+	subscriptionWait = time.Minute
+	defer func() { subscriptionWait = oldWait }()
+
+	srv := New(dir + "/tcpevents.sock").(*server)
+	srv.Listen()
+	go srv.Serve(ctx)
+
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	srv.FlowCreated(start, "https", inetdiag.SockID{SPort: 443, SrcIP: "10.0.0.1"})
+	srv.FlowCreated(start, "http", inetdiag.SockID{SPort: 80, SrcIP: "10.0.0.2"})
+	for {
+		srv.mutex.Lock()
+		length := len(srv.flows)
+		srv.mutex.Unlock()
+		if length == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A client that subscribes as it connects never sees the other flows, not even
+	// their replay, on the wire.
+	c, err := net.Dial("unix", dir+"/tcpevents.sock")
+	rtx.Must(err, "Could not open UNIX domain socket")
+	defer c.Close()
+	_, err = c.Write([]byte(`{"Ports":[{"Min":443,"Max":443}]}` + "\n"))
+	rtx.Must(err, "Could not subscribe")
+	waitForClients(srv, 1)
+	srv.FlowDeleted(time.Now(), "http")
+	srv.FlowCreated(time.Now(), "https2", inetdiag.SockID{DPort: 443, SrcIP: "10.0.0.3"})
+	srv.FlowDeleted(time.Now(), "https")
+
+	r := bufio.NewScanner(c)
+	var got []string
+	for r.Scan() {
+		line := r.Text()
+		if strings.Contains(line, "10.0.0.2") || strings.Contains(line, `"http"`) {
+			t.Error("Sent an event the client did not subscribe to:", line)
+		}
+		var event FlowEvent
+		rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshall")
+		got = append(got, fmt.Sprint(event.Event, " ", event.UUID, " ", event.Replay))
+		if event.Event == Close && event.UUID == "https" {
+			break
+		}
+	}
+	want := []string{"Open https true", "Open https2 false", "Close https false"}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error("Wrong events:", diff)
+	}
+}
+
+func TestSlowClients(t *testing.T) {
+	for _, disconnect := range []bool{false, true} {
+		dropped := testutil.ToFloat64(metrics.EventsDropped)
+		disconnected := testutil.ToFloat64(metrics.EventClientsDisconnected)
+		srv := New("unused").(*server)
+		srv.disconnectSlow = disconnect
+		fast := newGatedConn()
+		close(fast.gate)
+		srv.addClient(fast)
+		srv.queueSize = 2
+		slow := newGatedConn()
+		srv.addClient(slow)
+
+		// The slow client gets stuck writing the first event, and has room in its
+		// queue for two more.
+		srv.sendToAllListeners(&FlowEvent{Event: Open, UUID: "1"})
+		<-slow.writing
+		for _, uuid := range []string{"2", "3", "4", "5"} {
+			srv.sendToAllListeners(&FlowEvent{Event: Open, UUID: uuid})
+		}
+		if d := testutil.ToFloat64(metrics.EventsDropped) - dropped; d != 2 && !disconnect || d != 1 && disconnect {
+			t.Error("Wrong number of dropped events:", d)
+		}
+
+		// The fast client is not held up.
+		for n, _ := fast.state(); n < 5; n, _ = fast.state() {
+		}
+		close(slow.gate)
+		srv.mutex.Lock()
+		_, present := srv.clients[slow]
+		srv.mutex.Unlock()
+		if disconnect {
+			if present || testutil.ToFloat64(metrics.EventClientsDisconnected)-disconnected != 1 {
+				t.Error("The slow client should be disconnected")
+			}
+			if _, closed := slow.state(); !closed {
+				t.Error("The connection of the slow client should be closed")
+			}
+		} else {
+			if !present {
+				t.Error("The slow client should not be disconnected")
+			}
+			for n, _ := slow.state(); n < 3; n, _ = slow.state() {
+			}
+		}
+	}
+}
+
 func TestTCPEvent_String(t *testing.T) {
 	tests := []struct {
 		want string
@@ -106,7 +405,9 @@ func TestTCPEvent_String(t *testing.T) {
 	}{
 		{"Open", Open},
 		{"Close", Close},
-		{"TCPEvent(3)", TCPEvent(3)},
+		{"StateChange", StateChange},
+		{"Stats", Stats},
+		{"TCPEvent(4)", TCPEvent(4)},
 	}
 	for _, tt := range tests {
 		t.Run(tt.want, func(t *testing.T) {
@@ -117,6 +418,25 @@ func TestTCPEvent_String(t *testing.T) {
 	}
 }
 
+func TestOptionalEventsDoNotBlock(t *testing.T) {
+	// Nothing reads the events of a server that is not serving.
+	srv := New("unused").(*server)
+	dropped := testutil.ToFloat64(metrics.EventsDropped)
+	for i := 0; i < 2*cap(srv.eventC); i++ {
+		srv.FlowStatsUpdated(time.Now(), "fakeuuid", FlowStats{})
+		srv.FlowStateChanged(time.Now(), "fakeuuid", tcp.FIN_WAIT1)
+	}
+	// Half of the queue is left for Open and Close events.
+	if len(srv.eventC) != cap(srv.eventC)/2 {
+		t.Error("Wrong number of events queued:", len(srv.eventC))
+	}
+	if d := testutil.ToFloat64(metrics.EventsDropped) - dropped; d != float64(4*cap(srv.eventC)-cap(srv.eventC)/2) {
+		t.Error("Wrong number of events dropped:", d)
+	}
+	srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
+	srv.FlowDeleted(time.Now(), "fakeuuid")
+}
+
 func TestNullServer(t *testing.T) {
 	// Verify that the null server never crashes or returns a non-null error
 	ctx, cancel := context.WithCancel(context.Background())
@@ -128,3 +448,9 @@ func TestNullServer(t *testing.T) {
 	srv.FlowDeleted(time.Now(), "")
 	// No crash == success
 }
+
+// The server serves the optional events too.
+var (
+	_ StateServer = &server{}
+	_ StatsServer = &server{}
+)
@@ -0,0 +1,103 @@
+package eventsocket
+
+import (
+	"net"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// Subscription selects the events a client wants.  Clients should send one, as a
+// line of JSON, as soon as they connect: the server waits briefly for it before
+// sending anything, so that it applies to the flows already open too.  Clients
+// may send another at any time, to replace it.  Clients that send none get every
+// event.  Empty fields match everything, and an event must match all the
+// non-empty fields to be sent.
+type Subscription struct {
+	Events []TCPEvent `json:",omitempty"` // The kinds of events.
+	// Ports match flows whose local or remote port is in any of the ranges.
+	Ports []PortRange `json:",omitempty"`
+	// Prefixes match flows whose local or remote address is in any of the
+	// prefixes, in CIDR notation, e.g. 192.168.0.0/16.
+	Prefixes []string `json:",omitempty"`
+	UUIDs    []string `json:",omitempty"` // The UUIDs of the flows.
+}
+
+// filter is a parsed Subscription.  The nil filter matches all events.
+type filter struct {
+	events map[TCPEvent]bool
+	ports  []PortRange
+	nets   []*net.IPNet
+	uuids  map[string]bool
+}
+
+// filter returns the filter for the subscription, or an error if it has bad
+// prefixes.
+func (sub *Subscription) filter() (*filter, error) {
+	f := &filter{ports: sub.Ports}
+	if len(sub.Events) > 0 {
+		f.events = make(map[TCPEvent]bool, len(sub.Events))
+		for _, e := range sub.Events {
+			f.events[e] = true
+		}
+	}
+	for _, p := range sub.Prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		f.nets = append(f.nets, n)
+	}
+	if len(sub.UUIDs) > 0 {
+		f.uuids = make(map[string]bool, len(sub.UUIDs))
+		for _, u := range sub.UUIDs {
+			f.uuids[u] = true
+		}
+	}
+	return f, nil
+}
+
+// matches returns whether the event should be sent.  Events without an ID never
+// match port or prefix filters.
+func (f *filter) matches(event *FlowEvent) bool {
+	if f == nil {
+		return true
+	}
+	if f.events != nil && !f.events[event.Event] {
+		return false
+	}
+	if f.uuids != nil && !f.uuids[event.UUID] {
+		return false
+	}
+	if len(f.ports) > 0 && (event.ID == nil || !f.matchesPort(event.ID.SPort) && !f.matchesPort(event.ID.DPort)) {
+		return false
+	}
+	if len(f.nets) > 0 && (event.ID == nil || !f.matchesIP(event.ID.SrcIP) && !f.matchesIP(event.ID.DstIP)) {
+		return false
+	}
+	return true
+}
+
+func (f *filter) matchesPort(port uint16) bool {
+	for _, r := range f.ports {
+		if r.Min <= port && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) matchesIP(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
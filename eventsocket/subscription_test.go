@@ -0,0 +1,49 @@
+package eventsocket
+
+import (
+	"testing"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+func TestSubscriptionFilter(t *testing.T) {
+	id := &inetdiag.SockID{SPort: 443, DPort: 51000, SrcIP: "192.168.1.2", DstIP: "2001:db8::1"}
+	open := &FlowEvent{Event: Open, UUID: "a", ID: id}
+	tests := []struct {
+		name  string
+		sub   Subscription
+		event *FlowEvent
+		want  bool
+	}{
+		{"empty", Subscription{}, open, true},
+		{"event", Subscription{Events: []TCPEvent{Open}}, open, true},
+		{"other event", Subscription{Events: []TCPEvent{Close, Stats}}, open, false},
+		{"uuid", Subscription{UUIDs: []string{"b", "a"}}, open, true},
+		{"other uuid", Subscription{UUIDs: []string{"b"}}, open, false},
+		{"local port", Subscription{Ports: []PortRange{{443, 443}}}, open, true},
+		{"remote port", Subscription{Ports: []PortRange{{50000, 52000}}}, open, true},
+		{"other port", Subscription{Ports: []PortRange{{80, 80}, {8000, 9000}}}, open, false},
+		{"local prefix", Subscription{Prefixes: []string{"192.168.0.0/16"}}, open, true},
+		{"remote prefix", Subscription{Prefixes: []string{"10.0.0.0/8", "2001:db8::/32"}}, open, true},
+		{"other prefix", Subscription{Prefixes: []string{"10.0.0.0/8"}}, open, false},
+		{"no id", Subscription{Ports: []PortRange{{0, 65535}}}, &FlowEvent{Event: Close, UUID: "a"}, false},
+		{"all", Subscription{Events: []TCPEvent{Open}, UUIDs: []string{"a"}, Ports: []PortRange{{443, 443}}, Prefixes: []string{"192.168.1.2/32"}}, open, true},
+		{"all but one", Subscription{Events: []TCPEvent{Open}, UUIDs: []string{"a"}, Ports: []PortRange{{443, 443}}, Prefixes: []string{"192.168.1.3/32"}}, open, false},
+	}
+	for _, tt := range tests {
+		f, err := tt.sub.filter()
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		if got := f.matches(tt.event); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// The nil filter matches everything.
+	if !(*filter)(nil).matches(open) {
+		t.Error("The nil filter should match")
+	}
+	if _, err := (&Subscription{Prefixes: []string{"10.0.0.0"}}).filter(); err == nil {
+		t.Error("Should reject prefixes without a length")
+	}
+}
@@ -4,9 +4,9 @@ package eventsocket
 
 import "strconv"
 
-const _TCPEvent_name = "OpenClose"
+const _TCPEvent_name = "OpenCloseStateChangeStats"
 
-var _TCPEvent_index = [...]uint8{0, 4, 9}
+var _TCPEvent_index = [...]uint8{0, 4, 9, 20, 25}
 
 func (i TCPEvent) String() string {
 	if i < 0 || i >= TCPEvent(len(_TCPEvent_index)-1) {
@@ -0,0 +1,288 @@
+package eventsocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Command-line flags configuring mutual TLS for tcp:// addresses.  Servers use the
+// certificate to identify themselves, and the CA to verify their clients.  Clients
+// use the certificate to identify themselves, and the CA to verify the server.
+// Servers on tcp:// addresses that are not loopback addresses need all three.
+var (
+	TLSCert = flag.String("tcpinfo.eventsocket.tls-cert", "", "For tcp:// event socket addresses, the PEM certificate file to present.  TLS is used when it is set.  Servers on addresses other than loopback addresses need it, and -tcpinfo.eventsocket.tls-ca, to verify their clients.")
+	TLSKey  = flag.String("tcpinfo.eventsocket.tls-key", "", "The PEM key file for -tcpinfo.eventsocket.tls-cert.")
+	TLSCA   = flag.String("tcpinfo.eventsocket.tls-ca", "", "For tcp:// event socket addresses, the PEM file of the CAs trusted to sign the certificates of the other end.  Servers require client certificates when it is set.")
+)
+
+// Errors returned for bad event socket addresses and TLS files.
+var (
+	ErrBadAddress      = errors.New("event socket address must be a filename, or start with unix://, tcp:// or ws://")
+	ErrTLSKeyPair      = errors.New("the TLS certificate and key must be set together")
+	ErrTLSNoCert       = errors.New("TLS servers need a certificate and key")
+	ErrUnauthenticated = errors.New("event sockets on addresses other than loopback addresses must be tcp://, with a TLS certificate, key and CA, to verify their clients")
+)
+
+// TLSFiles names the PEM files configuring TLS.  The zero value means no TLS.
+type TLSFiles struct {
+	Cert, Key string // The certificate to present, and its key.
+	CA        string // The CAs trusted to sign the certificate of the other end.
+}
+
+// tlsFlags returns the TLSFiles set by the command-line flags.
+func tlsFlags() TLSFiles {
+	return TLSFiles{Cert: *TLSCert, Key: *TLSKey, CA: *TLSCA}
+}
+
+// config returns the TLS config for a server or a client, or nil if no files are
+// set.
+func (files TLSFiles) config(server bool) (*tls.Config, error) {
+	if files == (TLSFiles{}) {
+		return nil, nil
+	}
+	if (files.Cert == "") != (files.Key == "") {
+		return nil, ErrTLSKeyPair
+	}
+	if server && files.Cert == "" {
+		return nil, ErrTLSNoCert
+	}
+	config := &tls.Config{}
+	if files.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if files.CA != "" {
+		pem, err := ioutil.ReadFile(files.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %q", files.CA)
+		}
+		if server {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.RootCAs = pool
+		}
+	}
+	return config, nil
+}
+
+// parseAddress splits an event socket address into its scheme, and the path or
+// host:port to pass to net.Listen or net.Dial.  Addresses without a scheme are
+// the filenames of unix-domain sockets.  For ws:// addresses, the URL path is
+// returned as well.
+func parseAddress(address string) (scheme, addr, path string, err error) {
+	if !strings.Contains(address, "://") {
+		return "unix", address, "", nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		return u.Scheme, u.Host + u.Path, "", nil
+	case "tcp":
+		return u.Scheme, u.Host, "", nil
+	case "ws":
+		path = u.Path
+		if path == "" {
+			path = "/"
+		}
+		return u.Scheme, u.Host, path, nil
+	}
+	return "", "", "", ErrBadAddress
+}
+
+// isLoopback returns whether the host of a host:port address is a loopback
+// address, which only local clients can connect to.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listen returns a listener for the address.  TLS only applies to tcp:// addresses,
+// which need it, with client certificates, unless they are loopback addresses.
+// ws:// addresses do not authenticate their clients, so they must be loopback
+// addresses.
+func listen(address string, files TLSFiles) (net.Listener, error) {
+	scheme, addr, path, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "tcp":
+		config, err := files.config(true)
+		if err != nil {
+			return nil, err
+		}
+		if !isLoopback(addr) && (config == nil || config.ClientCAs == nil) {
+			return nil, ErrUnauthenticated
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil || config == nil {
+			return l, err
+		}
+		return tls.NewListener(l, config), nil
+	case "ws":
+		if !isLoopback(addr) {
+			return nil, ErrUnauthenticated
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return newWSListener(l, path), nil
+	}
+	return net.Listen("unix", addr)
+}
+
+// dial connects to the address.  TLS only applies to tcp:// addresses.
+func dial(address string, files TLSFiles) (net.Conn, error) {
+	scheme, addr, _, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "tcp":
+		config, err := files.config(false)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return net.Dial("tcp", addr)
+		}
+		return tls.Dial("tcp", addr, config)
+	case "ws":
+		ws, _, err := websocket.DefaultDialer.Dial(address, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &wsConn{Conn: ws}, nil
+	}
+	return net.Dial("unix", addr)
+}
+
+// wsListener accepts WebSocket connections on a path, through an HTTP server.
+type wsListener struct {
+	net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	srv       *http.Server
+}
+
+func newWSListener(l net.Listener, path string) *wsListener {
+	wl := &wsListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, wl.upgrade)
+	wl.srv = &http.Server{Handler: mux}
+	go wl.srv.Serve(l)
+	return wl
+}
+
+// upgrade hands each WebSocket connection to Accept.
+func (wl *wsListener) upgrade(rw http.ResponseWriter, req *http.Request) {
+	ws, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		return
+	}
+	select {
+	case wl.conns <- &wsConn{Conn: ws}:
+	case <-wl.done:
+		ws.Close()
+	}
+}
+
+// Accept waits for the next WebSocket connection.
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-wl.conns:
+		return c, nil
+	case <-wl.done:
+		return nil, errors.New("websocket listener closed")
+	}
+}
+
+// Close stops the HTTP server.  Connections already accepted stay open.
+func (wl *wsListener) Close() error {
+	wl.closeOnce.Do(func() { close(wl.done) })
+	return wl.srv.Close()
+}
+
+// wsConn is a net.Conn carrying the same stream as the other transports, with each
+// write sent as one WebSocket message.  As the server writes one event per write,
+// each message is one line of JSON.
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader // The message being read, if any.
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if _, ok := err.(*websocket.CloseError); ok {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,219 @@
+package eventsocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address, scheme, addr, path string
+		wantErr                     bool
+	}{
+		{address: "/tmp/tcpevents.sock", scheme: "unix", addr: "/tmp/tcpevents.sock"},
+		{address: "unix:///tmp/tcpevents.sock", scheme: "unix", addr: "/tmp/tcpevents.sock"},
+		{address: "tcp://localhost:9995", scheme: "tcp", addr: "localhost:9995"},
+		{address: "ws://localhost:9995", scheme: "ws", addr: "localhost:9995", path: "/"},
+		{address: "ws://localhost:9995/events", scheme: "ws", addr: "localhost:9995", path: "/events"},
+		{address: "http://localhost:9995", wantErr: true},
+	}
+	for _, tt := range tests {
+		scheme, addr, path, err := parseAddress(tt.address)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAddress(%q) error = %v, wantErr %v", tt.address, err, tt.wantErr)
+			continue
+		}
+		if scheme != tt.scheme || addr != tt.addr || path != tt.path {
+			t.Errorf("parseAddress(%q) = %q, %q, %q", tt.address, scheme, addr, path)
+		}
+	}
+}
+
+// serve starts a server on address, and returns the address clients should use,
+// with the port that was picked for port 0.
+func serve(ctx context.Context, address string, files TLSFiles) (*server, string) {
+	srv := New(address).(*server)
+	srv.tls = files
+	rtx.Must(srv.Listen(), "Could not listen on %q", address)
+	go srv.Serve(ctx)
+	if strings.HasSuffix(address, ":0") || strings.Contains(address, ":0/") {
+		address = strings.Replace(address, ":0", ":"+portOf(srv.listener.Addr()), 1)
+	}
+	return srv, address
+}
+
+func portOf(addr net.Addr) string {
+	_, port, err := net.SplitHostPort(addr.String())
+	rtx.Must(err, "Bad address")
+	return port
+}
+
+// checkEvents runs a client on address until it gets the events of one flow.
+func checkEvents(t *testing.T, srv *server, address string, opts ...Option) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	th := &testHandler{}
+	th.wg.Add(2)
+	clientWg := sync.WaitGroup{}
+	clientWg.Add(1)
+	go func() {
+		MustRun(ctx, address, th, opts...)
+		clientWg.Done()
+	}()
+	waitForClients(srv, 1)
+
+	srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
+	srv.FlowDeleted(time.Now(), "fakeuuid")
+	th.wg.Wait()
+	if th.opens != 1 || th.closes != 1 {
+		t.Error(address, "wrong events handled:", th.opens, th.closes)
+	}
+	cancel()
+	clientWg.Wait()
+}
+
+func TestTransports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEventSocketTransports")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	for _, address := range []string{
+		dir + "/tcpevents.sock",
+		"unix://" + dir + "/tcpevents2.sock",
+		"tcp://127.0.0.1:0",
+		"ws://127.0.0.1:0/events",
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		srv, address := serve(ctx, address, TLSFiles{})
+		// The subscription checks that clients can write on each transport too.
+		checkEvents(t, srv, address, WithSubscription(Subscription{Events: []TCPEvent{Open, Close}}))
+		cancel()
+		srv.servingWG.Wait()
+	}
+}
+
+// writeCert writes a certificate signed by parent, or self-signed if parent is
+// nil, and its key, to dir/name.pem and dir/name.key.
+func writeCert(dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rtx.Must(err, "Could not generate key")
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	rtx.Must(err, "Could not create certificate")
+	cert, err := x509.ParseCertificate(der)
+	rtx.Must(err, "Could not parse certificate")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	rtx.Must(err, "Could not marshal key")
+	rtx.Must(ioutil.WriteFile(dir+"/"+name+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), "Could not write certificate")
+	rtx.Must(ioutil.WriteFile(dir+"/"+name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), "Could not write key")
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEventSocketMutualTLS")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, address := serve(ctx, "tcp://127.0.0.1:0", TLSFiles{Cert: dir + "/server.pem", Key: dir + "/server.key", CA: dir + "/ca.pem"})
+	checkEvents(t, srv, address, WithTLS(TLSFiles{Cert: dir + "/client.pem", Key: dir + "/client.key", CA: dir + "/ca.pem"}))
+
+	// Clients without a certificate are refused, either during the handshake, or
+	// when they first read.
+	c, err := dial(address, TLSFiles{CA: dir + "/ca.pem"})
+	if err == nil {
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+	}
+	if err == nil {
+		t.Error("Client without a certificate was accepted")
+	}
+	// Clients that do not trust the server refuse it.
+	_, err = dial(address, TLSFiles{Cert: dir + "/client.pem", Key: dir + "/client.key"})
+	if err == nil {
+		t.Error("Client accepted an untrusted server")
+	}
+	// Bad TLS files fail to listen.
+	_, err = listen("tcp://127.0.0.1:0", TLSFiles{Cert: dir + "/missing.pem", Key: dir + "/missing.key"})
+	if err == nil {
+		t.Error("Listened with a missing certificate")
+	}
+}
+
+func TestListenChecksTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEventSocketListenChecksTLS")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	writeCert(dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	server := TLSFiles{Cert: dir + "/ca.pem", Key: dir + "/ca.key"}
+	mutual := TLSFiles{Cert: dir + "/ca.pem", Key: dir + "/ca.key", CA: dir + "/ca.pem"}
+
+	tests := []struct {
+		address string
+		files   TLSFiles
+		want    error
+	}{
+		{address: "tcp://127.0.0.1:0", files: TLSFiles{Cert: dir + "/ca.pem"}, want: ErrTLSKeyPair},
+		{address: "tcp://127.0.0.1:0", files: TLSFiles{Key: dir + "/ca.key"}, want: ErrTLSKeyPair},
+		{address: "tcp://127.0.0.1:0", files: TLSFiles{CA: dir + "/ca.pem"}, want: ErrTLSNoCert},
+		{address: "tcp://:0", want: ErrUnauthenticated},
+		{address: "tcp://0.0.0.0:0", files: server, want: ErrUnauthenticated},
+		{address: "tcp://0.0.0.0:0", files: mutual},
+		{address: "tcp://127.0.0.1:0"},
+		{address: "tcp://localhost:0", files: server},
+		{address: "ws://0.0.0.0:0/events", want: ErrUnauthenticated},
+		{address: "ws://:0/events", files: mutual, want: ErrUnauthenticated},
+		{address: "ws://127.0.0.1:0/events"},
+	}
+	for _, tt := range tests {
+		l, err := listen(tt.address, tt.files)
+		if err != tt.want {
+			t.Errorf("listen(%q, %+v) error = %v, want %v", tt.address, tt.files, err, tt.want)
+		}
+		if l != nil {
+			l.Close()
+		}
+	}
+}
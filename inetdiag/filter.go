@@ -0,0 +1,545 @@
+package inetdiag
+
+// Socket filters, compiled into the bytecode evaluated by the kernel's
+// inet_diag_bc_run(), so that sockets we are not interested in are never
+// copied to user space.
+//
+// Filters can be built with the Go API (And, Or, Not, SrcPorts, DstPorts,
+// SrcPrefix, DstPrefix, Mark) or parsed from text with ParseFilter, e.g.
+//
+//	dport == 443 or (sport >= 3000 and sport <= 3010) and not dst 10.0.0.0/8
+//	mark 0x10/0xf0
+//
+// "and" binds tighter than "or".  Addresses without a prefix length match a
+// single host.  IPv4 prefixes also match v4-mapped addresses on AF_INET6 sockets.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Request attributes, from uapi/linux/inet_diag.h
+const (
+	INET_DIAG_REQ_NONE = iota
+	INET_DIAG_REQ_BYTECODE
+)
+
+// Bytecode op codes, from uapi/linux/inet_diag.h
+const (
+	INET_DIAG_BC_NOP = iota
+	INET_DIAG_BC_JMP
+	INET_DIAG_BC_S_GE
+	INET_DIAG_BC_S_LE
+	INET_DIAG_BC_D_GE
+	INET_DIAG_BC_D_LE
+	INET_DIAG_BC_AUTO
+	INET_DIAG_BC_S_COND
+	INET_DIAG_BC_D_COND
+	INET_DIAG_BC_DEV_COND
+	INET_DIAG_BC_MARK_COND
+	INET_DIAG_BC_S_EQ
+	INET_DIAG_BC_D_EQ
+)
+
+// Errors returned by filter parsing and compilation.
+var (
+	ErrFilterSyntax  = errors.New("filter syntax error")
+	ErrFilterTooLong = errors.New("filter bytecode too long")
+)
+
+// BCOp corresponds to struct inet_diag_bc_op.  If the condition is true,
+// execution continues Yes bytes further, otherwise No bytes further.  A
+// program accepts a socket if execution ends exactly at the end of the
+// bytecode.
+type BCOp struct {
+	Code uint8
+	Yes  uint8
+	No   uint16
+}
+
+// SizeofBCOp is the size of the struct.
+const SizeofBCOp = int(unsafe.Sizeof(BCOp{}))
+
+// Serialize returns the host byte order representation of the op.
+func (op *BCOp) Serialize() []byte {
+	return (*(*[SizeofBCOp]byte)(unsafe.Pointer(op)))[:]
+}
+
+// Serialize returns the host byte order representation of the condition.  The
+// address bytes must follow it in the bytecode.
+func (hc *HostCond) Serialize() []byte {
+	return (*(*[unsafe.Sizeof(HostCond{})]byte)(unsafe.Pointer(hc)))[:]
+}
+
+// Serialize returns the host byte order representation of the condition.
+func (mc *MarkCond) Serialize() []byte {
+	return (*(*[unsafe.Sizeof(MarkCond{})]byte)(unsafe.Pointer(mc)))[:]
+}
+
+// Filter is a boolean expression over socket properties that can be compiled
+// into inet_diag bytecode.
+type Filter interface {
+	// compile emits code that falls through if the filter matches, and jumps
+	// to onFalse otherwise.
+	compile(c *compiler, onFalse label)
+	String() string
+}
+
+type andFilter []Filter
+type orFilter []Filter
+type notFilter struct{ f Filter }
+
+type portFilter struct {
+	dst    bool
+	lo, hi uint16
+}
+
+type prefixFilter struct {
+	dst bool
+	net *net.IPNet
+}
+
+type markFilter struct{ mark, mask uint32 }
+
+// And matches sockets matching all of the filters.
+func And(filters ...Filter) Filter { return andFilter(filters) }
+
+// Or matches sockets matching any of the filters.
+func Or(filters ...Filter) Filter { return orFilter(filters) }
+
+// Not matches sockets not matching f.
+func Not(f Filter) Filter { return notFilter{f} }
+
+// SrcPorts matches sockets with a local port in [lo, hi].
+func SrcPorts(lo, hi uint16) Filter { return portFilter{dst: false, lo: lo, hi: hi} }
+
+// DstPorts matches sockets with a remote port in [lo, hi].
+func DstPorts(lo, hi uint16) Filter { return portFilter{dst: true, lo: lo, hi: hi} }
+
+// SrcPrefix matches sockets with a local address in prefix.
+func SrcPrefix(prefix *net.IPNet) Filter { return prefixFilter{dst: false, net: prefix} }
+
+// DstPrefix matches sockets with a remote address in prefix.
+func DstPrefix(prefix *net.IPNet) Filter { return prefixFilter{dst: true, net: prefix} }
+
+// Mark matches sockets whose mark, masked with mask, equals mark.  The kernel
+// only allows mark filters for callers with CAP_NET_ADMIN.
+func Mark(mark, mask uint32) Filter { return markFilter{mark: mark, mask: mask} }
+
+func joinFilters(filters []Filter, sep string) string {
+	s := make([]string, len(filters))
+	for i := range filters {
+		s[i] = filters[i].String()
+	}
+	return "(" + strings.Join(s, sep) + ")"
+}
+
+func (f andFilter) String() string { return joinFilters(f, " and ") }
+func (f orFilter) String() string  { return joinFilters(f, " or ") }
+func (f notFilter) String() string { return "not " + f.f.String() }
+
+func (f portFilter) String() string {
+	name := "sport"
+	if f.dst {
+		name = "dport"
+	}
+	if f.lo == f.hi {
+		return fmt.Sprintf("%s == %d", name, f.lo)
+	}
+	return fmt.Sprintf("(%s >= %d and %s <= %d)", name, f.lo, name, f.hi)
+}
+
+func (f prefixFilter) String() string {
+	if f.dst {
+		return "dst " + f.net.String()
+	}
+	return "src " + f.net.String()
+}
+
+func (f markFilter) String() string { return fmt.Sprintf("mark 0x%x/0x%x", f.mark, f.mask) }
+
+func (f andFilter) compile(c *compiler, onFalse label) {
+	for _, sub := range f {
+		sub.compile(c, onFalse)
+	}
+}
+
+func (f orFilter) compile(c *compiler, onFalse label) {
+	if len(f) == 0 {
+		c.jump(onFalse)
+		return
+	}
+	matched := c.newLabel()
+	for _, sub := range f[:len(f)-1] {
+		next := c.newLabel()
+		sub.compile(c, next)
+		c.jump(matched)
+		c.place(next)
+	}
+	f[len(f)-1].compile(c, onFalse)
+	c.place(matched)
+}
+
+func (f notFilter) compile(c *compiler, onFalse label) {
+	notMatched := c.newLabel()
+	f.f.compile(c, notMatched)
+	c.jump(onFalse)
+	c.place(notMatched)
+}
+
+func (f portFilter) compile(c *compiler, onFalse label) {
+	ge, le := uint8(INET_DIAG_BC_S_GE), uint8(INET_DIAG_BC_S_LE)
+	if f.dst {
+		ge, le = INET_DIAG_BC_D_GE, INET_DIAG_BC_D_LE
+	}
+	if f.lo > f.hi {
+		c.jump(onFalse)
+		return
+	}
+	// The port to compare with is held in the No field of a second op.
+	if f.lo > 0 {
+		port := BCOp{No: f.lo}
+		c.emit(ge, onFalse, port.Serialize())
+	}
+	if f.hi < 0xffff {
+		port := BCOp{No: f.hi}
+		c.emit(le, onFalse, port.Serialize())
+	}
+}
+
+func (f prefixFilter) compile(c *compiler, onFalse label) {
+	code := uint8(INET_DIAG_BC_S_COND)
+	if f.dst {
+		code = INET_DIAG_BC_D_COND
+	}
+	ones, _ := f.net.Mask.Size()
+	cond := HostCond{Family: syscall.AF_INET, PrefixLen: uint8(ones), Port: -1}
+	addr := f.net.IP.To4()
+	if addr == nil {
+		cond.Family = AF_INET6
+		addr = f.net.IP.To16()
+	}
+	c.emit(code, onFalse, append(cond.Serialize(), addr...))
+}
+
+func (f markFilter) compile(c *compiler, onFalse label) {
+	cond := MarkCond{Mark: f.mark, Mask: f.mask}
+	c.emit(INET_DIAG_BC_MARK_COND, onFalse, cond.Serialize())
+}
+
+// label is a position in the bytecode that is the target of a jump.
+type label int
+
+// rejectLabel is just past the end of the bytecode.  Jumping there rejects the socket.
+const rejectLabel = label(-1)
+
+type instruction struct {
+	code    uint8
+	onFalse label
+	payload []byte // Data following the op.
+}
+
+type compiler struct {
+	code   []instruction
+	labels []int // Index of the instruction following each label.
+}
+
+func (c *compiler) newLabel() label {
+	c.labels = append(c.labels, -1)
+	return label(len(c.labels) - 1)
+}
+
+func (c *compiler) place(l label) {
+	c.labels[l] = len(c.code)
+}
+
+func (c *compiler) emit(code uint8, onFalse label, payload []byte) {
+	c.code = append(c.code, instruction{code: code, onFalse: onFalse, payload: payload})
+}
+
+// jump emits an unconditional jump, which the kernel takes using the No field.
+func (c *compiler) jump(to label) {
+	c.emit(INET_DIAG_BC_JMP, to, nil)
+}
+
+// assemble resolves all labels and returns the bytecode.  Every op continues
+// to the next one when its condition is true, as required by the kernel's
+// bytecode audit, so only the No fields jump further ahead.
+func (c *compiler) assemble() ([]byte, error) {
+	offsets := make([]int, len(c.code)+1)
+	for i := range c.code {
+		offsets[i+1] = offsets[i] + SizeofBCOp + len(c.code[i].payload)
+	}
+	end := offsets[len(c.code)]
+	bc := make([]byte, 0, end)
+	for i, inst := range c.code {
+		target := end + 4
+		if inst.onFalse != rejectLabel {
+			target = offsets[c.labels[inst.onFalse]]
+		}
+		no := target - offsets[i]
+		if no > 0xffff {
+			return nil, ErrFilterTooLong
+		}
+		op := BCOp{Code: inst.code, Yes: uint8(SizeofBCOp + len(inst.payload)), No: uint16(no)}
+		bc = append(bc, op.Serialize()...)
+		bc = append(bc, inst.payload...)
+	}
+	return bc, nil
+}
+
+// Compile compiles the filter into inet_diag bytecode, suitable for an
+// INET_DIAG_REQ_BYTECODE request attribute.  A filter that matches all sockets
+// may compile to empty bytecode.
+func Compile(f Filter) ([]byte, error) {
+	c := &compiler{}
+	f.compile(c, rejectLabel)
+	return c.assemble()
+}
+
+/*********************************************************************************************/
+/*                                    Filter parsing                                         */
+/*********************************************************************************************/
+
+func tokenize(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch ch := s[i]; {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case strings.IndexByte("=!<>&|", ch) >= 0:
+			j := i + 1
+			if j < len(s) && strings.IndexByte("=&|", s[j]) >= 0 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\n()=!<>&|", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%v: %s at token %d", ErrFilterSyntax, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *parser) parseOr() (Filter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	filters := []Filter{f}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		f, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return Or(filters...), nil
+}
+
+func (p *parser) parseAnd() (Filter, error) {
+	f, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	filters := []Filter{f}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return And(filters...), nil
+}
+
+func (p *parser) parseUnary() (Filter, error) {
+	switch t := p.next(); t {
+	case "not", "!":
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(f), nil
+	case "(":
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, p.errorf("missing )")
+		}
+		return f, nil
+	case "sport", "dport":
+		return p.parsePort(t == "dport")
+	case "src", "dst":
+		return p.parsePrefix(t == "dst")
+	case "mark":
+		return p.parseMark()
+	case "":
+		return nil, p.errorf("unexpected end of filter")
+	default:
+		return nil, p.errorf("unexpected %q", t)
+	}
+}
+
+func (p *parser) parsePort(dst bool) (Filter, error) {
+	op := p.next()
+	n, err := strconv.ParseUint(p.next(), 10, 16)
+	if err != nil {
+		return nil, p.errorf("bad port: %v", err)
+	}
+	port := uint16(n)
+	f := portFilter{dst: dst, lo: 0, hi: 0xffff}
+	switch op {
+	case "==", "=":
+		f.lo, f.hi = port, port
+	case "!=":
+		return Not(portFilter{dst: dst, lo: port, hi: port}), nil
+	case ">=":
+		f.lo = port
+	case "<=":
+		f.hi = port
+	case ">":
+		if port == 0xffff {
+			return nil, p.errorf("no port is > %d", port)
+		}
+		f.lo = port + 1
+	case "<":
+		if port == 0 {
+			return nil, p.errorf("no port is < 0")
+		}
+		f.hi = port - 1
+	default:
+		return nil, p.errorf("unknown port comparison %q", op)
+	}
+	return f, nil
+}
+
+func (p *parser) parsePrefix(dst bool) (Filter, error) {
+	s := p.next()
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, p.errorf("bad address %q", s)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, p.errorf("bad prefix: %v", err)
+	}
+	return prefixFilter{dst: dst, net: prefix}, nil
+}
+
+func (p *parser) parseMark() (Filter, error) {
+	fields := strings.SplitN(p.next(), "/", 2)
+	mark, err := strconv.ParseUint(fields[0], 0, 32)
+	if err != nil {
+		return nil, p.errorf("bad mark: %v", err)
+	}
+	mask := uint64(0xffffffff)
+	if len(fields) == 2 {
+		mask, err = strconv.ParseUint(fields[1], 0, 32)
+		if err != nil {
+			return nil, p.errorf("bad mark mask: %v", err)
+		}
+	}
+	return Mark(uint32(mark), uint32(mask)), nil
+}
+
+// ParseFilter parses the textual form of a filter, as described at the top of this file.
+func ParseFilter(s string) (Filter, error) {
+	p := &parser{tokens: tokenize(s)}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.peek())
+	}
+	return f, nil
+}
+
+// FilterFlag is a flag.Value holding a parsed and compiled Filter.  The zero
+// value holds no filter, which matches all sockets.
+type FilterFlag struct {
+	Filter   Filter
+	Bytecode []byte
+	text     string
+}
+
+// Set parses and compiles the filter.
+func (ff *FilterFlag) Set(s string) error {
+	if strings.TrimSpace(s) == "" {
+		*ff = FilterFlag{}
+		return nil
+	}
+	f, err := ParseFilter(s)
+	if err != nil {
+		return err
+	}
+	bc, err := Compile(f)
+	if err != nil {
+		return err
+	}
+	*ff = FilterFlag{Filter: f, Bytecode: bc, text: s}
+	return nil
+}
+
+// String returns the filter as it was set.
+func (ff *FilterFlag) String() string {
+	return ff.text
+}
+
+// Get returns the Filter, which may be nil.
+func (ff *FilterFlag) Get() interface{} {
+	return ff.Filter
+}
@@ -0,0 +1,374 @@
+package inetdiag_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// socket holds the properties examined by the kernel when running a filter.
+type socket struct {
+	family       uint8
+	src, dst     net.IP
+	sport, dport uint16
+	mark         uint32
+}
+
+func v4(src string, sport uint16, dst string, dport uint16) socket {
+	return socket{family: syscall.AF_INET, src: net.ParseIP(src).To4(), sport: sport, dst: net.ParseIP(dst).To4(), dport: dport}
+}
+
+func v6(src string, sport uint16, dst string, dport uint16) socket {
+	return socket{family: inetdiag.AF_INET6, src: net.ParseIP(src).To16(), sport: sport, dst: net.ParseIP(dst).To16(), dport: dport}
+}
+
+func opAt(bc []byte, off int) inetdiag.BCOp {
+	return *(*inetdiag.BCOp)(unsafe.Pointer(&bc[off]))
+}
+
+func hostCondAt(bc []byte, off int) inetdiag.HostCond {
+	return *(*inetdiag.HostCond)(unsafe.Pointer(&bc[off]))
+}
+
+func markCondAt(bc []byte, off int) inetdiag.MarkCond {
+	return *(*inetdiag.MarkCond)(unsafe.Pointer(&bc[off]))
+}
+
+var errAudit = errors.New("bytecode rejected by audit")
+
+// validCC mirrors valid_cc() in net/ipv4/inet_diag.c.  It checks that the
+// remaining length cc is reachable by following the yes chain.
+func validCC(bc []byte, cc int) bool {
+	off, length := 0, len(bc)
+	for length > 0 {
+		if cc == length {
+			return true
+		}
+		yes := int(opAt(bc, off).Yes)
+		if length < yes || yes == 0 {
+			return false
+		}
+		off += yes
+		length -= yes
+	}
+	return false
+}
+
+// audit mirrors inet_diag_bc_audit() in net/ipv4/inet_diag.c.
+func audit(bc []byte) error {
+	off, length := 0, len(bc)
+	for length > 0 {
+		if length < inetdiag.SizeofBCOp {
+			return errAudit
+		}
+		minLen := inetdiag.SizeofBCOp
+		op := opAt(bc, off)
+		switch op.Code {
+		case inetdiag.INET_DIAG_BC_S_COND, inetdiag.INET_DIAG_BC_D_COND:
+			minLen += int(unsafe.Sizeof(inetdiag.HostCond{}))
+			if length < minLen {
+				return errAudit
+			}
+			cond := hostCondAt(bc, off+inetdiag.SizeofBCOp)
+			switch cond.Family {
+			case syscall.AF_INET:
+				minLen += 4
+			case inetdiag.AF_INET6:
+				minLen += 16
+			case syscall.AF_UNSPEC:
+			default:
+				return errAudit
+			}
+			if length < minLen || int(cond.PrefixLen) > 8*(minLen-inetdiag.SizeofBCOp-8) {
+				return errAudit
+			}
+		case inetdiag.INET_DIAG_BC_S_GE, inetdiag.INET_DIAG_BC_S_LE,
+			inetdiag.INET_DIAG_BC_D_GE, inetdiag.INET_DIAG_BC_D_LE:
+			minLen += inetdiag.SizeofBCOp
+			if length < minLen {
+				return errAudit
+			}
+		case inetdiag.INET_DIAG_BC_MARK_COND:
+			minLen += int(unsafe.Sizeof(inetdiag.MarkCond{}))
+			if length < minLen {
+				return errAudit
+			}
+		case inetdiag.INET_DIAG_BC_AUTO, inetdiag.INET_DIAG_BC_JMP, inetdiag.INET_DIAG_BC_NOP:
+		default:
+			return errAudit
+		}
+		if op.Code != inetdiag.INET_DIAG_BC_NOP {
+			no := int(op.No)
+			if no < minLen || no > length+4 || no&3 != 0 {
+				return errAudit
+			}
+			if no < length && !validCC(bc, length-no) {
+				return errAudit
+			}
+		}
+		yes := int(op.Yes)
+		if yes < minLen || yes > length+4 || yes&3 != 0 {
+			return errAudit
+		}
+		off += yes
+		length -= yes
+	}
+	return nil
+}
+
+func prefixMatch(a, b []byte, bits int) bool {
+	for ; bits >= 8; bits -= 8 {
+		if a[0] != b[0] {
+			return false
+		}
+		a, b = a[1:], b[1:]
+	}
+	if bits > 0 {
+		mask := byte(0xff) << uint(8-bits)
+		return a[0]&mask == b[0]&mask
+	}
+	return true
+}
+
+// run mirrors inet_diag_bc_run() in net/ipv4/inet_diag.c.
+func run(bc []byte, s socket) bool {
+	off, length := 0, len(bc)
+	for length > 0 {
+		op := opAt(bc, off)
+		yes := true
+		switch op.Code {
+		case inetdiag.INET_DIAG_BC_NOP:
+		case inetdiag.INET_DIAG_BC_JMP:
+			yes = false
+		case inetdiag.INET_DIAG_BC_S_GE:
+			yes = s.sport >= opAt(bc, off+inetdiag.SizeofBCOp).No
+		case inetdiag.INET_DIAG_BC_S_LE:
+			yes = s.sport <= opAt(bc, off+inetdiag.SizeofBCOp).No
+		case inetdiag.INET_DIAG_BC_D_GE:
+			yes = s.dport >= opAt(bc, off+inetdiag.SizeofBCOp).No
+		case inetdiag.INET_DIAG_BC_D_LE:
+			yes = s.dport <= opAt(bc, off+inetdiag.SizeofBCOp).No
+		case inetdiag.INET_DIAG_BC_S_COND, inetdiag.INET_DIAG_BC_D_COND:
+			cond := hostCondAt(bc, off+inetdiag.SizeofBCOp)
+			condAddr := bc[off+inetdiag.SizeofBCOp+8 : off+int(op.Yes)]
+			port, addr := s.sport, s.src
+			if op.Code == inetdiag.INET_DIAG_BC_D_COND {
+				port, addr = s.dport, s.dst
+			}
+			if cond.Port != -1 && int32(port) != cond.Port {
+				yes = false
+				break
+			}
+			if cond.PrefixLen == 0 {
+				break
+			}
+			if cond.Family == syscall.AF_INET && s.family == inetdiag.AF_INET6 {
+				mapped := addr.To4()
+				if mapped == nil {
+					yes = false
+					break
+				}
+				addr = mapped
+			} else if cond.Family != s.family {
+				yes = false
+				break
+			}
+			yes = prefixMatch(addr, condAddr, int(cond.PrefixLen))
+		case inetdiag.INET_DIAG_BC_MARK_COND:
+			cond := markCondAt(bc, off+inetdiag.SizeofBCOp)
+			yes = s.mark&cond.Mask == cond.Mark
+		}
+		if yes {
+			off += int(op.Yes)
+			length -= int(op.Yes)
+		} else {
+			off += int(op.No)
+			length -= int(op.No)
+		}
+	}
+	return length == 0
+}
+
+func TestFilters(t *testing.T) {
+	a := v4("192.168.1.5", 3005, "10.1.2.3", 443)
+	b := v4("192.168.1.5", 22, "8.8.8.8", 50000)
+	c := v6("2001:db8::1", 443, "2001:db8:1::7", 60000)
+	d := v6("::ffff:10.1.2.3", 80, "fe80::1", 33000)
+	e := socket{family: syscall.AF_INET, src: net.IPv4(1, 2, 3, 4).To4(), dst: net.IPv4(5, 6, 7, 8).To4(), mark: 0x1234}
+	all := []socket{a, b, c, d, e}
+
+	tests := []struct {
+		filter string
+		want   []socket
+	}{
+		{"dport == 443", []socket{a}},
+		{"dport = 443", []socket{a}},
+		{"sport == 443", []socket{c}},
+		{"dport != 443", []socket{b, c, d, e}},
+		{"sport >= 3000 and sport <= 3010", []socket{a}},
+		{"sport > 3005", []socket{}},
+		{"sport < 23", []socket{b, e}},
+		{"dport > 49999", []socket{b, c}},
+		{"sport == 22 || sport == 443", []socket{b, c}},
+		{"dport == 443 or (sport >= 3000 and sport <= 3010) and not dst 10.0.0.0/8", []socket{a}},
+		{"(dport == 443 or sport == 22) and not dst 10.0.0.0/8", []socket{b}},
+		{"!(sport == 22 || sport == 443 || sport == 80)", []socket{a, e}},
+		{"not not dport == 443", []socket{a}},
+		{"dst 10.0.0.0/8", []socket{a}},
+		{"src 10.1.2.3", []socket{d}},
+		{"src 192.168.0.0/16 && dst 8.8.8.8", []socket{b}},
+		{"dst 2001:db8::/32", []socket{c}},
+		{"src 2001:db8::1", []socket{c}},
+		{"dst 0.0.0.0/0", all},
+		{"mark 0x1234", []socket{e}},
+		{"mark 0x30/0xf0", []socket{e}},
+		{"mark 0x1000/0xff00", []socket{}},
+		{"not mark 0x1234 and sport < 100", []socket{b, d}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := inetdiag.ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bc, err := inetdiag.Compile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := audit(bc); err != nil {
+				t.Fatal(err, bc)
+			}
+			want := map[int]bool{}
+			for i := range all {
+				for _, w := range tt.want {
+					if reflect.DeepEqual(all[i], w) {
+						want[i] = true
+					}
+				}
+			}
+			for i, s := range all {
+				if run(bc, s) != want[i] {
+					t.Errorf("%q on socket %d: got %v, want %v", tt.filter, i, !want[i], want[i])
+				}
+			}
+
+			// The String form should compile to equivalent bytecode.
+			f2, err := inetdiag.ParseFilter(f.String())
+			if err != nil {
+				t.Fatal(f.String(), err)
+			}
+			for i, s := range all {
+				bc2, err := inetdiag.Compile(f2)
+				rtx.Must(err, "Could not compile %q", f2.String())
+				if run(bc2, s) != want[i] {
+					t.Errorf("%q on socket %d: got %v, want %v", f.String(), i, !want[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFilterAPI(t *testing.T) {
+	_, prefix, err := net.ParseCIDR("10.0.0.0/8")
+	rtx.Must(err, "Bad prefix")
+	f := inetdiag.Or(
+		inetdiag.And(inetdiag.DstPorts(80, 80), inetdiag.Not(inetdiag.DstPrefix(prefix))),
+		inetdiag.SrcPorts(9000, 9999))
+	bc, err := inetdiag.Compile(f)
+	rtx.Must(err, "Could not compile")
+	rtx.Must(audit(bc), "Audit failed")
+	if !run(bc, v4("1.1.1.1", 9500, "10.0.0.1", 1)) || !run(bc, v4("1.1.1.1", 1, "11.0.0.1", 80)) {
+		t.Error("Should match")
+	}
+	if run(bc, v4("1.1.1.1", 1, "10.0.0.1", 80)) {
+		t.Error("Should not match")
+	}
+
+	// Full port ranges need no code at all.
+	bc, err = inetdiag.Compile(inetdiag.SrcPorts(0, 0xffff))
+	rtx.Must(err, "Could not compile")
+	if len(bc) != 0 {
+		t.Error("Expected empty bytecode", bc)
+	}
+	// Empty port ranges and empty Or match nothing.
+	for _, f := range []inetdiag.Filter{inetdiag.DstPorts(10, 1), inetdiag.Or()} {
+		bc, err = inetdiag.Compile(f)
+		rtx.Must(err, "Could not compile")
+		rtx.Must(audit(bc), "Audit failed")
+		if run(bc, v4("1.1.1.1", 20, "2.2.2.2", 20)) {
+			t.Error("Should not match", f)
+		}
+	}
+}
+
+func TestFilterTooLong(t *testing.T) {
+	var filters []inetdiag.Filter
+	for i := 0; i < 5000; i++ {
+		filters = append(filters, inetdiag.Not(inetdiag.DstPorts(uint16(i), uint16(i))))
+	}
+	_, err := inetdiag.Compile(inetdiag.Or(inetdiag.And(filters...), inetdiag.SrcPorts(1, 1)))
+	if err != inetdiag.ErrFilterTooLong {
+		t.Error("Expected ErrFilterTooLong, got", err)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"dport",
+		"dport == ",
+		"dport == 70000",
+		"dport ~ 80",
+		"sport < 0",
+		"sport > 65535",
+		"(dport == 80",
+		"dport == 80)",
+		"dport == 80 sport == 90",
+		"src 10.0.0.300",
+		"dst 10.0.0.0/33",
+		"mark foo",
+		"mark 0x10/bar",
+		"and",
+		"foo == 1",
+	}
+	for _, s := range bad {
+		_, err := inetdiag.ParseFilter(s)
+		if err == nil || !strings.Contains(err.Error(), inetdiag.ErrFilterSyntax.Error()) {
+			t.Errorf("ParseFilter(%q) = %v, expected syntax error", s, err)
+		}
+	}
+}
+
+func TestFilterFlag(t *testing.T) {
+	ff := inetdiag.FilterFlag{}
+	if ff.Get() != nil || ff.Bytecode != nil {
+		t.Error("Zero value should have no filter")
+	}
+	rtx.Must(ff.Set("dport == 443"), "Could not set flag")
+	if ff.String() != "dport == 443" || ff.Get() == nil {
+		t.Error("Wrong flag value", ff.String())
+	}
+	bc, err := inetdiag.Compile(ff.Filter)
+	rtx.Must(err, "Could not compile")
+	if !bytes.Equal(bc, ff.Bytecode) {
+		t.Error("Bytecode mismatch", bc, ff.Bytecode)
+	}
+	if ff.Set("dport == ") == nil {
+		t.Error("Expected error")
+	}
+	if ff.String() != "dport == 443" {
+		t.Error("Failed Set should not change the flag", ff.String())
+	}
+	rtx.Must(ff.Set(""), "Could not clear flag")
+	if ff.Get() != nil || ff.Bytecode != nil {
+		t.Error("Empty flag should have no filter")
+	}
+}
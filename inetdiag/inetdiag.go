@@ -62,6 +62,17 @@ const (
 	INET_DIAG_MAX
 )
 
+// RequestedExtensions is the IDiagExt mask of the attributes tcp-info requests
+// from the kernel.  Bit n-1 requests attribute n.
+const RequestedExtensions = 1<<(INET_DIAG_MEMINFO-1) |
+	1<<(INET_DIAG_INFO-1) |
+	1<<(INET_DIAG_VEGASINFO-1) |
+	1<<(INET_DIAG_CONG-1) |
+	1<<(INET_DIAG_TCLASS-1) |
+	1<<(INET_DIAG_TOS-1) |
+	1<<(INET_DIAG_SKMEMINFO-1) |
+	1<<(INET_DIAG_SHUTDOWN-1)
+
 // InetDiagType provides human readable strings for decoding attribute types.
 var InetDiagType = map[int32]string{
 	INET_DIAG_MEMINFO:   "MemInfo",
@@ -101,12 +112,15 @@ const (
 	Protocol_IPPROTO_UDP Protocol = 17
 	// Protocol_IPPROTO_DCCP indicates DCCP traffic.
 	Protocol_IPPROTO_DCCP Protocol = 33
+	// Protocol_IPPROTO_SCTP indicates SCTP traffic.
+	Protocol_IPPROTO_SCTP Protocol = 132
 )
 
 // ProtocolName is used to convert Protocol values to strings.
 var ProtocolName = map[int32]string{
-	0:  "IPPROTO_UNUSED",
-	6:  "IPPROTO_TCP",
-	17: "IPPROTO_UDP",
-	33: "IPPROTO_DCCP",
+	0:   "IPPROTO_UNUSED",
+	6:   "IPPROTO_TCP",
+	17:  "IPPROTO_UDP",
+	33:  "IPPROTO_DCCP",
+	132: "IPPROTO_SCTP",
 }
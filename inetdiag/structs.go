@@ -225,15 +225,17 @@ func ipv6(original [16]byte) net.IP {
 	return original[:]
 }
 
-// HostCond is related to filters.  We don't currently use filters, so we don't actually use this type.
+// HostCond is the operand of the S_COND and D_COND filter ops.  It is followed
+// in the bytecode by the address, in network byte order.  See filter.go.
 type HostCond struct { // inet_diag_hostcond
-	Family    uint8  // __u8 family
-	PrefixLen uint8  // __u8 prefix_len
-	Port      uint16 // int port
-	Addr      uint32 // __be32	addr[0];
+	Family    uint8   // __u8 family
+	PrefixLen uint8   // __u8 prefix_len
+	_         [2]byte // padding
+	Port      int32   // int port, -1 matches any port.
+	// __be32	addr[0];
 }
 
-// MarkCond is related to filters.  We don't currently use filters, so we don't actually use this type.
+// MarkCond is the operand of the MARK_COND filter op.  See filter.go.
 type MarkCond struct { // inet_diag_markcond
 	Mark uint32
 	Mask uint32
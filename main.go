@@ -8,8 +8,11 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/trace"
+	"syscall"
+	"time"
 
 	"github.com/m-lab/tcp-info/eventsocket"
 
@@ -24,6 +27,7 @@ import (
 	"github.com/m-lab/tcp-info/collector"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/zstd"
 )
 
 /*
@@ -62,22 +66,75 @@ func init() {
 //  3. zstd seems to result in similar file size using proto or raw output.
 
 var (
-	reps        = flag.Int("reps", 0, "How many cycles should be recorded, 0 means continuous")
-	enableTrace = flag.Bool("trace", false, "Enable trace")
-	outputDir   = flag.String("output", "", "Directory in which to put the resulting tree of data.  Default is the current directory.")
+	reps            = flag.Int("reps", 0, "How many cycles should be recorded, 0 means continuous")
+	enableTrace     = flag.Bool("trace", false, "Enable trace")
+	outputDir       = flag.String("output", "", "Directory in which to put the resulting tree of data.  Default is the current directory.")
+	host            = flag.String("host", hostname(), "Identity of this machine, in the header of every connection file, and for {host} in -saver.path-template.  Defaults to the hostname.")
+	pod             = flag.String("pod", "", "Identity of the site or pod of this machine, in the header of every connection file, and for {pod} in -saver.path-template.")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 20*time.Second, "After SIGTERM or SIGINT, how long to wait for the connection files to be flushed and closed before exiting anyway.")
 
 	ctx, cancel = context.WithCancel(context.Background())
 )
 
+// hostname returns the hostname, or the empty string if it is unknown.
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return h
+}
+
+// logFatal is log.Fatal, except in tests.
+var logFatal = log.Fatal
+
+// handleSignals cancels the context on SIGTERM or SIGINT, and then exits if the
+// shutdown takes longer than the timeout.  The returned function stops it.
+func handleSignals(timeout time.Duration) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Println("Received", sig, "shutting down")
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-time.After(timeout):
+			logFatal("Shutdown took longer than", timeout)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
 func main() {
 	flag.Parse()
-	flagx.ArgsFromEnv(flag.CommandLine)
+	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from environment")
+	rtx.Must(zstd.LoadDictionaries(), "Could not load zstd dictionaries")
 
 	if *outputDir != "" {
 		rtx.PanicOnError(os.MkdirAll(*outputDir, 0755), "Could not create the output dir %s", *outputDir)
 		rtx.Must(os.Chdir(*outputDir), "Could not change to the directory %s", *outputDir)
 	}
 
+	// Finalize the files left behind if the previous run crashed.
+	since := time.Time{}
+	if *saver.RecoveryAge > 0 {
+		since = time.Now().Add(-*saver.RecoveryAge)
+	}
+	recovered, err := saver.RecoverPartialFiles(".", since)
+	if err != nil {
+		log.Println("Could not recover partial files:", err)
+	}
+	log.Printf("Recovered partial files: %+v\n", recovered)
+
 	// Performance instrumentation.
 	runtime.SetBlockProfileRate(1000000) // 1 sample/msec
 	runtime.SetMutexProfileFraction(1000)
@@ -93,21 +150,38 @@ func main() {
 		defer trace.Stop()
 	}
 
-	// Make and start the event server.
+	// Make and start the event server.  It has its own context, so that it keeps
+	// running until the saver has reported the flows closed during shutdown.
+	eventCtx, eventCancel := context.WithCancel(context.Background())
+	defer eventCancel()
 	eventSrv := eventsocket.NullServer()
 	if *eventsocket.Filename != "" {
 		eventSrv = eventsocket.New(*eventsocket.Filename)
 	}
 	rtx.Must(eventSrv.Listen(), "Could not listen on", *eventsocket.Filename)
-	go eventSrv.Serve(ctx)
+	go eventSrv.Serve(eventCtx)
 
 	// Make the saver and construct the message channel, buffering up to 2 batches
 	// of messages without stalling producer. We may want to increase the buffer if
 	// we observe main() stalling.
 	svrChan := make(chan netlink.MessageBlock, 2)
-	anon := anonymize.New(anonymize.IPAnonymizationFlag)
-	svr := saver.NewSaver("host", "pod", 3, eventSrv, anon)
+	rtx.Must(saver.ValidateRotationFlags(), "Bad -saver.rotation-* flags")
+	svr := saver.NewSaver(*host, *pod, 3, eventSrv, anonymize.IPAnonymizationFlag)
+	rtx.Must(svr.PathTemplate.Validate(), "Bad -saver.path-template %q", svr.PathTemplate)
+	svr.Sink, err = saver.NewSink(*saver.SinkSpec)
+	rtx.Must(err, "Could not create the %q sink", *saver.SinkSpec)
+	if _, ok := svr.Sink.(saver.FileSink); ok && saver.RetentionEnabled() {
+		// Keep the output tree within its quota, and sample new connections when
+		// that is not enough.
+		svr.Retention = saver.NewRetentionManager(".")
+		if err := svr.Retention.Scan(); err != nil {
+			log.Println("Could not scan the output tree:", err)
+		}
+		svr.Sink = saver.FileSink{Retention: svr.Retention}
+		go svr.Retention.Run(ctx, *saver.RetentionInterval)
+	}
 	go svr.MessageSaverLoop(svrChan)
+	defer handleSignals(*shutdownTimeout)()
 
 	// Run the collector, possibly forever.
 	totalSeen, totalErr := collector.Run(ctx, *reps, svrChan, svr, true)
@@ -115,5 +189,8 @@ func main() {
 	// Shut down and clean up after the collector terminates.
 	close(svrChan)
 	svr.Done.Wait()
+	if err := svr.Sink.Close(); err != nil {
+		log.Println("Could not close the sink:", err)
+	}
 	svr.LogCacheStats(totalSeen, totalErr)
 }
@@ -2,8 +2,12 @@ package main
 
 import (
 	"io/ioutil"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/m-lab/go/osx"
 	"github.com/m-lab/go/rtx"
@@ -32,3 +36,44 @@ func TestMain(t *testing.T) {
 	// REPS=1 should cause main to run once and then exit.
 	main()
 }
+
+func TestMainShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMainShutdown")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	for _, v := range []struct{ name, val string }{
+		{"REPS", "0"},
+		{"TRACE", "false"},
+		{"OUTPUT", dir},
+		{"TCPINFO_EVENTSOCKET", dir + "/eventsock.sock"},
+		{"PROMETHEUSX_LISTEN_ADDRESS", ":0"},
+	} {
+		cleanup := osx.MustSetenv(v.name, v.val)
+		defer cleanup()
+	}
+	logFatal = func(args ...interface{}) { t.Error(args...) }
+	defer func() { logFatal = log.Fatal }()
+
+	// Keep SIGTERM from killing the test before main handles it.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	// Without REPS, main runs until it gets a signal.
+	done := make(chan struct{})
+	go func() {
+		main()
+		close(done)
+	}()
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+			rtx.Must(syscall.Kill(os.Getpid(), syscall.SIGTERM), "Could not send SIGTERM")
+		case <-deadline:
+			t.Fatal("main did not shut down")
+		}
+	}
+}
@@ -39,6 +39,15 @@ var (
 		},
 	)
 
+	// PollingIntervalGauge tracks the current target interval between polling cycles.
+	// It only changes when adaptive polling is enabled.
+	PollingIntervalGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_polling_interval_seconds",
+			Help: "target interval between netlink polling cycles (seconds)",
+		},
+	)
+
 	// ConnectionCountHistogram tracks the number of connections returned by
 	// each syscall.  This ??? includes local connections that are NOT recorded
 	// in the cache or output.
@@ -152,6 +161,119 @@ var (
 			Help: "Number of snapshots taken.",
 		},
 	)
+
+	// HeartbeatCount counts the snapshots saved only because a connection had no
+	// record saved for the heartbeat interval.  They are also counted in SnapshotCount.
+	HeartbeatCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_heartbeat_total",
+			Help: "Number of heartbeat snapshots saved.",
+		},
+	)
+
+	// OutputBytes tracks the bytes in the output tree, as counted by the retention
+	// manager when it last enforced the quota.
+	OutputBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_output_bytes",
+			Help: "Bytes in the output tree.",
+		},
+	)
+
+	// OutputFreeBytes tracks the bytes available on the filesystem of the output
+	// tree, as of the last scan by the retention manager.
+	OutputFreeBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_output_free_bytes",
+			Help: "Bytes available on the filesystem of the output tree.",
+		},
+	)
+
+	// OutputFull is 1 while the output tree is over quota or the disk is nearly
+	// full, and only a sample of new connections is saved.
+	OutputFull = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_output_full",
+			Help: "Whether only a sample of new connections is saved, because the output is full.",
+		},
+	)
+
+	// RetentionDeletedBytes counts the bytes of date directories deleted by the
+	// retention manager, by reason, i.e. age or quota.
+	RetentionDeletedBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_retention_deleted_bytes_total",
+			Help: "Bytes of old date directories deleted from the output tree.",
+		}, []string{"reason"})
+
+	// RecoveryErrorCount counts the partial files left behind by a crash that
+	// could not be recovered at startup.
+	RecoveryErrorCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_recovery_errors_total",
+			Help: "Number of partial files that could not be recovered at startup.",
+		},
+	)
+
+	// SampledOutCount counts the new connections that were not saved because the
+	// output was full.
+	SampledOutCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_sampled_out_connections_total",
+			Help: "Number of new connections not saved because the output was full.",
+		},
+	)
+
+	// QueueDepth tracks the number of items waiting in the queue of each stage:
+	// MessageBlocks waiting for the saver, and tasks waiting for a marshaller.
+	QueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_queue_depth",
+			Help: "Number of items waiting in the queue of each stage.",
+		}, []string{"stage"})
+
+	// QueueBlockedSeconds counts the time producers spent waiting to queue items
+	// for each stage, because it was falling behind.
+	QueueBlockedSeconds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_queue_blocked_seconds_total",
+			Help: "Time spent waiting to queue items for each stage.",
+		}, []string{"stage"})
+
+	// DropCount counts the items dropped by the overload policy: MessageBlocks for
+	// the saver stage, and new connections for the marshaller stage.
+	DropCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_overload_drops_total",
+			Help: "Number of items dropped because a stage was overloaded.",
+		}, []string{"stage"})
+
+	// EventClientLag tracks the number of events waiting to be sent to each client
+	// of the event socket, by client number.
+	EventClientLag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_eventsocket_client_lag",
+			Help: "Number of events waiting to be sent to each eventsocket client.",
+		}, []string{"client"})
+
+	// EventsDropped counts the events not sent to a client of the event socket,
+	// because its queue was full, and the optional events, such as Stats, not
+	// sent to any client because the event socket fell behind.
+	EventsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_eventsocket_dropped_events_total",
+			Help: "Number of events not sent to eventsocket clients that fell behind, or because the eventsocket fell behind.",
+		},
+	)
+
+	// EventClientsDisconnected counts the clients of the event socket that were
+	// disconnected because they fell behind.
+	EventClientsDisconnected = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_eventsocket_disconnected_clients_total",
+			Help: "Number of eventsocket clients disconnected because they fell behind.",
+		},
+	)
 )
 
 // init() prints a log message to let the user know that the package has been
@@ -11,5 +11,10 @@ func TestPrometheusMetrics(t *testing.T) {
 	metrics.ConnectionCountHistogram.WithLabelValues("x")
 	metrics.ErrorCount.WithLabelValues("x")
 	metrics.SyscallTimeHistogram.WithLabelValues("x")
+	metrics.RetentionDeletedBytes.WithLabelValues("x")
+	metrics.QueueDepth.WithLabelValues("x")
+	metrics.QueueBlockedSeconds.WithLabelValues("x")
+	metrics.DropCount.WithLabelValues("x")
+	metrics.EventClientLag.WithLabelValues("x")
 	promtest.LintMetrics(nil)
 }
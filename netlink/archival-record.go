@@ -28,6 +28,32 @@ type Metadata struct {
 	UUID      string
 	Sequence  int
 	StartTime time.Time
+	// Namespace identifies the network namespace of the connection.  It is empty for
+	// connections in the namespace tcp-info runs in.
+	Namespace string `json:",omitempty"`
+	// Protocol is the transport protocol of the connection.  It is omitted for TCP.
+	Protocol inetdiag.Protocol `json:",omitempty"`
+	// Host and Pod identify the machine and site that collected the connection, so
+	// that files can be attributed after they are moved off the machine.
+	Host string `json:",omitempty"`
+	Pod  string `json:",omitempty"`
+
+	// The remaining fields describe the writer, so that readers can tell what to
+	// expect of the records in the file.
+	ToolVersion   string `json:",omitempty"` // The git commit tcp-info was built from.
+	KernelRelease string `json:",omitempty"` // e.g. 4.19.0-8-amd64
+	// ExtMask is the INET_DIAG extension mask requested from the kernel.  Bit n-1
+	// requests attribute n, so missing attributes were either not requested, or
+	// not provided by the kernel.
+	ExtMask uint8 `json:",omitempty"`
+	// TCPInfoSize is the size of tcp.LinuxTCPInfo in the writer.  INET_DIAG_INFO
+	// attributes shorter than this came from an older kernel, and the fields they
+	// lack are not valid.  Longer ones came from a newer kernel, and still hold
+	// all the fields, even though the writer could not interpret them.
+	TCPInfoSize int `json:",omitempty"`
+	// Anonymization is the IP anonymization method applied to the records, e.g.
+	// none, or netblock.
+	Anonymization string `json:",omitempty"`
 }
 
 // ArchivalRecord is a container for parsed InetDiag messages and attributes.
@@ -45,6 +71,48 @@ type ArchivalRecord struct {
 	// Metadata contains connection level metadata.  It is typically included in the very first record
 	// in a file.
 	Metadata *Metadata `json:",omitempty"`
+
+	// Namespace identifies the network namespace the record was collected from.  Socket cookies
+	// are only unique within a namespace.  Empty for the namespace tcp-info runs in.
+	Namespace string `json:",omitempty"`
+
+	// Protocol is the transport protocol of the socket.  It is omitted for TCP, so zero
+	// also means TCP.  For other protocols, there is no TCPInfo, and INET_DIAG_INFO, if
+	// present, holds a protocol specific struct.
+	Protocol inetdiag.Protocol `json:",omitempty"`
+
+	// Delta, if present, replaces the RawIDM and Attributes with their changes from
+	// the previous record in the file.  See delta.go.  The ArchiveReaders returned
+	// by NewArchiveReader never return such records.
+	Delta *Delta `json:",omitempty"`
+
+	// Heartbeat is true for records that were saved only because no record of the
+	// connection had been saved for a while, rather than because anything changed.
+	Heartbeat bool `json:",omitempty"`
+
+	// CloseReason, if present, marks the last record of a connection, written when
+	// the connection closed, or tcp-info stopped saving it.  Such a record has no
+	// RawIDM, and, unless the file was recovered after a crash, has a Summary.
+	CloseReason string `json:",omitempty"`
+
+	// Summary, if present, describes the whole connection.
+	Summary *Summary `json:",omitempty"`
+}
+
+// CloseReasonClosed is the CloseReason of the records written when the kernel no
+// longer reports a connection.
+const CloseReasonClosed = "closed"
+
+// CloseReasonShutdown is the CloseReason of the records written when tcp-info shuts down.
+const CloseReasonShutdown = "shutdown"
+
+// CloseReasonRecovered is the CloseReason of the records appended to files that were
+// left incomplete by a crash, when they are recovered on the next start.
+const CloseReasonRecovered = "recovered"
+
+// IsTCP returns true if the record is from a TCP socket.
+func (pm *ArchivalRecord) IsTCP() bool {
+	return pm.Protocol == 0 || pm.Protocol == inetdiag.Protocol_IPPROTO_TCP
 }
 
 // ParseRouteAttr parses a byte array into slice of NetlinkRouteAttr struct.
@@ -181,27 +249,31 @@ func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error)
 
 	// TODO - should we validate that ID matches?  Otherwise, we shouldn't even be comparing the rest.
 
-	// We now allocate only the size
-	if len(previous.Attributes) <= inetdiag.INET_DIAG_INFO || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
-		return NoTCPInfo, nil
-	}
-	a := previous.Attributes[inetdiag.INET_DIAG_INFO]
-	b := pm.Attributes[inetdiag.INET_DIAG_INFO]
-	if a == nil || b == nil {
-		return NoTCPInfo, nil
-	}
+	// Other protocols have no TCPInfo, so all their attributes are compared below.
+	isTCP := pm.IsTCP()
+	if isTCP {
+		// We now allocate only the size
+		if len(previous.Attributes) <= inetdiag.INET_DIAG_INFO || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+			return NoTCPInfo, nil
+		}
+		a := previous.Attributes[inetdiag.INET_DIAG_INFO]
+		b := pm.Attributes[inetdiag.INET_DIAG_INFO]
+		if a == nil || b == nil {
+			return NoTCPInfo, nil
+		}
 
-	// If any of the byte/segment/package counters have changed, that is what we are most
-	// interested in.
-	// NOTE: There are more fields beyond BusyTime, but for now we are ignoring them for diffing purposes.
-	if 0 != bytes.Compare(a[pmtuOffset:busytimeOffset], b[pmtuOffset:busytimeOffset]) {
-		return StateOrCounterChange, nil
-	}
+		// If any of the byte/segment/package counters have changed, that is what we are most
+		// interested in.
+		// NOTE: There are more fields beyond BusyTime, but for now we are ignoring them for diffing purposes.
+		if 0 != bytes.Compare(a[pmtuOffset:busytimeOffset], b[pmtuOffset:busytimeOffset]) {
+			return StateOrCounterChange, nil
+		}
 
-	// Check all the earlier fields, too.  Usually these won't change unless the counters above
-	// change, but this way we won't miss something subtle.
-	if 0 != bytes.Compare(a[:lastDataSentOffset], b[:lastDataSentOffset]) {
-		return StateOrCounterChange, nil
+		// Check all the earlier fields, too.  Usually these won't change unless the counters above
+		// change, but this way we won't miss something subtle.
+		if 0 != bytes.Compare(a[:lastDataSentOffset], b[:lastDataSentOffset]) {
+			return StateOrCounterChange, nil
+		}
 	}
 
 	// If any attributes have been added or removed, that is likely significant.
@@ -216,8 +288,8 @@ func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error)
 		if tp >= len(pm.Attributes) {
 			return LostAttribute, nil
 		}
-		switch tp {
-		case inetdiag.INET_DIAG_INFO:
+		switch {
+		case tp == inetdiag.INET_DIAG_INFO && isTCP:
 			// Handled explicitly above.
 		default:
 			// Detect any change in anything other than INET_DIAG_INFO
@@ -297,15 +369,25 @@ type archiveReader struct {
 	scanner *bufio.Scanner
 }
 
-// NewArchiveReader wraps a source of JSONL ArchiveRecords to create ArchiveReader
+// NewArchiveReader wraps a source of ArchiveRecords to create ArchiveReader.  The
+// source may be JSONL, or binary records, which are detected by BinaryMagic.  Records
+// written as deltas are reconstructed.
 func NewArchiveReader(rdr io.Reader) ArchiveReader {
-	sc := bufio.NewScanner(rdr)
-	return &archiveReader{scanner: sc}
+	br := bufio.NewReader(rdr)
+	if magic, _ := br.Peek(len(BinaryMagic)); string(magic) == BinaryMagic {
+		br.Discard(len(BinaryMagic))
+		return &deltaReader{rdr: &binaryReader{rdr: br}}
+	}
+	sc := bufio.NewScanner(br)
+	return &deltaReader{rdr: &archiveReader{scanner: sc}}
 }
 
 // Next decodes and returns the next ArchivalRecord.
 func (ar *archiveReader) Next() (*ArchivalRecord, error) {
 	if !ar.scanner.Scan() {
+		if err := ar.scanner.Err(); err != nil {
+			return nil, err
+		}
 		return nil, io.EOF
 	}
 	buf := ar.scanner.Bytes()
@@ -318,7 +400,39 @@ func (ar *archiveReader) Next() (*ArchivalRecord, error) {
 	return &record, nil
 }
 
-// LoadAllArchivalRecords reads all PMs from a jsonl stream.
+// ArchiveWriter writes ArchivalRecords to some destination, in some format.
+type ArchiveWriter interface {
+	// Write encodes and writes a single ArchivalRecord.
+	Write(*ArchivalRecord) error
+	// Close closes the destination.
+	Close() error
+}
+
+type jsonlWriter struct {
+	w io.WriteCloser
+}
+
+// NewJSONLWriter returns an ArchiveWriter that writes one JSON object per line to w.
+func NewJSONLWriter(w io.WriteCloser) ArchiveWriter {
+	return &jsonlWriter{w: w}
+}
+
+// Write encodes and writes a single record.
+func (jw *jsonlWriter) Write(pm *ArchivalRecord) error {
+	b, err := json.Marshal(pm)
+	if err != nil {
+		return err
+	}
+	_, err = jw.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying writer.
+func (jw *jsonlWriter) Close() error {
+	return jw.w.Close()
+}
+
+// LoadAllArchivalRecords reads all PMs from a jsonl or binary stream.
 func LoadAllArchivalRecords(rdr io.Reader) ([]*ArchivalRecord, error) {
 	msgs := make([]*ArchivalRecord, 0, 2000) // We typically read a large number of records
 
@@ -344,9 +458,10 @@ func (pm *ArchivalRecord) HasDiagInfo() bool {
 var sendLogger = logx.NewLogEvery(nil, time.Second)
 var rcvLogger = logx.NewLogEvery(nil, time.Second)
 
-// GetStats returns basic stats from the TCPInfo snapshot.
+// GetStats returns basic stats from the TCPInfo snapshot.  It returns zeros for
+// other protocols.
 func (pm *ArchivalRecord) GetStats() (uint64, uint64) {
-	if len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+	if !pm.IsTCP() || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
 		return 0, 0
 	}
 	raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
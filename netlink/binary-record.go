@@ -0,0 +1,349 @@
+package netlink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+/*********************************************************************************************
+*          Binary encoding of ArchivalRecords
+*********************************************************************************************/
+
+// A binary archive is BinaryMagic followed by a sequence of records, each of which is
+// a uvarint length followed by that many bytes of record.  A record starts with a
+// uvarint bitmask of the fields present, followed by the fields in bit order:
+//
+//	Timestamp   varint nanoseconds since the Unix epoch
+//	RawIDM      uvarint length, bytes
+//	Attributes  uvarint count, then for each, uvarint length+1 (0 for nil), bytes
+//	Metadata    uvarint length, JSON bytes
+//	Namespace   uvarint length, bytes
+//	Protocol    uvarint
+//	Delta       uvarint length, bytes of the Delta binary encoding
+//	Heartbeat   nothing, the bit alone means true
+//	CloseReason uvarint length, bytes
+//	Summary     uvarint length, JSON bytes
+//
+// Like the JSONL format, nothing is parsed beyond what is needed, so the RawIDM and
+// attributes are kept exactly as the kernel sent them.  New fields are added with new
+// bits at the end, and readers ignore the rest of a record after the fields they know.
+
+// BinaryMagic is the header of binary archives.  JSONL archives always start with '{'.
+const BinaryMagic = "\x00tcp-info-ar\x01"
+
+// maxBinaryRecordSize bounds the allocation for a record with a corrupt length.
+const maxBinaryRecordSize = 1 << 20
+
+// Bits in the binary record field mask.
+const (
+	hasTimestamp = 1 << iota
+	hasRawIDM
+	hasAttributes
+	hasMetadata
+	hasNamespace
+	hasProtocol
+	hasDelta
+	isHeartbeat
+	hasCloseReason
+	hasSummary
+)
+
+// Errors from decoding binary archives.
+var (
+	ErrBinaryTruncated = errors.New("binary ArchivalRecord is truncated")
+	ErrBinaryTooLarge  = errors.New("binary ArchivalRecord is too large")
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// AppendBinary appends the binary encoding of the record, without the length
+// prefix, to b.
+func (pm *ArchivalRecord) AppendBinary(b []byte) ([]byte, error) {
+	var mask uint64
+	if !pm.Timestamp.IsZero() {
+		mask |= hasTimestamp
+	}
+	if pm.RawIDM != nil {
+		mask |= hasRawIDM
+	}
+	if pm.Attributes != nil {
+		mask |= hasAttributes
+	}
+	if pm.Metadata != nil {
+		mask |= hasMetadata
+	}
+	if pm.Namespace != "" {
+		mask |= hasNamespace
+	}
+	if pm.Protocol != 0 {
+		mask |= hasProtocol
+	}
+	if pm.Delta != nil {
+		mask |= hasDelta
+	}
+	if pm.Heartbeat {
+		mask |= isHeartbeat
+	}
+	if pm.CloseReason != "" {
+		mask |= hasCloseReason
+	}
+	if pm.Summary != nil {
+		mask |= hasSummary
+	}
+	b = appendUvarint(b, mask)
+	if mask&hasTimestamp != 0 {
+		b = appendVarint(b, pm.Timestamp.UnixNano())
+	}
+	if mask&hasRawIDM != 0 {
+		b = appendBytes(b, pm.RawIDM)
+	}
+	if mask&hasAttributes != 0 {
+		b = appendUvarint(b, uint64(len(pm.Attributes)))
+		for _, a := range pm.Attributes {
+			if a == nil {
+				b = append(b, 0)
+				continue
+			}
+			b = appendUvarint(b, uint64(len(a))+1)
+			b = append(b, a...)
+		}
+	}
+	if mask&hasMetadata != 0 {
+		// Metadata appears once per file, so there is no need to make it compact.
+		md, err := json.Marshal(pm.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, md)
+	}
+	if mask&hasNamespace != 0 {
+		b = appendBytes(b, []byte(pm.Namespace))
+	}
+	if mask&hasProtocol != 0 {
+		b = appendUvarint(b, uint64(pm.Protocol))
+	}
+	if mask&hasDelta != 0 {
+		b = appendBytes(b, pm.Delta.appendBinary(nil))
+	}
+	if mask&hasCloseReason != 0 {
+		b = appendBytes(b, []byte(pm.CloseReason))
+	}
+	if mask&hasSummary != 0 {
+		// Like Metadata, summaries appear once per connection.
+		s, err := json.Marshal(pm.Summary)
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, s)
+	}
+	return b, nil
+}
+
+// MarshalBinary returns the binary encoding of the record, without the length prefix.
+func (pm *ArchivalRecord) MarshalBinary() ([]byte, error) {
+	return pm.AppendBinary(nil)
+}
+
+// binaryDecoder consumes fields from a binary record.
+type binaryDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrBinaryTruncated
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrBinaryTruncated
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryDecoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = ErrBinaryTruncated
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+// UnmarshalBinary decodes a record encoded by MarshalBinary.  The RawIDM and
+// Attributes of the record refer to data.
+func (pm *ArchivalRecord) UnmarshalBinary(data []byte) error {
+	*pm = ArchivalRecord{}
+	d := binaryDecoder{b: data}
+	mask := d.uvarint()
+	if mask&hasTimestamp != 0 {
+		pm.Timestamp = time.Unix(0, d.varint()).UTC()
+	}
+	if mask&hasRawIDM != 0 {
+		pm.RawIDM = inetdiag.RawInetDiagMsg(d.bytes(d.uvarint()))
+	}
+	if mask&hasAttributes != 0 {
+		count := d.uvarint()
+		// Each attribute takes at least one byte.
+		if count > uint64(len(d.b)) {
+			return ErrBinaryTruncated
+		}
+		pm.Attributes = make([][]byte, count)
+		for i := range pm.Attributes {
+			if n := d.uvarint(); n > 0 {
+				pm.Attributes[i] = d.bytes(n - 1)
+			}
+		}
+	}
+	if mask&hasMetadata != 0 {
+		md := d.bytes(d.uvarint())
+		if d.err == nil {
+			pm.Metadata = &Metadata{}
+			if err := json.Unmarshal(md, pm.Metadata); err != nil {
+				return err
+			}
+		}
+	}
+	if mask&hasNamespace != 0 {
+		pm.Namespace = string(d.bytes(d.uvarint()))
+	}
+	if mask&hasProtocol != 0 {
+		pm.Protocol = inetdiag.Protocol(d.uvarint())
+	}
+	if mask&hasDelta != 0 {
+		delta := d.bytes(d.uvarint())
+		if d.err == nil {
+			pm.Delta = &Delta{}
+			if err := pm.Delta.UnmarshalBinary(delta); err != nil {
+				return err
+			}
+		}
+	}
+	pm.Heartbeat = mask&isHeartbeat != 0
+	if mask&hasCloseReason != 0 {
+		pm.CloseReason = string(d.bytes(d.uvarint()))
+	}
+	if mask&hasSummary != 0 {
+		s := d.bytes(d.uvarint())
+		if d.err == nil {
+			pm.Summary = &Summary{}
+			if err := json.Unmarshal(s, pm.Summary); err != nil {
+				return err
+			}
+		}
+	}
+	return d.err
+}
+
+type binaryWriter struct {
+	w   io.WriteCloser
+	buf []byte
+}
+
+// NewBinaryWriter writes BinaryMagic to w, and returns an ArchiveWriter that
+// writes length prefixed binary records to w.
+func NewBinaryWriter(w io.WriteCloser) (ArchiveWriter, error) {
+	_, err := io.WriteString(w, BinaryMagic)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryWriter{w: w}, nil
+}
+
+// Write encodes and writes a single record.
+func (bw *binaryWriter) Write(pm *ArchivalRecord) error {
+	// Leave room in front of the record for the length, so that it can be
+	// written with a single call.
+	if bw.buf == nil {
+		bw.buf = make([]byte, binary.MaxVarintLen32, 1024)
+	}
+	buf, err := pm.AppendBinary(bw.buf[:binary.MaxVarintLen32])
+	if err != nil {
+		return err
+	}
+	bw.buf = buf
+	size := len(buf) - binary.MaxVarintLen32
+	if size > maxBinaryRecordSize {
+		return ErrBinaryTooLarge
+	}
+	var length [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(length[:], uint64(size))
+	start := binary.MaxVarintLen32 - n
+	copy(buf[start:], length[:n])
+	_, err = bw.w.Write(buf[start:])
+	return err
+}
+
+// Close closes the underlying writer.
+func (bw *binaryWriter) Close() error {
+	return bw.w.Close()
+}
+
+type binaryReader struct {
+	rdr *bufio.Reader
+}
+
+// Next decodes and returns the next ArchivalRecord.
+func (br *binaryReader) Next() (*ArchivalRecord, error) {
+	size, err := binary.ReadUvarint(br.rdr)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrBinaryTruncated
+		}
+		return nil, err
+	}
+	if size > maxBinaryRecordSize {
+		return nil, ErrBinaryTooLarge
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(br.rdr, buf)
+	if err != nil {
+		return nil, ErrBinaryTruncated
+	}
+	record := ArchivalRecord{}
+	err = record.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
@@ -0,0 +1,274 @@
+package netlink
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+/*********************************************************************************************
+*          Delta encoding of consecutive ArchivalRecords
+*********************************************************************************************/
+
+// Consecutive records of a connection usually differ in just a few counters.  In delta
+// mode, a record that has the same shape as the previous record, that is, the same
+// RawIDM length and the same attributes with the same lengths, is written as a list
+// of the byte ranges that changed.  Every so often, and whenever the shape changes, a
+// full record, or keyframe, is written instead.  The first record of every file is a
+// keyframe, so files can be read on their own.
+//
+// The ArchiveReaders returned by NewArchiveReader reconstruct the full records, so
+// consumers never see the deltas.
+
+// Errors from reconstructing delta records.
+var (
+	ErrDeltaWithoutKeyframe = errors.New("delta record without a previous full record")
+	ErrBadDelta             = errors.New("delta record does not match the previous record")
+)
+
+// patchGap is the number of unchanged bytes that are included in a patch, rather
+// than starting a new one.  Each patch costs a few bytes of overhead.
+const patchGap = 8
+
+// DeltaRawIDM is the Patch.Attribute value of patches to the RawIDM.
+const DeltaRawIDM = -1
+
+// Patch is a changed byte range of the RawIDM, or of an attribute.
+type Patch struct {
+	Attribute int // The attribute index, or DeltaRawIDM.
+	Offset    int
+	Data      []byte
+}
+
+// Delta replaces the RawIDM and Attributes of a record that is encoded relative to
+// the previous record of the same connection.  Each patch takes just a few bytes of
+// overhead in its binary encoding, which is also used, in base64, in JSONL files.
+type Delta struct {
+	Patches []Patch
+}
+
+// appendBinary appends the binary encoding of the patches to b: a uvarint count,
+// then for each patch, a varint attribute, a uvarint offset, a uvarint length, and
+// the data.
+func (d *Delta) appendBinary(b []byte) []byte {
+	b = appendUvarint(b, uint64(len(d.Patches)))
+	for _, p := range d.Patches {
+		b = appendVarint(b, int64(p.Attribute))
+		b = appendUvarint(b, uint64(p.Offset))
+		b = appendBytes(b, p.Data)
+	}
+	return b
+}
+
+// MarshalBinary returns the binary encoding of the patches.
+func (d *Delta) MarshalBinary() ([]byte, error) {
+	return d.appendBinary(nil), nil
+}
+
+// UnmarshalBinary decodes patches encoded by MarshalBinary.  The patch data refers
+// to data.
+func (d *Delta) UnmarshalBinary(data []byte) error {
+	dec := binaryDecoder{b: data}
+	count := dec.uvarint()
+	// Each patch takes at least three bytes.
+	if count > uint64(len(dec.b)) {
+		return ErrBinaryTruncated
+	}
+	d.Patches = make([]Patch, count)
+	for i := range d.Patches {
+		p := &d.Patches[i]
+		p.Attribute = int(dec.varint())
+		p.Offset = int(dec.uvarint())
+		p.Data = dec.bytes(dec.uvarint())
+	}
+	return dec.err
+}
+
+// MarshalJSON encodes the patches as a base64 string of their binary encoding,
+// which is much smaller than a JSON object per patch.
+func (d *Delta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.appendBinary(nil))
+}
+
+// UnmarshalJSON decodes patches encoded by MarshalJSON.
+func (d *Delta) UnmarshalJSON(data []byte) error {
+	var b []byte
+	err := json.Unmarshal(data, &b)
+	if err != nil {
+		return err
+	}
+	return d.UnmarshalBinary(b)
+}
+
+// diff appends patches for the byte ranges where b differs from a, which must
+// have the same length.
+func diff(patches []Patch, attribute int, a, b []byte) []Patch {
+	for i := 0; i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		// Extend the patch until there are patchGap unchanged bytes.
+		end := i + 1
+		for j := end; j < len(b) && j < end+patchGap; j++ {
+			if a[j] != b[j] {
+				end = j + 1
+			}
+		}
+		patches = append(patches, Patch{Attribute: attribute, Offset: i, Data: b[i:end:end]})
+		i = end
+	}
+	return patches
+}
+
+// sameShape returns whether pm can be encoded as a delta from prev.
+func sameShape(prev, pm *ArchivalRecord) bool {
+	if prev == nil || pm.RawIDM == nil || len(prev.RawIDM) != len(pm.RawIDM) || len(prev.Attributes) != len(pm.Attributes) {
+		return false
+	}
+	for i := range pm.Attributes {
+		if (prev.Attributes[i] == nil) != (pm.Attributes[i] == nil) || len(prev.Attributes[i]) != len(pm.Attributes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// MakeDelta returns a copy of pm with the RawIDM and Attributes replaced by their
+// changes relative to prev, or nil if pm is not the same shape as prev.
+func MakeDelta(prev, pm *ArchivalRecord) *ArchivalRecord {
+	if !sameShape(prev, pm) {
+		return nil
+	}
+	patches := diff(nil, DeltaRawIDM, prev.RawIDM, pm.RawIDM)
+	for i := range pm.Attributes {
+		patches = diff(patches, i, prev.Attributes[i], pm.Attributes[i])
+	}
+	delta := *pm
+	delta.RawIDM = nil
+	delta.Attributes = nil
+	delta.Delta = &Delta{Patches: patches}
+	return &delta
+}
+
+// copyRecordData returns a copy of the RawIDM and Attributes of pm, in a single allocation.
+func copyRecordData(pm *ArchivalRecord) ([]byte, [][]byte) {
+	size := len(pm.RawIDM)
+	for _, a := range pm.Attributes {
+		size += len(a)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, pm.RawIDM...)
+	var raw []byte
+	if pm.RawIDM != nil {
+		raw = buf[:len(pm.RawIDM):len(pm.RawIDM)]
+	}
+	var attrs [][]byte
+	if pm.Attributes != nil {
+		attrs = make([][]byte, len(pm.Attributes))
+		for i, a := range pm.Attributes {
+			if a == nil {
+				continue
+			}
+			start := len(buf)
+			buf = append(buf, a...)
+			attrs[i] = buf[start:len(buf):len(buf)]
+		}
+	}
+	return raw, attrs
+}
+
+// Clone returns a copy of pm that does not share any data with it.  The Metadata
+// and Delta are shared, as they are never modified.
+func (pm *ArchivalRecord) Clone() *ArchivalRecord {
+	c := *pm
+	c.RawIDM, c.Attributes = copyRecordData(pm)
+	return &c
+}
+
+// ApplyDelta reconstructs the full record from a delta record and the previous full
+// record.  The reconstructed record does not share any data with prev.
+func ApplyDelta(prev, delta *ArchivalRecord) (*ArchivalRecord, error) {
+	if prev == nil || prev.RawIDM == nil {
+		return nil, ErrDeltaWithoutKeyframe
+	}
+	pm := *delta
+	pm.Delta = nil
+	pm.RawIDM, pm.Attributes = copyRecordData(prev)
+	for _, p := range delta.Delta.Patches {
+		var dst []byte
+		switch {
+		case p.Attribute == DeltaRawIDM:
+			dst = pm.RawIDM
+		case p.Attribute >= 0 && p.Attribute < len(pm.Attributes):
+			dst = pm.Attributes[p.Attribute]
+		default:
+			return nil, ErrBadDelta
+		}
+		if p.Offset < 0 || p.Offset > len(dst) || len(p.Data) > len(dst)-p.Offset {
+			return nil, ErrBadDelta
+		}
+		copy(dst[p.Offset:], p.Data)
+	}
+	return &pm, nil
+}
+
+type deltaWriter struct {
+	w        ArchiveWriter
+	interval int
+	count    int // Records since the last keyframe.
+	prev     *ArchivalRecord
+}
+
+// NewDeltaWriter returns an ArchiveWriter that writes records to w as deltas from
+// the previous record, with a keyframe at least every keyframeInterval records.
+func NewDeltaWriter(w ArchiveWriter, keyframeInterval int) ArchiveWriter {
+	return &deltaWriter{w: w, interval: keyframeInterval}
+}
+
+// Write writes pm, or its delta from the previous record.
+func (dw *deltaWriter) Write(pm *ArchivalRecord) error {
+	if pm.RawIDM == nil {
+		// Headers, and anything else without a RawIDM, are never deltas.
+		return dw.w.Write(pm)
+	}
+	var delta *ArchivalRecord
+	if dw.count+1 < dw.interval {
+		delta = MakeDelta(dw.prev, pm)
+	}
+	// Keep a copy, as the caller may reuse the data.
+	dw.prev = pm.Clone()
+	if delta == nil {
+		dw.count = 0
+		return dw.w.Write(pm)
+	}
+	dw.count++
+	return dw.w.Write(delta)
+}
+
+// Close closes the underlying writer.
+func (dw *deltaWriter) Close() error {
+	return dw.w.Close()
+}
+
+// deltaReader reconstructs full records from the delta records of another reader.
+type deltaReader struct {
+	rdr  ArchiveReader
+	prev *ArchivalRecord
+}
+
+// Next returns the next full ArchivalRecord.
+func (dr *deltaReader) Next() (*ArchivalRecord, error) {
+	pm, err := dr.rdr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if pm.Delta != nil {
+		pm, err = ApplyDelta(dr.prev, pm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pm.RawIDM != nil {
+		dr.prev = pm
+	}
+	return pm, nil
+}
@@ -1,9 +1,19 @@
 package netlink
 
-import "time"
+import (
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
 
 // MessageBlock contains timestamps and message arrays for v4 and v6 from a single collection cycle.
 type MessageBlock struct {
+	// Namespace identifies the network namespace the messages were collected from.
+	// It is empty for the namespace tcp-info runs in.
+	Namespace string
+	// Protocol is the transport protocol of all the sockets in the block.  Zero means TCP.
+	Protocol inetdiag.Protocol
+
 	V4Time     time.Time         // Time at which netlink message block was received.
 	V4Messages []*NetlinkMessage // Array of raw messages.
 
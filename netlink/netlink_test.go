@@ -1,6 +1,7 @@
 package netlink_test
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -108,7 +109,8 @@ func TestReader(t *testing.T) {
 	// 1209 sockets 143 remotes 403 per iteration
 	source := "testdata/testdata.zst"
 	t.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	parsed := int64(0)
 	for {
 		_, err := netlink.LoadRawNetlinkMessage(rdr)
@@ -178,12 +180,38 @@ func TestCompare(t *testing.T) {
 		t.Error("Late field change not detected:", deep.Equal(mp1.Attributes[inetdiag.INET_DIAG_INFO],
 			mp2.Attributes[inetdiag.INET_DIAG_INFO]))
 	}
+
+	// For other protocols, INET_DIAG_INFO is not TCPInfo, so any change is detected.
+	mp1.Protocol = inetdiag.Protocol_IPPROTO_SCTP
+	mp2.Protocol = inetdiag.Protocol_IPPROTO_SCTP
+	mp2.Attributes[inetdiag.INET_DIAG_INFO] = append([]byte{}, mp1.Attributes[inetdiag.INET_DIAG_INFO]...)
+	mp2.Attributes[inetdiag.INET_DIAG_INFO][lastDataSentOffset] += 1
+	diff, err = mp1.Compare(mp2)
+	rtx.Must(err, "")
+	if diff != netlink.Other {
+		t.Error("Change in SCTP info not detected:", diff)
+	}
+	if s, r := mp1.GetStats(); s != 0 || r != 0 {
+		t.Error("Should have no TCP stats for SCTP", s, r)
+	}
+
+	// ... and may be missing altogether, e.g. for UDP.
+	mp1.Protocol = inetdiag.Protocol_IPPROTO_UDP
+	mp2.Protocol = inetdiag.Protocol_IPPROTO_UDP
+	mp1.Attributes[inetdiag.INET_DIAG_INFO] = nil
+	mp2.Attributes[inetdiag.INET_DIAG_INFO] = nil
+	diff, err = mp1.Compare(mp2)
+	rtx.Must(err, "")
+	if diff != netlink.NoMajorChange {
+		t.Error("Unchanged UDP record should have no change:", diff)
+	}
 }
 
 func TestNLMsgSerialize(t *testing.T) {
 	source := "testdata/testdata.zst"
 	t.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	parsed := 0
 	for {
 		msg, err := netlink.LoadRawNetlinkMessage(rdr)
@@ -235,7 +263,8 @@ func TestCompressionSize(t *testing.T) {
 		t.Fatal(err)
 	}
 	t.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	msgs := make([]*netlink.ArchivalRecord, 0, 200)
 
 	ts := time.Now()
@@ -293,7 +322,8 @@ func BenchmarkNLMsgSerialize(b *testing.B) {
 	b.StopTimer()
 	source := "testdata/testdata.zst"
 	b.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	msgs := make([]*netlink.ArchivalRecord, 0, 200)
 
 	for {
@@ -328,7 +358,8 @@ func BenchmarkNLMsgParseSerializeCompress(b *testing.B) {
 	b.StopTimer()
 	source := "testdata/testdata.zst"
 	b.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	raw := make([]*netlink.NetlinkMessage, 0, 200)
 	msgs := make([]*netlink.ArchivalRecord, 0, 200)
 
@@ -375,7 +406,8 @@ func BenchmarkNLMsgParseSerializeCompress(b *testing.B) {
 func Test_rawReader_Next(t *testing.T) {
 	source := "testdata/testdata.zst"
 	t.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	defer rdr.Close()
 	raw := netlink.NewRawReader(rdr)
 
@@ -398,7 +430,8 @@ func Test_rawReader_Next(t *testing.T) {
 func Test_archiveReader_Next(t *testing.T) {
 	source := "testdata/archiveRecords.jsonl.zst"
 	log.Println("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	defer rdr.Close()
 	msgs, err := netlink.LoadAllArchivalRecords(rdr)
 	if err != nil {
@@ -411,7 +444,8 @@ func Test_archiveReader_Next(t *testing.T) {
 
 func TestGetStats(t *testing.T) {
 	source := "testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst"
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	defer rdr.Close()
 	msgs, err := netlink.LoadAllArchivalRecords(rdr)
 	if err != nil {
@@ -439,7 +473,8 @@ func TestGetStats(t *testing.T) {
 func TestLoadAllArchivalRecords(t *testing.T) {
 	source := "testdata/testdata.zst"
 	log.Println("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	defer rdr.Close()
 	raw := netlink.NewRawReader(rdr)
 
@@ -458,3 +493,181 @@ func TestLoadAllArchivalRecords(t *testing.T) {
 		t.Error("Wrong count:", parsed)
 	}
 }
+
+// nopCloser adds a no-op Close method to a bytes.Buffer.
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestBinaryFormat(t *testing.T) {
+	source := "testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst"
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
+	defer rdr.Close()
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", source)
+	// Exercise the fields that are not in the test data.
+	msgs[1].Namespace = "netns-42"
+	msgs[1].Protocol = inetdiag.Protocol_IPPROTO_UDP
+	msgs[2].Attributes = append(msgs[2].Attributes, []byte{})
+	msgs[2].Heartbeat = true
+	msgs = append(msgs, &netlink.ArchivalRecord{Timestamp: msgs[2].Timestamp, CloseReason: netlink.CloseReasonShutdown, Summary: &netlink.Summary{UUID: "foo", MaxRTT: 1234}})
+
+	jsonl := nopCloser{&bytes.Buffer{}}
+	bin := nopCloser{&bytes.Buffer{}}
+	jw := netlink.NewJSONLWriter(jsonl)
+	bw, err := netlink.NewBinaryWriter(bin)
+	rtx.Must(err, "Could not create binary writer")
+	for _, m := range msgs {
+		rtx.Must(jw.Write(m), "Could not write JSONL")
+		rtx.Must(bw.Write(m), "Could not write binary")
+	}
+	t.Logf("%d records, %d bytes of JSONL, %d bytes binary", len(msgs), jsonl.Len(), bin.Len())
+	if bin.Len() >= jsonl.Len()*3/4 {
+		t.Errorf("Binary should be much smaller than JSONL: %d >= %d", bin.Len(), jsonl.Len())
+	}
+	if !strings.HasPrefix(bin.String(), netlink.BinaryMagic) {
+		t.Error("Binary format should start with the magic header")
+	}
+
+	// Both formats are detected by the reader, and decode to the same records.
+	for _, buf := range []*bytes.Buffer{jsonl.Buffer, bin.Buffer} {
+		read, err := netlink.LoadAllArchivalRecords(buf)
+		rtx.Must(err, "Could not read records")
+		if diff := deep.Equal(read, msgs); diff != nil {
+			t.Error(diff)
+		}
+	}
+}
+
+func TestBinaryFormatErrors(t *testing.T) {
+	ar := netlink.ArchivalRecord{
+		Timestamp:  time.Date(2019, 7, 1, 0, 0, 12, 92000000, time.UTC),
+		RawIDM:     inetdiag.RawInetDiagMsg{1, 2, 3},
+		Attributes: [][]byte{nil, {4, 5}},
+		Metadata:   &netlink.Metadata{UUID: "foo"},
+	}
+	b, err := ar.MarshalBinary()
+	rtx.Must(err, "Could not marshal")
+	// Every truncation must be detected.
+	for i := 0; i < len(b); i++ {
+		var read netlink.ArchivalRecord
+		if read.UnmarshalBinary(b[:i]) == nil {
+			t.Error("Truncation at", i, "was not detected")
+		}
+	}
+	// Fields added later are ignored.
+	var read netlink.ArchivalRecord
+	rtx.Must(read.UnmarshalBinary(append(b, 1, 2, 3)), "Could not unmarshal")
+	if diff := deep.Equal(read, ar); diff != nil {
+		t.Error(diff)
+	}
+
+	truncated := netlink.BinaryMagic + string(byte(len(b))) + string(b[:len(b)-1])
+	_, err = netlink.NewArchiveReader(strings.NewReader(truncated)).Next()
+	if err != netlink.ErrBinaryTruncated {
+		t.Error("Expected ErrBinaryTruncated, got", err)
+	}
+	huge := netlink.BinaryMagic + "\xff\xff\xff\xff\x0f"
+	_, err = netlink.NewArchiveReader(strings.NewReader(huge)).Next()
+	if err != netlink.ErrBinaryTooLarge {
+		t.Error("Expected ErrBinaryTooLarge, got", err)
+	}
+	_, err = netlink.NewArchiveReader(strings.NewReader(netlink.BinaryMagic)).Next()
+	if err != io.EOF {
+		t.Error("Expected EOF, got", err)
+	}
+}
+
+func TestDelta(t *testing.T) {
+	source := "testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst"
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
+	defer rdr.Close()
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", source)
+	// A change of shape forces a keyframe.
+	msgs[20].Attributes = append(msgs[20].Attributes, []byte{1, 2, 3})
+
+	full := nopCloser{&bytes.Buffer{}}
+	fw := netlink.NewJSONLWriter(full)
+	for _, m := range msgs {
+		rtx.Must(fw.Write(m), "Could not write JSONL")
+	}
+	for _, format := range []string{"jsonl", "binary"} {
+		buf := nopCloser{&bytes.Buffer{}}
+		var w netlink.ArchiveWriter
+		if format == "binary" {
+			w, err = netlink.NewBinaryWriter(buf)
+			rtx.Must(err, "Could not create binary writer")
+		} else {
+			w = netlink.NewJSONLWriter(buf)
+		}
+		w = netlink.NewDeltaWriter(w, 10)
+		for _, m := range msgs {
+			rtx.Must(w.Write(m), "Could not write %s", format)
+		}
+		t.Logf("%s deltas: %d bytes, full JSONL: %d bytes", format, buf.Len(), full.Len())
+		if buf.Len() >= full.Len()/2 {
+			t.Errorf("%s deltas should be much smaller than JSONL: %d >= %d", format, buf.Len(), full.Len())
+		}
+
+		if format == "jsonl" {
+			lines := strings.Split(buf.String(), "\n")
+			// The header, and the first record are not deltas.
+			if strings.Contains(lines[0], "Delta") || strings.Contains(lines[1], "Delta") || !strings.Contains(lines[2], "Delta") {
+				t.Error("Wrong records are deltas")
+			}
+			// Nor are the records with the extra attribute and after it, or every 10th
+			// record after that.
+			for i, isDelta := range map[int]bool{19: true, 20: false, 21: false, 22: true, 30: true, 31: false} {
+				if strings.Contains(lines[i], "Delta") != isDelta {
+					t.Error("Record", i, "should have delta", isDelta)
+				}
+			}
+		}
+
+		read, err := netlink.LoadAllArchivalRecords(buf)
+		rtx.Must(err, "Could not read %s", format)
+		if diff := deep.Equal(read, msgs); diff != nil {
+			t.Error(format, diff)
+		}
+	}
+}
+
+func TestDeltaErrors(t *testing.T) {
+	prev := &netlink.ArchivalRecord{RawIDM: inetdiag.RawInetDiagMsg{1, 2, 3}, Attributes: [][]byte{nil, {4, 5}}}
+	next := &netlink.ArchivalRecord{RawIDM: inetdiag.RawInetDiagMsg{1, 2, 4}, Attributes: [][]byte{nil, {6, 5}}}
+	delta := netlink.MakeDelta(prev, next)
+	if delta == nil || delta.RawIDM != nil || delta.Attributes != nil || len(delta.Delta.Patches) != 2 {
+		t.Fatalf("Bad delta %+v", delta)
+	}
+	if netlink.MakeDelta(prev, &netlink.ArchivalRecord{RawIDM: prev.RawIDM, Attributes: [][]byte{{1}, {4, 5}}}) != nil {
+		t.Error("Records of different shapes should not have deltas")
+	}
+	if _, err := netlink.ApplyDelta(nil, delta); err != netlink.ErrDeltaWithoutKeyframe {
+		t.Error("Expected ErrDeltaWithoutKeyframe, got", err)
+	}
+	for _, p := range []netlink.Patch{
+		{Attribute: 2, Offset: 0, Data: []byte{1}},
+		{Attribute: 0, Offset: 0, Data: []byte{1}},
+		{Attribute: 1, Offset: 1, Data: []byte{1, 2}},
+		{Attribute: netlink.DeltaRawIDM, Offset: -1, Data: []byte{1}},
+	} {
+		bad := &netlink.ArchivalRecord{Delta: &netlink.Delta{Patches: []netlink.Patch{p}}}
+		if _, err := netlink.ApplyDelta(prev, bad); err != netlink.ErrBadDelta {
+			t.Errorf("Expected ErrBadDelta for %+v, got %v", p, err)
+		}
+	}
+	if err := (&netlink.Delta{}).UnmarshalJSON([]byte(`"AQ=="`)); err != netlink.ErrBinaryTruncated {
+		t.Error("Expected ErrBinaryTruncated, got", err)
+	}
+	// A file starting with a delta can not be read.
+	b, err := json.Marshal(delta)
+	rtx.Must(err, "Could not marshal")
+	if _, err = netlink.NewArchiveReader(bytes.NewReader(b)).Next(); err != netlink.ErrDeltaWithoutKeyframe {
+		t.Error("Expected ErrDeltaWithoutKeyframe, got", err)
+	}
+}
@@ -0,0 +1,80 @@
+package netlink
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// Summary describes a whole connection, so that analysis does not have to replay
+// all of its records.  The Saver includes it in the last record of each
+// connection, and optionally in daily summary files.
+type Summary struct {
+	UUID      string
+	Namespace string            `json:",omitempty"`
+	Protocol  inetdiag.Protocol `json:",omitempty"`
+
+	StartTime time.Time
+	EndTime   time.Time     // Time of the last observation.
+	Duration  time.Duration // EndTime - StartTime, in nanoseconds.
+
+	// The final counts, from the last TCPInfo.  Zero for other protocols.
+	BytesAcked    uint64 `json:",omitempty"`
+	BytesReceived uint64 `json:",omitempty"`
+	BytesSent     uint64 `json:",omitempty"`
+	SegsOut       uint32 `json:",omitempty"`
+	SegsIn        uint32 `json:",omitempty"`
+	TotalRetrans  uint32 `json:",omitempty"`
+
+	// The smallest and largest RTT observed, in microseconds.  MinRTT also
+	// reflects the kernel's own minimum, which includes samples between
+	// observations.
+	MinRTT uint32 `json:",omitempty"`
+	MaxRTT uint32 `json:",omitempty"`
+
+	LastState   string // The socket state in the last observation, e.g. ESTABLISHED.
+	CloseReason string // Why the summary was written, e.g. closed, or shutdown.
+}
+
+// TCPInfo returns a copy of the TCPInfo of a TCP record.  Fields that are missing
+// from the record, because it came from an older kernel, are zero.  It returns
+// false if the record has no TCPInfo.
+func (pm *ArchivalRecord) TCPInfo() (tcp.LinuxTCPInfo, bool) {
+	var info tcp.LinuxTCPInfo
+	if !pm.IsTCP() || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO || pm.Attributes[inetdiag.INET_DIAG_INFO] == nil {
+		return info, false
+	}
+	copy((*[unsafe.Sizeof(info)]byte)(unsafe.Pointer(&info))[:], pm.Attributes[inetdiag.INET_DIAG_INFO])
+	return info, true
+}
+
+// Update folds an observation of the connection into the summary.
+func (s *Summary) Update(pm *ArchivalRecord) {
+	s.EndTime = pm.Timestamp
+	s.Duration = s.EndTime.Sub(s.StartTime)
+	if idm, err := pm.RawIDM.Parse(); err == nil {
+		s.LastState = tcp.State(idm.IDiagState).String()
+	}
+	info, ok := pm.TCPInfo()
+	if !ok {
+		return
+	}
+	counters := info.Counters()
+	s.BytesAcked = counters.BytesAcked
+	s.BytesReceived = counters.BytesReceived
+	s.BytesSent = counters.BytesSent
+	s.SegsOut = counters.SegsOut
+	s.SegsIn = counters.SegsIn
+	s.TotalRetrans = info.TotalRetrans
+	for _, rtt := range []uint32{info.RTT, info.MinRTT} {
+		// The kernel reports ~0 before the first sample.
+		if rtt != 0 && rtt != ^uint32(0) && (s.MinRTT == 0 || rtt < s.MinRTT) {
+			s.MinRTT = rtt
+		}
+	}
+	if info.RTT > s.MaxRTT {
+		s.MaxRTT = info.RTT
+	}
+}
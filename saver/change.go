@@ -0,0 +1,154 @@
+package saver
+
+import (
+	"encoding/binary"
+	"flag"
+	"time"
+	"unsafe"
+
+	"github.com/m-lab/go/flagx"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// ChangeDetector decides which records of a connection are worth saving.  The
+// first record of every connection is always saved.
+type ChangeDetector interface {
+	// Changed returns whether pm should be saved.  previous is the previous
+	// observation of the connection, and saved is the last record saved for
+	// it.  Neither is nil.
+	Changed(previous, saved, pm *netlink.ArchivalRecord) (bool, error)
+}
+
+// SavedRecordDetector is implemented by ChangeDetectors that may need more of the
+// saved record than its Timestamp.  For the others, the Saver only keeps the
+// Timestamp of the last record saved, rather than a copy of the whole record.
+type SavedRecordDetector interface {
+	ChangeDetector
+	NeedsSavedRecord() bool
+}
+
+// Command-line flags selecting the ChangeDetector returned by NewChangeDetector.
+var (
+	ChangePolicy = flagx.Enum{
+		Options: []string{"default", "min-interval", "state", "bytes-acked"},
+		Value:   "default",
+	}
+	MinInterval       = flag.Duration("saver.min-interval", time.Second, "For -saver.change-policy=min-interval, the minimum time between records of a connection.")
+	BytesAckedPercent = flag.Float64("saver.bytes-acked-percent", 10, "For -saver.change-policy=bytes-acked, by how many percent BytesAcked must grow before a record is saved.")
+)
+
+func init() {
+	flag.Var(&ChangePolicy, "saver.change-policy", "Which records to save: \"default\" for any significant change, \"min-interval\" for significant changes at least -saver.min-interval apart, \"state\" for only TCP or congestion avoidance state changes, or \"bytes-acked\" for when BytesAcked grows by -saver.bytes-acked-percent.")
+}
+
+// NewChangeDetector returns the ChangeDetector selected by the command-line flags.
+func NewChangeDetector() ChangeDetector {
+	switch ChangePolicy.Value {
+	case "min-interval":
+		return &MinIntervalDetector{Interval: *MinInterval}
+	case "state":
+		return StateChangeDetector{}
+	case "bytes-acked":
+		return &BytesAckedDetector{Percent: *BytesAckedPercent}
+	}
+	return DefaultChangeDetector{}
+}
+
+// DefaultChangeDetector saves a record whenever ArchivalRecord.Compare finds a
+// significant change from the previous observation.
+type DefaultChangeDetector struct{}
+
+// Changed implements ChangeDetector.
+func (DefaultChangeDetector) Changed(previous, saved, pm *netlink.ArchivalRecord) (bool, error) {
+	change, err := pm.Compare(previous)
+	return change > netlink.NoMajorChange, err
+}
+
+// MinIntervalDetector saves significant changes, like DefaultChangeDetector, but
+// no more often than once per Interval.  TCP state changes are always saved.
+type MinIntervalDetector struct {
+	Interval time.Duration
+}
+
+// Changed implements ChangeDetector.
+func (d *MinIntervalDetector) Changed(previous, saved, pm *netlink.ArchivalRecord) (bool, error) {
+	change, err := pm.Compare(previous)
+	if err != nil || change == netlink.NoMajorChange {
+		return false, err
+	}
+	if change == netlink.IDiagStateChange {
+		return true, nil
+	}
+	return pm.Timestamp.Sub(saved.Timestamp) >= d.Interval, nil
+}
+
+// Useful offsets into INET_DIAG_INFO, for TCP sockets.
+const (
+	caStateOffset    = unsafe.Offsetof(tcp.LinuxTCPInfo{}.CAState)
+	bytesAckedOffset = unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesAcked)
+)
+
+// tcpInfo returns the INET_DIAG_INFO attribute of a TCP record, or nil.
+func tcpInfo(pm *netlink.ArchivalRecord) []byte {
+	if !pm.IsTCP() || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
+		return nil
+	}
+	return pm.Attributes[inetdiag.INET_DIAG_INFO]
+}
+
+// StateChangeDetector saves a record only when the TCP state, or the congestion
+// avoidance state, changes.  For other protocols, only the socket state is used.
+type StateChangeDetector struct{}
+
+// Changed implements ChangeDetector.
+func (StateChangeDetector) Changed(previous, saved, pm *netlink.ArchivalRecord) (bool, error) {
+	prevIDM, err := previous.RawIDM.Parse()
+	if err != nil {
+		return false, err
+	}
+	pmIDM, err := pm.RawIDM.Parse()
+	if err != nil {
+		return false, err
+	}
+	if prevIDM.IDiagState != pmIDM.IDiagState {
+		return true, nil
+	}
+	a, b := tcpInfo(previous), tcpInfo(pm)
+	if len(a) <= int(caStateOffset) || len(b) <= int(caStateOffset) {
+		// Losing or gaining the TCPInfo is a change.
+		return len(a) != len(b), nil
+	}
+	return a[caStateOffset] != b[caStateOffset], nil
+}
+
+// BytesAckedDetector saves a record when BytesAcked has grown by Percent since the
+// last saved record, or on a TCP state change.  For other protocols, there is no
+// BytesAcked, so only state changes are saved.
+type BytesAckedDetector struct {
+	Percent float64
+}
+
+// NeedsSavedRecord implements SavedRecordDetector, as BytesAcked is compared with
+// that of the saved record.
+func (d *BytesAckedDetector) NeedsSavedRecord() bool {
+	return true
+}
+
+// Changed implements ChangeDetector.
+func (d *BytesAckedDetector) Changed(previous, saved, pm *netlink.ArchivalRecord) (bool, error) {
+	changed, err := StateChangeDetector{}.Changed(previous, saved, pm)
+	if err != nil || changed {
+		return changed, err
+	}
+	a, b := tcpInfo(saved), tcpInfo(pm)
+	if len(a) < int(bytesAckedOffset+8) || len(b) < int(bytesAckedOffset+8) {
+		return false, nil
+	}
+	// The linux field is actually uint64.
+	was := binary.LittleEndian.Uint64(a[bytesAckedOffset:])
+	now := binary.LittleEndian.Uint64(b[bytesAckedOffset:])
+	return now > was && float64(now-was) >= float64(was)*d.Percent/100, nil
+}
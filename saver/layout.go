@@ -0,0 +1,75 @@
+package saver
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultPathTemplate is the traditional layout of the output tree, e.g.
+// 2006/01/02/<uuid>.00000.jsonl.zst, or udp/2006/01/02/... for UDP sockets.
+const DefaultPathTemplate = "{proto}{date}/{uuid}.{seq}"
+
+// PathTemplateFlag is a command-line flag setting the default Saver.PathTemplate.
+var PathTemplateFlag = flag.String("saver.path-template", DefaultPathTemplate, "Where connection files go in the output tree.  {date} is the date as 2006/01/02, {host} and {pod} the machine and site identity, {uuid} the connection UUID, {seq} the 5 digit file sequence number, and {proto} is empty for TCP, or the protocol directory, e.g. udp/, for other protocols.  {uuid} and {seq} are required, and the template must be relative, without .. elements.  Characters of the host and pod that are unsafe in file names are replaced with _.  The file extension is appended.")
+
+// Errors returned by PathTemplate.Validate.
+var (
+	// ErrBadPathTemplate is returned for path templates that would not give every
+	// file a unique name.
+	ErrBadPathTemplate = errors.New("path template must contain {uuid} and {seq}")
+	// ErrPathTemplateEscapes is returned for path templates that are absolute, or
+	// have .. elements, so that files could be written outside the output
+	// directory, where neither recovery nor retention would find them.
+	ErrPathTemplateEscapes = errors.New("path template must be relative, without .. elements")
+)
+
+// PathTemplate describes the path of each connection file, relative to the output
+// directory, with placeholders as described by the -saver.path-template flag.
+type PathTemplate string
+
+// Validate returns an error if the template does not give each file a unique name,
+// within the output directory.
+func (tmpl PathTemplate) Validate() error {
+	if !strings.Contains(string(tmpl), "{uuid}") || !strings.Contains(string(tmpl), "{seq}") {
+		return ErrBadPathTemplate
+	}
+	if strings.HasPrefix(string(tmpl), "/") {
+		return ErrPathTemplateEscapes
+	}
+	for _, elem := range strings.Split(string(tmpl), "/") {
+		if elem == ".." {
+			return ErrPathTemplateEscapes
+		}
+	}
+	return nil
+}
+
+// pathElement returns s with every character that is not a letter, digit, '-',
+// '_' or '.' replaced by '_', and leading dots too, so that it can not add
+// elements to a path, or go up.
+func pathElement(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		ok := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.'
+		if !ok || c == '.' && strings.Trim(s[:i+1], ".") == "" {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Expand returns the path of the next file of conn, without the extension.  Any
+// characters of host and pod that are not safe in a file name are replaced.
+func (tmpl PathTemplate) Expand(conn *Connection, host, pod string, date time.Time) string {
+	return strings.NewReplacer(
+		"{date}", date.UTC().Format("2006/01/02"),
+		"{host}", pathElement(host),
+		"{pod}", pathElement(pod),
+		"{uuid}", conn.Key().UUID(),
+		"{seq}", fmt.Sprintf("%05d", conn.Sequence),
+		"{proto}", protocolDir(conn.Protocol),
+	).Replace(string(tmpl))
+}
@@ -0,0 +1,88 @@
+package saver
+
+import (
+	"flag"
+	"math/rand"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// OverloadPolicy is what the Saver does when it falls behind.
+type OverloadPolicy string
+
+// The overload policies.
+const (
+	// OverloadBlock makes the collector wait for the Saver, and the Saver wait for
+	// the marshallers, so that polling cycles stretch, but nothing is lost.
+	OverloadBlock = OverloadPolicy("block")
+	// OverloadDrop drops the oldest cycle waiting for the Saver whenever the
+	// collector is waiting too.  Connections that end meanwhile are only noticed
+	// in the next cycle.
+	OverloadDrop = OverloadPolicy("drop")
+	// OverloadSample saves only a sample of the connections that start while the
+	// queue of their marshaller is full.  Connections already being saved are
+	// still saved completely.
+	OverloadSample = OverloadPolicy("sample")
+)
+
+// Command-line flags setting the default Saver.Overload and Saver.OverloadSampleRate.
+var (
+	Overload = flagx.Enum{
+		Options: []string{string(OverloadBlock), string(OverloadDrop), string(OverloadSample)},
+		Value:   string(OverloadBlock),
+	}
+	OverloadSampleRate = flag.Float64("saver.overload-sample-rate", 0.1, "For -saver.overload=sample, the fraction of new connections saved while their marshaller is behind.")
+)
+
+func init() {
+	flag.Var(&Overload, "saver.overload", "What to do when the saver falls behind: \"block\" the collector, so that polling cycles stretch, \"drop\" the oldest waiting cycles, or \"sample\" new connections while the marshallers are behind.")
+}
+
+// The metrics of the marshaller stage, looked up once, as they are updated for
+// every record.
+var (
+	marshallerDepth   = metrics.QueueDepth.WithLabelValues("marshaller")
+	marshallerBlocked = metrics.QueueBlockedSeconds.WithLabelValues("marshaller")
+	marshallerDrops   = metrics.DropCount.WithLabelValues("marshaller")
+)
+
+// send queues a task, accounting for the time spent waiting when the marshaller
+// falls behind.
+func (q MarshalChan) send(task Task) {
+	marshallerDepth.Set(float64(len(q)))
+	select {
+	case q <- task:
+		return
+	default:
+	}
+	start := time.Now()
+	q <- task
+	marshallerBlocked.Add(time.Since(start).Seconds())
+}
+
+// admit returns whether to save a new connection, whose records go to q.
+func (svr *Saver) admit(q MarshalChan) bool {
+	if svr.Overload != OverloadSample || len(q) < cap(q) || rand.Float64() < svr.OverloadSampleRate {
+		return true
+	}
+	marshallerDrops.Inc()
+	return false
+}
+
+// dropBlock returns whether to drop msgs, the oldest block received from
+// readerChannel, because the collector is waiting to queue more.  Empty blocks
+// are kept, as they may report that a namespace is gone.
+func (svr *Saver) dropBlock(readerChannel <-chan netlink.MessageBlock, msgs *netlink.MessageBlock) bool {
+	if svr.Overload != OverloadDrop || cap(readerChannel) == 0 || len(readerChannel) < cap(readerChannel) {
+		return false
+	}
+	if len(msgs.V4Messages) == 0 && len(msgs.V6Messages) == 0 {
+		return false
+	}
+	metrics.DropCount.WithLabelValues("saver").Inc()
+	return true
+}
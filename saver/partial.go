@@ -0,0 +1,242 @@
+package saver
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// Connection files are written with PartialSuffix appended to their names, and
+// renamed to their final names once they are completely written.  So any file
+// without the suffix is complete, and any file with it is either still being
+// written, or was abandoned by a crash.  RecoverPartialFiles cleans up the latter.
+const (
+	PartialSuffix = ".partial"
+	// CorruptSuffix replaces PartialSuffix on files that could not be recovered.
+	CorruptSuffix = ".corrupt"
+)
+
+// RecoveryAge is a command-line flag limiting how far back RecoverPartialFiles
+// looks at startup.  Partial files are only left behind by a crash, so only the
+// most recent date directories should have any.
+var RecoveryAge = flag.Duration("saver.recovery-age", 48*time.Hour, "At startup, partial files left behind by a crash are recovered in the date directories younger than this.  0 recovers them in the whole output tree.")
+
+// finalizingWriter renames the file from its partial name to its final name once
+// it is closed successfully, if all writes succeeded.  If it has a
+// RetentionManager, it reports the bytes written to it.
+type finalizingWriter struct {
+	written int64 // Accessed atomically, as Size is called by the Saver, and first, so that it is aligned.
+	io.WriteCloser
+	final string
+	err   error // The first write error.
+
+	rm       *RetentionManager
+	dir      *dateDir // The date directory of the file, as returned by rm.opened.
+	reported int64    // The bytes reported to rm so far.
+}
+
+// newFinalizingWriter returns a compressing writer to the partial name of filename,
+// which is renamed to filename when the writer is closed.
+func newFinalizingWriter(filename string) (*finalizingWriter, error) {
+	w, err := zstd.NewWriter(filename + PartialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &finalizingWriter{WriteCloser: w, final: filename}, nil
+}
+
+// Write writes to the partial file.
+func (fw *finalizingWriter) Write(p []byte) (int, error) {
+	n, err := fw.WriteCloser.Write(p)
+	atomic.AddInt64(&fw.written, int64(n))
+	if err != nil && fw.err == nil {
+		fw.err = err
+	}
+	fw.report()
+	return n, err
+}
+
+// report adds the bytes written since the last report to the RetentionManager.
+func (fw *finalizingWriter) report() {
+	if fw.rm == nil {
+		return
+	}
+	size := fw.Size()
+	fw.rm.wrote(fw.dir, size-fw.reported)
+	fw.reported = size
+}
+
+// Size returns the compressed size of the file so far, as counted by the
+// compressor.  As the compressor buffers data, the last few records are usually
+// not included.  The external zstd command can not tell, so then the
+// uncompressed size is returned instead.
+func (fw *finalizingWriter) Size() int64 {
+	if s, ok := fw.WriteCloser.(Sizer); ok {
+		return s.Size()
+	}
+	return atomic.LoadInt64(&fw.written)
+}
+
+// Close closes the file, and if that and all writes succeeded, renames it to its
+// final name.
+func (fw *finalizingWriter) Close() error {
+	err := fw.WriteCloser.Close()
+	if fw.rm != nil {
+		fw.report()
+		fw.rm.closed(fw.dir)
+	}
+	if fw.err != nil {
+		err = fw.err
+	}
+	if err != nil {
+		// Leave the partial file for RecoverPartialFiles.
+		return err
+	}
+	return os.Rename(fw.final+PartialSuffix, fw.final)
+}
+
+// newArchiveWriter returns an ArchiveWriter for the format of filename.
+func newArchiveWriter(w io.WriteCloser, filename string) (netlink.ArchiveWriter, error) {
+	if strings.HasSuffix(filename, ".bin.zst") {
+		return netlink.NewBinaryWriter(w)
+	}
+	return netlink.NewJSONLWriter(w), nil
+}
+
+// RecoveryStats counts the results of RecoverPartialFiles.
+type RecoveryStats struct {
+	Complete  int // Files that were complete, and just renamed.
+	Truncated int // Files that were rewritten with their readable records.
+	Corrupt   int // Files with no readable records, renamed with CorruptSuffix.
+	Failed    int // Files, or directories, that could not be recovered, and were left as they were.
+}
+
+// RecoverPartialFiles finalizes the partial files in the tree under dir, which
+// are left behind if a previous run crashed.  It must not run while a Saver is
+// writing to the tree.  Files that can be read completely are just renamed.
+// Files that were cut off are rewritten with all the records that can be read,
+// followed by a record with CloseReason set to netlink.CloseReasonRecovered.
+// Files without any readable record are quarantined with CorruptSuffix, so that
+// they are not mistaken for connection files.
+//
+// Date directories for dates before since are skipped, unless since is zero.
+// Files and directories that can not be recovered are logged, counted, and
+// skipped, so only an error reading dir itself is returned.
+func RecoverPartialFiles(dir string, since time.Time) (RecoveryStats, error) {
+	stats := RecoveryStats{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Println("Could not recover partial files in", path, err)
+			stats.Failed++
+			metrics.RecoveryErrorCount.Inc()
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir && before(dir, path, since) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, PartialSuffix) {
+			return nil
+		}
+		if err := recoverPartialFile(path, info, &stats); err != nil {
+			log.Println("Could not recover partial file", path, err)
+			stats.Failed++
+			metrics.RecoveryErrorCount.Inc()
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// before returns whether path, under dir, is a date directory for a date before
+// since.
+func before(dir, path string, since time.Time) bool {
+	if since.IsZero() {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	m := dateDirPattern.FindStringSubmatch(filepath.ToSlash(rel))
+	if m == nil || m[3] != "" {
+		return false
+	}
+	date, err := time.Parse("2006/01/02", m[2])
+	return err == nil && date.Add(24*time.Hour).Before(since)
+}
+
+// recoverPartialFile finalizes one partial file, and counts the result in stats.
+func recoverPartialFile(path string, info os.FileInfo, stats *RecoveryStats) error {
+	final := strings.TrimSuffix(path, PartialSuffix)
+	records, readErr := readPartialFile(path)
+	switch {
+	case readErr == nil:
+		if err := os.Rename(path, final); err != nil {
+			return err
+		}
+		stats.Complete++
+		return nil
+	case len(records) == 0:
+		log.Println("Quarantining unreadable file", path, readErr)
+		if err := os.Rename(path, final+CorruptSuffix); err != nil {
+			return err
+		}
+		stats.Corrupt++
+		return nil
+	}
+	log.Println("Recovering", len(records), "records from", path, readErr)
+	records = append(records, &netlink.ArchivalRecord{Timestamp: info.ModTime().UTC(), CloseReason: netlink.CloseReasonRecovered})
+	if err := rewriteFile(final, records); err != nil {
+		return err
+	}
+	stats.Truncated++
+	return nil
+}
+
+// readPartialFile returns all the records that can be read from path, and the
+// error that stopped reading, if any.
+func readPartialFile(path string) ([]*netlink.ArchivalRecord, error) {
+	rdr, err := zstd.NewReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return netlink.LoadAllArchivalRecords(rdr)
+}
+
+// rewriteFile writes records to a new file at filename, through its partial name,
+// replacing any partial file that is already there.
+func rewriteFile(filename string, records []*netlink.ArchivalRecord) error {
+	w, err := newFinalizingWriter(filename)
+	if err != nil {
+		return err
+	}
+	aw, err := newArchiveWriter(w, filename)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	for _, r := range records {
+		err = aw.Write(r)
+		if err != nil {
+			aw.Close()
+			return err
+		}
+	}
+	return aw.Close()
+}
@@ -0,0 +1,359 @@
+package saver
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// Command-line flags configuring the RetentionManager returned by
+// NewRetentionManager.
+var (
+	Quota             = flag.Int64("saver.quota", 0, "The most bytes to keep in the output tree.  Beyond it, the oldest date directories are deleted.  0 means no quota.")
+	MaxAge            = flag.Duration("saver.max-age", 0, "Date directories are deleted once their date is older than this.  0 keeps them forever.")
+	MinFree           = flag.Int64("saver.min-free", 0, "When the disk has fewer bytes free, or the quota can not be met, only -saver.full-sample-rate of new connections are saved.")
+	FullSampleRate    = flag.Float64("saver.full-sample-rate", 0.1, "The fraction of new connections saved while the output is full.")
+	RetentionInterval = flag.Duration("saver.retention-interval", time.Minute, "How often to enforce -saver.quota, -saver.max-age and -saver.min-free.")
+)
+
+// RetentionEnabled returns whether any of the retention flags are set.
+func RetentionEnabled() bool {
+	return *Quota > 0 || *MaxAge > 0 || *MinFree > 0
+}
+
+// dateDirPattern matches the date directories in the output tree, e.g. 2006/01/02,
+// or udp/2006/01/02.
+var dateDirPattern = regexp.MustCompile(`^(.*?)(\d{4}/\d{2}/\d{2})(/|$)`)
+
+// ErrDeleting is returned by FileSink.Open for files in a date directory that the
+// RetentionManager is deleting.
+var ErrDeleting = errors.New("date directory is being deleted")
+
+// RetentionManager keeps the output tree of a FileSink within a quota of bytes and
+// of age, by deleting the oldest date directories.  The directory of the current
+// date is never deleted, so if that is not enough, or the disk is nearly full
+// anyway, the manager reports that the output is full, and the Saver only saves a
+// sample of new connections until it is not.
+//
+// The tree is walked once, by Scan, and then the FileSink writers report the
+// files they open, and the bytes they write.  Date directories with files still
+// open, e.g. by long-lived connections, are not deleted until they are closed.
+type RetentionManager struct {
+	Dir        string        // The root of the output tree.
+	Quota      int64         // The most bytes to keep, or 0 for no limit.
+	MaxAge     time.Duration // How long to keep date directories, or 0 for no limit.
+	MinFree    int64         // The fewest bytes to leave free on the disk, or 0.
+	SampleRate float64       // The fraction of new connections Admit accepts while full.
+
+	full int32 // Accessed atomically, as Enforce runs in its own goroutine.
+
+	mutex   sync.Mutex
+	scanned bool
+	dirs    map[string]*dateDir // By path relative to Dir.
+	other   int64               // Bytes outside date directories.  Accessed atomically.
+}
+
+// NewRetentionManager returns a RetentionManager for the tree under dir, configured
+// by the command-line flags.
+func NewRetentionManager(dir string) *RetentionManager {
+	return &RetentionManager{
+		Dir:        dir,
+		Quota:      *Quota,
+		MaxAge:     *MaxAge,
+		MinFree:    *MinFree,
+		SampleRate: *FullSampleRate,
+	}
+}
+
+// dateDir is a date directory of the output tree.
+type dateDir struct {
+	size     int64  // Accessed atomically, as writers add to it, and first, so that it is aligned.
+	name     string // The path relative to Dir, which is its key in RetentionManager.dirs.
+	path     string
+	date     time.Time
+	open     int  // The files being written.
+	deleting bool // Set while Enforce deletes the directory.
+}
+
+// Full returns whether the output was full at the last call to Enforce.
+func (rm *RetentionManager) Full() bool {
+	return atomic.LoadInt32(&rm.full) != 0
+}
+
+// Admit returns whether files should be written for a new connection.  While the
+// output is full, only a random SampleRate of connections are admitted.
+func (rm *RetentionManager) Admit() bool {
+	if !rm.Full() || rand.Float64() < rm.SampleRate {
+		return true
+	}
+	metrics.SampledOutCount.Inc()
+	return false
+}
+
+// Enforce deletes the date directories that are older than MaxAge, then the oldest
+// ones, except that of the current date, until the tree is within the Quota.  Date
+// directories with files still being written are skipped.  It then updates
+// whether the output is full, and the metrics.  The tree is scanned first, if Scan
+// was not called yet.
+func (rm *RetentionManager) Enforce(now time.Time) error {
+	rm.mutex.Lock()
+	scanned := rm.scanned
+	rm.mutex.Unlock()
+	if !scanned {
+		if err := rm.Scan(); err != nil {
+			return err
+		}
+	}
+	for _, r := range rm.pick(now) {
+		rm.remove(r.dir, r.reason)
+	}
+	usage := rm.usage()
+	metrics.OutputBytes.Set(float64(usage))
+
+	full := rm.Quota > 0 && usage > rm.Quota
+	var fs unix.Statfs_t
+	if err := unix.Statfs(rm.Dir, &fs); err == nil {
+		free := int64(fs.Bavail) * int64(fs.Bsize)
+		metrics.OutputFreeBytes.Set(float64(free))
+		full = full || (rm.MinFree > 0 && free < rm.MinFree)
+	}
+	if full != rm.Full() {
+		log.Println("Output full:", full, "bytes:", usage)
+	}
+	if full {
+		atomic.StoreInt32(&rm.full, 1)
+		metrics.OutputFull.Set(1)
+	} else {
+		atomic.StoreInt32(&rm.full, 0)
+		metrics.OutputFull.Set(0)
+	}
+	return nil
+}
+
+// removal is a date directory to delete, and why.
+type removal struct {
+	dir    *dateDir
+	reason string
+}
+
+// pick returns the date directories to delete, oldest first, and marks them as
+// being deleted, so that no files are opened in them meanwhile.
+func (rm *RetentionManager) pick(now time.Time) []removal {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	dirs := make([]*dateDir, 0, len(rm.dirs))
+	usage := atomic.LoadInt64(&rm.other)
+	for _, d := range rm.dirs {
+		dirs = append(dirs, d)
+		usage += atomic.LoadInt64(&d.size)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if !dirs[i].date.Equal(dirs[j].date) {
+			return dirs[i].date.Before(dirs[j].date)
+		}
+		return dirs[i].path < dirs[j].path
+	})
+	today := now.UTC().Truncate(24 * time.Hour)
+	removals := []removal{}
+	remaining := dirs[:0]
+	for _, d := range dirs {
+		if rm.MaxAge > 0 && !d.date.Add(24*time.Hour).After(now.Add(-rm.MaxAge)) && d.open == 0 {
+			removals = append(removals, removal{d, "age"})
+			usage -= atomic.LoadInt64(&d.size)
+			continue
+		}
+		remaining = append(remaining, d)
+	}
+	for _, d := range remaining {
+		if rm.Quota <= 0 || usage <= rm.Quota || !d.date.Before(today) {
+			break
+		}
+		if d.open > 0 {
+			continue
+		}
+		removals = append(removals, removal{d, "quota"})
+		usage -= atomic.LoadInt64(&d.size)
+	}
+	for _, r := range removals {
+		r.dir.deleting = true
+	}
+	return removals
+}
+
+// usage returns the bytes in the tree.
+func (rm *RetentionManager) usage() int64 {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	usage := atomic.LoadInt64(&rm.other)
+	for _, d := range rm.dirs {
+		usage += atomic.LoadInt64(&d.size)
+	}
+	return usage
+}
+
+// Scan walks the tree, to find the date directories, and the bytes in them.  It
+// should be called before the FileSink opens any file.
+func (rm *RetentionManager) Scan() error {
+	dirs := map[string]*dateDir{}
+	other := int64(0)
+	err := filepath.Walk(rm.Dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Partial files are renamed when they are closed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(rm.Dir, path)
+		if err != nil {
+			return err
+		}
+		d := rm.dateDir(dirs, rel)
+		if d == nil {
+			other += info.Size()
+			return nil
+		}
+		d.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.dirs = dirs
+	atomic.StoreInt64(&rm.other, other)
+	rm.scanned = true
+	return nil
+}
+
+// dateDir returns the entry in dirs of the date directory of the file rel,
+// relative to Dir, adding it if needed, or nil if the file is not in a date
+// directory.
+func (rm *RetentionManager) dateDir(dirs map[string]*dateDir, rel string) *dateDir {
+	m := dateDirPattern.FindStringSubmatch(filepath.ToSlash(rel))
+	if m == nil || m[3] == "" {
+		return nil
+	}
+	date, err := time.Parse("2006/01/02", m[2])
+	if err != nil {
+		return nil
+	}
+	d, ok := dirs[m[1]+m[2]]
+	if !ok {
+		d = &dateDir{name: m[1] + m[2], path: filepath.Join(rm.Dir, filepath.FromSlash(m[1]+m[2])), date: date}
+		dirs[m[1]+m[2]] = d
+	}
+	return d
+}
+
+// opened records that the FileSink is opening the named file, and returns its date
+// directory, or nil if it is not in one.  It fails if the directory is being
+// deleted.
+func (rm *RetentionManager) opened(name string) (*dateDir, error) {
+	rel, err := filepath.Rel(rm.Dir, name)
+	if err != nil {
+		return nil, nil
+	}
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if rm.dirs == nil {
+		rm.dirs = map[string]*dateDir{}
+	}
+	d := rm.dateDir(rm.dirs, rel)
+	if d == nil {
+		return nil, nil
+	}
+	if d.deleting {
+		return nil, ErrDeleting
+	}
+	d.open++
+	return d, nil
+}
+
+// wrote adds the bytes written to a file in d, or outside date directories if d
+// is nil.
+func (rm *RetentionManager) wrote(d *dateDir, n int64) {
+	if d == nil {
+		atomic.AddInt64(&rm.other, n)
+		return
+	}
+	atomic.AddInt64(&d.size, n)
+}
+
+// closed records that a file in d, as returned by opened, was closed.
+func (rm *RetentionManager) closed(d *dateDir) {
+	if d == nil {
+		return
+	}
+	rm.mutex.Lock()
+	d.open--
+	rm.mutex.Unlock()
+}
+
+// remove deletes a date directory marked by pick, and counts the bytes actually
+// freed.
+func (rm *RetentionManager) remove(d *dateDir, reason string) {
+	size := atomic.LoadInt64(&d.size)
+	log.Println("Deleting", d.path, "for", reason, size, "bytes")
+	freed := size
+	if err := os.RemoveAll(d.path); err != nil {
+		log.Println(err)
+		freed = size - du(d.path)
+		if freed < 0 {
+			freed = 0
+		}
+	}
+	metrics.RetentionDeletedBytes.WithLabelValues(reason).Add(float64(freed))
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	atomic.AddInt64(&d.size, -freed)
+	d.deleting = false
+	if freed == size {
+		delete(rm.dirs, d.name)
+	}
+}
+
+// du returns the bytes in the files under path.
+func du(path string) int64 {
+	size := int64(0)
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Run calls Enforce every interval until ctx is canceled.
+func (rm *RetentionManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := rm.Enforce(time.Now()); err != nil {
+			log.Println("Retention:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package saver
+
+import (
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// RotationPolicy decides when the Saver closes the file of a long running
+// connection and starts the next one.
+type RotationPolicy interface {
+	// ShouldRotate returns whether the current file of conn should be closed
+	// before pm is written.
+	ShouldRotate(conn *Connection, pm *netlink.ArchivalRecord) bool
+}
+
+// Command-line flags selecting the RotationPolicy returned by NewRotationPolicy.
+var (
+	Rotation = flagx.Enum{
+		Options: []string{"age", "records", "size", "wallclock"},
+		Value:   "age",
+	}
+	RotationAge      = flag.Duration("saver.rotation-age", 10*time.Minute, "For -saver.rotation=age, the longest time a connection file covers.")
+	RotationRecords  = flag.Int("saver.rotation-records", 1000, "For -saver.rotation=records, the most records in a connection file.")
+	RotationSize     = flag.Int64("saver.rotation-size", 1<<20, "For -saver.rotation=size, the compressed size in bytes after which a connection file is closed.  The size is only approximate, as the compressor buffers data.")
+	RotationBoundary = flag.Duration("saver.rotation-boundary", time.Hour, "For -saver.rotation=wallclock, connection files end at multiples of this duration since midnight UTC, e.g. 1h for the top of every hour, or 24h for midnight.")
+)
+
+func init() {
+	flag.Var(&Rotation, "saver.rotation", "When to start a new file for a long running connection: \"age\" after -saver.rotation-age, \"records\" after -saver.rotation-records records, \"size\" after -saver.rotation-size bytes, or \"wallclock\" at multiples of -saver.rotation-boundary.")
+}
+
+// ErrBadRotation is returned by ValidateRotationFlags for limits that are not
+// positive, which would start a new file for every record.
+var ErrBadRotation = errors.New("rotation limits must be positive")
+
+// ValidateRotationFlags returns an error if any of the rotation limits set by the
+// command-line flags are not positive.
+func ValidateRotationFlags() error {
+	if *RotationAge <= 0 || *RotationRecords <= 0 || *RotationSize <= 0 || *RotationBoundary <= 0 {
+		return ErrBadRotation
+	}
+	return nil
+}
+
+// NewRotationPolicy returns the RotationPolicy selected by the command-line flags.
+func NewRotationPolicy() RotationPolicy {
+	switch Rotation.Value {
+	case "records":
+		return &RecordCountRotation{MaxRecords: *RotationRecords}
+	case "size":
+		return &SizeRotation{MaxBytes: *RotationSize}
+	case "wallclock":
+		return &WallClockRotation{Boundary: *RotationBoundary}
+	}
+	return &AgeRotation{MaxAge: *RotationAge}
+}
+
+// AgeRotation starts a new file once the current one covers MaxAge.
+type AgeRotation struct {
+	MaxAge time.Duration
+}
+
+// ShouldRotate implements RotationPolicy.
+func (r *AgeRotation) ShouldRotate(conn *Connection, pm *netlink.ArchivalRecord) bool {
+	return pm.Timestamp.Sub(conn.FileStart) >= r.MaxAge
+}
+
+// RecordCountRotation starts a new file once the current one has MaxRecords
+// records, not counting the header.
+type RecordCountRotation struct {
+	MaxRecords int
+}
+
+// ShouldRotate implements RotationPolicy.
+func (r *RecordCountRotation) ShouldRotate(conn *Connection, pm *netlink.ArchivalRecord) bool {
+	return conn.FileRecords >= r.MaxRecords
+}
+
+// SizeRotation starts a new file once the current one has MaxBytes written.  It
+// only works with sinks whose writers implement Sizer, such as FileSink.
+type SizeRotation struct {
+	MaxBytes int64
+}
+
+// ShouldRotate implements RotationPolicy.
+func (r *SizeRotation) ShouldRotate(conn *Connection, pm *netlink.ArchivalRecord) bool {
+	s, ok := conn.Writer.(Sizer)
+	return ok && s.Size() >= r.MaxBytes
+}
+
+// WallClockRotation starts a new file whenever a record falls in a later multiple
+// of Boundary since midnight UTC than the start of the current file.  So files
+// of long running connections cover aligned periods, like whole hours.
+type WallClockRotation struct {
+	Boundary time.Duration
+}
+
+// ShouldRotate implements RotationPolicy.
+func (r *WallClockRotation) ShouldRotate(conn *Connection, pm *netlink.ArchivalRecord) bool {
+	// The zero Time is midnight UTC.
+	return pm.Timestamp.Truncate(r.Boundary).After(conn.FileStart.Truncate(r.Boundary))
+}
@@ -2,24 +2,28 @@
 //  1. Sets up a channel that accepts slices of *netlink.ArchivalRecord
 //  2. Maintains a map of Connections, one for each connection.
 //  3. Uses several marshallers goroutines to serialize data and and write to
-//     zstd files.
+//     a Sink, by default zstd files.
 //  4. Rotates Connection output files every 10 minutes for long lasting connections.
 //  5. uses a cache to detect meaningful state changes, and avoid excessive
 //     writes.
 package saver
 
 import (
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
-	"os"
+	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/prometheusx"
 
 	"github.com/m-lab/tcp-info/cache"
 	"github.com/m-lab/tcp-info/eventsocket"
@@ -27,7 +31,6 @@ import (
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/tcp"
-	"github.com/m-lab/tcp-info/zstd"
 	"github.com/m-lab/uuid"
 )
 
@@ -47,11 +50,39 @@ var (
 	ErrNoMarshallers = errors.New("Saver has zero Marshallers")
 )
 
+// Format is a command-line flag selecting the format of new connection files,
+// either "jsonl", or "binary", the more compact length prefixed encoding of
+// ArchivalRecords.  netlink.NewArchiveReader reads both.
+var Format = flagx.Enum{
+	Options: []string{"jsonl", "binary"},
+	Value:   "jsonl",
+}
+
+var (
+	// Delta is a command-line flag enabling delta mode, in which records are
+	// saved as the changes from the previous record of the connection.
+	Delta = flag.Bool("saver.delta", false, "Save records as the byte ranges that changed from the previous record of the connection, with periodic full records.  netlink.NewArchiveReader reconstructs the full records.")
+
+	// KeyframeInterval is a command-line flag setting how often a full record is
+	// saved in delta mode.
+	KeyframeInterval = flag.Int("saver.keyframe-interval", 20, "In delta mode, save a full record at least once every this many records of a connection.")
+
+	// DailySummaries is a command-line flag setting the default Saver.DailySummaries.
+	DailySummaries = flag.Bool("saver.daily-summaries", false, "In addition to the last record of each connection file, write the summaries of all connections to daily summary files, under summary/2006/01/02.")
+
+	// HeartbeatInterval is a command-line flag setting the default Saver.Heartbeat.
+	HeartbeatInterval = flag.Duration("saver.heartbeat", 0, "Save a record of every live connection at least this often, even if nothing changed.  Such records have Heartbeat set.  Zero disables heartbeats.")
+)
+
+func init() {
+	flag.Var(&Format, "saver.format", "Format of connection files, \"jsonl\" for .jsonl.zst files, or \"binary\" for the more compact .bin.zst files.")
+}
+
 // Task represents a single marshalling task, specifying the message and the writer.
 type Task struct {
 	// nil message means close the writer.
 	Message *netlink.ArchivalRecord
-	Writer  io.WriteCloser
+	Writer  netlink.ArchiveWriter
 }
 
 // CacheLogger is any object with a LogCacheStats method.
@@ -59,6 +90,12 @@ type CacheLogger interface {
 	LogCacheStats(localCount, errCount int)
 }
 
+// ChangeCounter is any object with a ChangeCount method.
+type ChangeCounter interface {
+	// ChangeCount returns the total number of new and changed records queued so far.
+	ChangeCount() int64
+}
+
 // MarshalChan is a channel of marshalling tasks.
 type MarshalChan chan<- Task
 
@@ -71,14 +108,17 @@ func runMarshaller(taskChan <-chan Task, wg *sync.WaitGroup, anon anonymize.IPAn
 		if task.Writer == nil {
 			log.Fatal("Nil writer")
 		}
-		err := task.Message.RawIDM.Anonymize(anon)
+		if task.Message.RawIDM != nil {
+			err := task.Message.RawIDM.Anonymize(anon)
+			if err != nil {
+				log.Println("Failed to anonymize message:", err)
+				continue
+			}
+		}
+		err := task.Writer.Write(task.Message)
 		if err != nil {
-			log.Println("Failed to anonymize message:", err)
-			continue
+			log.Println("Failed to write message:", err)
 		}
-		b, _ := json.Marshal(task.Message) // FIXME: don't ignore error
-		task.Writer.Write(b)
-		task.Writer.Write([]byte("\n"))
 	}
 	log.Println("Marshaller Done")
 	wg.Done()
@@ -91,68 +131,129 @@ func newMarshaller(wg *sync.WaitGroup, anon anonymize.IPAnonymizer) MarshalChan
 	return marshChan
 }
 
+// ConnKey identifies a connection.  Socket cookies are only unique within a single
+// network namespace, so the namespace is part of the key.
+type ConnKey struct {
+	Namespace string
+	Cookie    uint64
+}
+
+// UUID returns the UUID used for files and events of the connection.  Connections
+// outside the default namespace get the namespace appended, so that they never
+// collide with connections elsewhere that have the same cookie.
+func (key ConnKey) UUID() string {
+	id := uuid.FromCookie(key.Cookie)
+	if key.Namespace != "" {
+		id += "_" + key.Namespace
+	}
+	return id
+}
+
+// blockKey identifies a source of MessageBlocks, each of which needs its own cache.
+type blockKey struct {
+	Namespace string
+	Protocol  inetdiag.Protocol // Zero for TCP.
+}
+
+func isTCP(p inetdiag.Protocol) bool {
+	return p == 0 || p == inetdiag.Protocol_IPPROTO_TCP
+}
+
+// protocolDir returns the directory holding the tree of files for protocol p.  TCP
+// files are at the top level, for compatibility.
+func protocolDir(p inetdiag.Protocol) string {
+	if isTCP(p) {
+		return ""
+	}
+	name, ok := inetdiag.ProtocolName[int32(p)]
+	if !ok {
+		return fmt.Sprintf("proto%d/", p)
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "IPPROTO_")) + "/"
+}
+
 // Connection objects handle all output associated with a single connection.
 type Connection struct {
-	Inode      uint32 // TODO - also use the UID???
-	ID         inetdiag.SockID
-	UID        uint32
-	Slice      string    // 4 hex, indicating which machine segment this is on.
-	StartTime  time.Time // Time the connection was initiated.
-	Sequence   int       // Typically zero, but increments for long running connections.
-	Expiration time.Time // Time we will swap files and increment Sequence.
-	Writer     io.WriteCloser
-}
-
-func newConnection(info *inetdiag.InetDiagMsg, timestamp time.Time) *Connection {
-	conn := Connection{Inode: info.IDiagInode, ID: info.ID.GetSockID(), UID: info.IDiagUID, Slice: "", StartTime: timestamp, Sequence: 0,
-		Expiration: time.Now()}
+	Inode       uint32 // TODO - also use the UID???
+	ID          inetdiag.SockID
+	Namespace   string            // Network namespace identity, empty for the default namespace.
+	Protocol    inetdiag.Protocol // Transport protocol, zero for TCP.
+	UID         uint32
+	Slice       string    // 4 hex, indicating which machine segment this is on.
+	StartTime   time.Time // Time the connection was initiated.
+	Sequence    int       // Typically zero, but increments for long running connections.
+	FileStart   time.Time // Time of the first record in the current file.
+	FileRecords int       // Records written to the current file, not counting the header.
+	Writer      netlink.ArchiveWriter
+
+	saved      *netlink.ArchivalRecord // The last record queued, for the ChangeDetector, as kept by keepSaved.
+	lastSaved  netlink.ArchivalRecord  // Just the Timestamp of the last record queued, when that is all the ChangeDetector needs.
+	savedState uint8                   // The socket state of the last record queued.
+	sampledOut bool                    // Set if the output was full when the connection started, so it is not saved.
+	summary    netlink.Summary         // Summary of all observations so far.
+}
+
+func newConnection(info *inetdiag.InetDiagMsg, namespace string, protocol inetdiag.Protocol, timestamp time.Time) *Connection {
+	conn := Connection{Inode: info.IDiagInode, ID: info.ID.GetSockID(), Namespace: namespace, Protocol: protocol, UID: info.IDiagUID, Slice: "", StartTime: timestamp, Sequence: 0}
+	conn.summary = netlink.Summary{UUID: conn.Key().UUID(), Namespace: namespace, Protocol: protocol, StartTime: timestamp}
 	return &conn
 }
 
-// Rotate opens the next writer for a connection.
+// Key returns the ConnKey identifying the connection.
+func (conn *Connection) Key() ConnKey {
+	return ConnKey{Namespace: conn.Namespace, Cookie: conn.ID.CookieUint64()}
+}
+
+// Rotate opens the next writer for a connection, from the sink, named by the
+// template.  now is the time of the first record that will be written to it.
 // Note that long running connections will have data in multiple directories,
-// because, for all segments after the first one, we choose the directory
-// based on the time Rotate() was called, and not on the StartTime of the
-// connection. Long-running connections with data on multiple days will
-// therefore likely have data in multiple date directories.
+// because, for all segments after the first one, we choose the date based on
+// now, and not on the StartTime of the connection. Long-running connections
+// with data on multiple days will therefore likely have data in multiple date
+// directories.
 // (This behavior is new as of April 2020. Prior to then, all files were
 // placed in the directory corresponding to the StartTime.)
-func (conn *Connection) Rotate(Host string, Pod string, FileAgeLimit time.Duration) error {
-	datePath := conn.StartTime.Format("2006/01/02")
+// Sockets of protocols other than TCP are saved in separate trees, e.g. udp/2006/01/02,
+// with the default template.
+// header holds the fields of the header that describe the writer, such as Host
+// and Pod, rather than the connection.
+func (conn *Connection) Rotate(sink Sink, header netlink.Metadata, template PathTemplate, now time.Time) error {
 	// For first block, date directory is based on the connection start time.
 	// For all other blocks, (sequence > 0) it is based on the current time.
+	date := conn.StartTime
 	if conn.Sequence > 0 {
-		now := time.Now().UTC()
-		datePath = now.Format("2006/01/02")
-	}
-	err := os.MkdirAll(datePath, 0777)
-	if err != nil {
-		return err
+		date = now
 	}
-	id := uuid.FromCookie(conn.ID.CookieUint64())
-	conn.Writer, err = zstd.NewWriter(fmt.Sprintf("%s/%s.%05d.jsonl.zst", datePath, id, conn.Sequence))
+	w, err := sink.Open(template.Expand(conn, header.Host, header.Pod, date) + fileExtension())
 	if err != nil {
 		return err
 	}
-	conn.writeHeader()
+	conn.Writer = w
+	conn.writeHeader(header)
 	metrics.NewFileCount.Inc()
-	conn.Expiration = conn.Expiration.Add(10 * time.Minute)
+	conn.FileStart = now
+	conn.FileRecords = 0
 	conn.Sequence++
 	return nil
 }
 
-func (conn *Connection) writeHeader() {
-	msg := netlink.ArchivalRecord{
-		Metadata: &netlink.Metadata{
-			UUID:      uuid.FromCookie(conn.ID.CookieUint64()),
-			Sequence:  conn.Sequence,
-			StartTime: conn.StartTime,
-		},
+// fileExtension returns the extension of new files, for the Format flag.
+func fileExtension() string {
+	if Format.Value == "binary" {
+		return ".bin.zst"
 	}
+	return ".jsonl.zst"
+}
+
+func (conn *Connection) writeHeader(header netlink.Metadata) {
+	header.UUID = conn.Key().UUID()
+	header.Sequence = conn.Sequence
+	header.StartTime = conn.StartTime
+	header.Namespace = conn.Namespace
+	header.Protocol = conn.Protocol
+	msg := netlink.ArchivalRecord{Metadata: &header}
 	// FIXME: Error handling
-	bytes, _ := json.Marshal(msg)
-	conn.Writer.Write(bytes)
-	conn.Writer.Write([]byte("\n"))
+	conn.Writer.Write(&msg)
 }
 
 type stats struct {
@@ -195,49 +296,111 @@ type TcpStats struct {
 
 // Saver provides functionality for saving tcpinfo diffs to connection files.
 // It handles arbitrary connections, and only writes to file when the
-// significant fields change.  (TODO - what does "significant fields" mean).
+// ChangeDetector finds a change worth saving.
 // TODO - just export an interface, instead of the implementation.
 type Saver struct {
-	Host          string // mlabN
-	Pod           string // 3 alpha + 2 decimal
-	FileAgeLimit  time.Duration
+	Host          string       // mlabN
+	Pod           string       // 3 alpha + 2 decimal
+	PathTemplate  PathTemplate // Names the connection files.  NewSaver sets it from the flag.
 	MarshalChans  []MarshalChan
 	Done          *sync.WaitGroup // All marshallers will call Done on this.
-	Connections   map[uint64]*Connection
-	ClosingStats  map[uint64]TcpStats // BytesReceived and BytesSent for connections that are closing.
+	Connections   map[ConnKey]*Connection
+	ClosingStats  map[ConnKey]TcpStats // BytesReceived and BytesSent for connections that are closing.
 	ClosingTotals TcpStats
 
-	cache       *cache.Cache
+	// ChangeDetector decides which records are saved.  NewSaver sets it according to
+	// the command-line flags, and it may be replaced before MessageSaverLoop is started.
+	ChangeDetector ChangeDetector
+	// Rotation decides when long running connections start new files.  NewSaver
+	// sets it according to the command-line flags.
+	Rotation RotationPolicy
+	// Sink provides the writers for connection files.  NewSaver sets it to a
+	// FileSink, and it may be replaced before MessageSaverLoop is started.
+	Sink Sink
+	// DailySummaries enables writing the summaries of all connections to daily
+	// summary files, as well as to the connection files.
+	DailySummaries bool
+	// Heartbeat, if positive, is the longest time a live connection goes without a
+	// saved record.  Records saved only because of it have Heartbeat set.
+	Heartbeat time.Duration
+	// Retention, if not nil, decides whether new connections are saved while the
+	// output is full.
+	Retention *RetentionManager
+	// Overload is the policy for falling behind the collector or the writers, and
+	// OverloadSampleRate the fraction of new connections the sample policy saves.
+	Overload           OverloadPolicy
+	OverloadSampleRate float64
+
+	caches      map[blockKey]*cache.Cache // One cache per network namespace and protocol.
+	liveStats   map[blockKey]TcpStats     // Bytes sent and received on live connections.
 	stats       stats
 	eventServer eventsocket.Server
+
+	summaryWriter netlink.ArchiveWriter // The current daily summary file, if any.
+	summaryDay    string                // The date directory of summaryWriter.
+	environment   netlink.Metadata      // The fields of file headers that describe tcp-info and the kernel.
+}
+
+// fileHeader returns the fields of file headers that describe the writer, rather
+// than the connection.
+func (svr *Saver) fileHeader() netlink.Metadata {
+	header := svr.environment
+	header.Host = svr.Host
+	header.Pod = svr.Pod
+	return header
+}
+
+// kernelRelease returns the release of the running kernel, or the empty string if
+// it is unknown.
+func kernelRelease() string {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(release))
 }
 
 // NewSaver creates a new Saver for the given host and pod.  numMarshaller controls
 // how many marshalling goroutines are used to distribute the marshalling workload.
-func NewSaver(host string, pod string, numMarshaller int, srv eventsocket.Server, anon anonymize.IPAnonymizer) *Saver {
+// IP addresses are anonymized with anonMethod, which file headers record.
+func NewSaver(host string, pod string, numMarshaller int, srv eventsocket.Server, anonMethod anonymize.Method) *Saver {
+	anon := anonymize.New(anonMethod)
 	m := make([]MarshalChan, 0, numMarshaller)
-	c := cache.NewCache()
 	// We start with capacity of 500.  This will be reallocated as needed, but this
 	// is not a performance concern.
-	conn := make(map[uint64]*Connection, 500)
+	conn := make(map[ConnKey]*Connection, 500)
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	ageLim := 10 * time.Minute
 
 	for i := 0; i < numMarshaller; i++ {
 		m = append(m, newMarshaller(wg, anon))
 	}
 
 	return &Saver{
-		Host:         host,
-		Pod:          pod,
-		FileAgeLimit: ageLim,
-		MarshalChans: m,
-		Done:         wg,
-		Connections:  conn,
-		ClosingStats: make(map[uint64]TcpStats, 100),
-		cache:        c,
-		eventServer:  srv,
+		Host:               host,
+		Pod:                pod,
+		MarshalChans:       m,
+		Done:               wg,
+		Connections:        conn,
+		ClosingStats:       make(map[ConnKey]TcpStats, 100),
+		ChangeDetector:     NewChangeDetector(),
+		PathTemplate:       PathTemplate(*PathTemplateFlag),
+		Rotation:           NewRotationPolicy(),
+		Sink:               FileSink{},
+		Heartbeat:          *HeartbeatInterval,
+		Overload:           OverloadPolicy(Overload.Value),
+		OverloadSampleRate: *OverloadSampleRate,
+		DailySummaries:     *DailySummaries,
+		caches:             map[blockKey]*cache.Cache{{}: cache.NewCache()},
+		liveStats:          make(map[blockKey]TcpStats),
+		eventServer:        srv,
+		environment: netlink.Metadata{
+			ToolVersion:   prometheusx.GitShortCommit,
+			KernelRelease: kernelRelease(),
+			ExtMask:       inetdiag.RequestedExtensions,
+			TCPInfoSize:   int(unsafe.Sizeof(tcp.LinuxTCPInfo{})),
+			Anonymization: anonMethod.String(),
+		},
 	}
 }
 
@@ -257,47 +420,179 @@ func (svr *Saver) queue(msg *netlink.ArchivalRecord) error {
 		return ErrNoMarshallers
 	}
 	q := svr.MarshalChans[int(cookie%uint64(len(svr.MarshalChans)))]
-	conn, ok := svr.Connections[cookie]
+	key := ConnKey{Namespace: msg.Namespace, Cookie: cookie}
+	conn, ok := svr.Connections[key]
 	if !ok {
 		// Create a new connection for first time cookies.  For late connections already
 		// terminating, log some info for debugging purposes.
-		if idm.IDiagState >= uint8(tcp.FIN_WAIT1) {
+		if msg.IsTCP() && idm.IDiagState >= uint8(tcp.FIN_WAIT1) {
 			s, r := msg.GetStats()
 			log.Println("Starting:", msg.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), TcpStats{s, r})
 		}
-		conn = newConnection(idm, msg.Timestamp)
-		svr.eventServer.FlowCreated(msg.Timestamp, uuid.FromCookie(cookie), idm.ID.GetSockID())
-		svr.Connections[cookie] = conn
+		conn = newConnection(idm, msg.Namespace, msg.Protocol, msg.Timestamp)
+		conn.sampledOut = (svr.Retention != nil && !svr.Retention.Admit()) || !svr.admit(q)
+		// Flow events are only for TCP connections.
+		if msg.IsTCP() {
+			svr.eventServer.FlowCreated(msg.Timestamp, key.UUID(), idm.ID.GetSockID())
+		}
+		svr.Connections[key] = conn
 	} else {
 		//log.Println("Diff inode:", inode)
 	}
-	if time.Now().After(conn.Expiration) && conn.Writer != nil {
-		q <- Task{nil, conn.Writer} // Close the previous file.
+	if conn.sampledOut {
+		return nil
+	}
+	if conn.Writer != nil && svr.Rotation.ShouldRotate(conn, msg) {
+		q.send(Task{nil, conn.Writer}) // Close the previous file.
 		conn.Writer = nil
 	}
 	if conn.Writer == nil {
-		err := conn.Rotate(svr.Host, svr.Pod, svr.FileAgeLimit)
+		err := conn.Rotate(svr.Sink, svr.fileHeader(), svr.PathTemplate, msg.Timestamp)
 		if err != nil {
 			return err
 		}
 	}
-	q <- Task{msg, conn.Writer}
+	// The marshaller anonymizes msg in place, so everything else is done with it
+	// before it is queued.
+	svr.notify(key, conn, idm, msg)
+	svr.keepSaved(conn, idm, msg)
+	q.send(Task{msg, conn.Writer})
+	conn.FileRecords++
 	return nil
 }
 
-func (svr *Saver) endConn(cookie uint64) {
-	svr.eventServer.FlowDeleted(time.Now(), uuid.FromCookie(cookie))
-	q := svr.MarshalChans[cookie%uint64(len(svr.MarshalChans))]
-	conn, ok := svr.Connections[cookie]
-	if ok && conn.Writer != nil {
-		q <- Task{nil, conn.Writer}
-		delete(svr.Connections, cookie)
+// keepSaved keeps what the ChangeDetector needs of pm, the record being queued:
+// a copy, for a SavedRecordDetector that needs it, or else just the Timestamp.
+func (svr *Saver) keepSaved(conn *Connection, idm *inetdiag.InetDiagMsg, pm *netlink.ArchivalRecord) {
+	conn.savedState = idm.IDiagState
+	if d, ok := svr.ChangeDetector.(SavedRecordDetector); ok && d.NeedsSavedRecord() {
+		conn.saved = pm.Clone()
+		return
 	}
+	conn.lastSaved.Timestamp = pm.Timestamp
+	conn.saved = &conn.lastSaved
 }
 
-// Handle a bundle of messages.
+// notify sends the events for a record of a TCP connection that is being queued,
+// to event servers that serve them: StateChange, if its state differs from that of
+// the previous record queued, and Stats.
+func (svr *Saver) notify(key ConnKey, conn *Connection, idm *inetdiag.InetDiagMsg, pm *netlink.ArchivalRecord) {
+	if !pm.IsTCP() {
+		return
+	}
+	if ss, ok := svr.eventServer.(eventsocket.StateServer); ok && conn.saved != nil && conn.savedState != idm.IDiagState {
+		ss.FlowStateChanged(pm.Timestamp, key.UUID(), tcp.State(idm.IDiagState))
+	}
+	ss, ok := svr.eventServer.(eventsocket.StatsServer)
+	if !ok {
+		return
+	}
+	info, ok := pm.TCPInfo()
+	if !ok {
+		return
+	}
+	counters := info.Counters()
+	ss.FlowStatsUpdated(pm.Timestamp, key.UUID(), eventsocket.FlowStats{
+		BytesAcked:    counters.BytesAcked,
+		BytesReceived: counters.BytesReceived,
+		BytesSent:     counters.BytesSent,
+		RTT:           info.RTT,
+		RTTVar:        info.RTTVar,
+		MinRTT:        info.MinRTT,
+		SndCwnd:       info.SndCwnd,
+		DeliveryRate:  counters.DeliveryRate,
+	})
+}
+
+// endConn writes the summary of a connection as its last record, and closes its file.
+func (svr *Saver) endConn(key ConnKey, reason string) {
+	now := time.Now()
+	q := svr.MarshalChans[key.Cookie%uint64(len(svr.MarshalChans))]
+	conn, ok := svr.Connections[key]
+	if !ok {
+		return
+	}
+	if isTCP(conn.Protocol) {
+		svr.eventServer.FlowDeleted(now, key.UUID())
+	}
+	delete(svr.Connections, key)
+	if conn.Writer != nil {
+		summary := conn.summary
+		summary.CloseReason = reason
+		last := &netlink.ArchivalRecord{Timestamp: now, CloseReason: reason, Summary: &summary}
+		q.send(Task{last, conn.Writer})
+		q.send(Task{nil, conn.Writer})
+		if svr.DailySummaries {
+			svr.writeDailySummary(last)
+		}
+	}
+}
+
+// writeDailySummary writes a summary record to the summary file for its date,
+// starting a new file when the date changes.  All summary files are written by the
+// first marshaller, so that the records are written in order.
+func (svr *Saver) writeDailySummary(pm *netlink.ArchivalRecord) {
+	q := svr.MarshalChans[0]
+	day := pm.Timestamp.UTC().Format("2006/01/02")
+	if svr.summaryWriter != nil && day != svr.summaryDay {
+		q.send(Task{nil, svr.summaryWriter})
+		svr.summaryWriter = nil
+	}
+	if svr.summaryWriter == nil {
+		// A restart may start another file for the same day.
+		name := fmt.Sprintf("summary/%s/summary_%s%s", day, pm.Timestamp.UTC().Format("20060102T150405.000000Z"), fileExtension())
+		w, err := svr.Sink.Open(name)
+		if err != nil {
+			log.Println("Could not open summary file", name, err)
+			return
+		}
+		svr.summaryWriter = w
+		svr.summaryDay = day
+	}
+	q.send(Task{pm, svr.summaryWriter})
+}
+
+// observe updates the summary of the connection of pm.
+func (svr *Saver) observe(pm *netlink.ArchivalRecord) {
+	idm, err := pm.RawIDM.Parse()
+	if err != nil {
+		return
+	}
+	conn, ok := svr.Connections[ConnKey{Namespace: pm.Namespace, Cookie: idm.ID.Cookie()}]
+	if ok {
+		conn.summary.Update(pm)
+	}
+}
+
+// blockCache returns the cache for MessageBlocks from key, creating it if needed.
+func (svr *Saver) blockCache(key blockKey) *cache.Cache {
+	c, ok := svr.caches[key]
+	if !ok {
+		c = cache.NewCache()
+		svr.caches[key] = c
+	}
+	return c
+}
+
+// isLoopback returns true if either end of the socket uses a loopback or link
+// local address.  Unlike the local check done for TCP, it keeps sockets without
+// a peer, such as QUIC servers using unconnected UDP sockets.
+func isLoopback(ar *netlink.ArchivalRecord) bool {
+	idm, err := ar.RawIDM.Parse()
+	if err != nil {
+		return false
+	}
+	for _, addr := range []net.IP{idm.ID.SrcIP(), idm.ID.DstIP()} {
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle a bundle of messages from the network namespace and protocol in key.
 // Returns the bytes sent and received on all non-local connections.
-func (svr *Saver) handleType(t time.Time, msgs []*netlink.NetlinkMessage) (uint64, uint64) {
+func (svr *Saver) handleType(c *cache.Cache, key blockKey, t time.Time, msgs []*netlink.NetlinkMessage) (uint64, uint64) {
 	var liveSent, liveReceived uint64
 	for _, msg := range msgs {
 		// In swap and queue, we want to track the total speed of all connections
@@ -306,20 +601,27 @@ func (svr *Saver) handleType(t time.Time, msgs []*netlink.NetlinkMessage) (uint6
 			log.Println("Nil message")
 			continue
 		}
-		ar, err := netlink.MakeArchivalRecord(msg, true)
+		ar, err := netlink.MakeArchivalRecord(msg, isTCP(key.Protocol))
 		if ar == nil {
 			if err != nil {
 				log.Println(err)
 			}
 			continue
 		}
+		if !isTCP(key.Protocol) {
+			if isLoopback(ar) {
+				continue
+			}
+			ar.Protocol = key.Protocol
+		}
 		ar.Timestamp = t
+		ar.Namespace = key.Namespace
 
 		// Note: If GetStats shows up in profiling, might want to move to once/second code.
 		s, r := ar.GetStats()
 		liveSent += s
 		liveReceived += r
-		svr.swapAndQueue(ar)
+		svr.swapAndQueue(c, ar)
 	}
 
 	return liveSent, liveReceived
@@ -334,31 +636,49 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 	closeLogCount := 10000
 
 	for msgs := range readerChannel {
+		if svr.dropBlock(readerChannel, &msgs) {
+			continue
+		}
 
 		// Handle v4 and v6 messages, and return the total bytes sent and received.
 		// TODO - we only need to collect these stats if this is a reporting cycle.
 		// NOTE: Prior to April 2020, we were not using UTC here.  The servers
 		// are configured to use UTC time, so this should not make any difference.
-		s4, r4 := svr.handleType(msgs.V4Time.UTC(), msgs.V4Messages)
-		s6, r6 := svr.handleType(msgs.V6Time.UTC(), msgs.V6Messages)
+		key := blockKey{Namespace: msgs.Namespace}
+		if !isTCP(msgs.Protocol) {
+			key.Protocol = msgs.Protocol
+		}
+		c := svr.blockCache(key)
+		s4, r4 := svr.handleType(c, key, msgs.V4Time.UTC(), msgs.V4Messages)
+		s6, r6 := svr.handleType(c, key, msgs.V6Time.UTC(), msgs.V6Messages)
+		svr.liveStats[key] = TcpStats{Sent: s4 + s6, Received: r4 + r6}
 
 		// Note that the connections that have closed may have had traffic that
 		// we never see, and therefore can't account for in metrics.
-		residual := svr.cache.EndCycle()
+		residual := c.EndCycle()
+
+		// An empty block for another namespace means that the namespace is gone.
+		if msgs.Namespace != "" && len(msgs.V4Messages) == 0 && len(msgs.V6Messages) == 0 {
+			delete(svr.caches, key)
+			delete(svr.liveStats, key)
+		}
 
 		// Remove all missing connections from the cache.
 		// Also keep a metric of the total cumulative send and receive bytes.
 		for cookie := range residual {
 			ar := residual[cookie]
+			key := ConnKey{Namespace: msgs.Namespace, Cookie: cookie}
 			var stats TcpStats
 			var ok bool
-			if !ar.HasDiagInfo() {
-				stats, ok = svr.ClosingStats[cookie]
+			if !ar.IsTCP() {
+				// No byte counts for other protocols.
+			} else if !ar.HasDiagInfo() {
+				stats, ok = svr.ClosingStats[key]
 				if ok {
 					// Remove the stats from closing.
 					svr.ClosingTotals.Sent -= stats.Sent
 					svr.ClosingTotals.Received -= stats.Received
-					delete(svr.ClosingStats, cookie)
+					delete(svr.ClosingStats, key)
 				} else {
 					log.Println("Missing stats for", cookie)
 				}
@@ -378,15 +698,20 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 				closeLogCount--
 			}
 
-			svr.endConn(cookie)
+			svr.endConn(key, netlink.CloseReasonClosed)
 			svr.stats.IncExpiredCount()
 		}
 
 		// Every second, update the total throughput for the past second.
 		if msgs.V4Time.Unix() > lastReportTime {
+			var live TcpStats
+			for _, ls := range svr.liveStats {
+				live.Sent += ls.Sent
+				live.Received += ls.Received
+			}
 			// This is the total bytes since program start.
-			totalSent := closed.Sent + svr.ClosingTotals.Sent + s4 + s6
-			totalReceived := closed.Received + svr.ClosingTotals.Received + r4 + r6
+			totalSent := closed.Sent + svr.ClosingTotals.Sent + live.Sent
+			totalReceived := closed.Received + svr.ClosingTotals.Received + live.Received
 
 			// NOTE: We are seeing occasions when total < reported.  This messes up prometheus, so
 			// we detect that and skip reporting.
@@ -397,7 +722,7 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 			// TODO: This can all be discarded when we are confident the bug has been fixed.
 			if totalSent > 10*maxSwitchSpeed/8+reported.Sent || totalSent < reported.Sent {
 				// Some bug in the accounting!!
-				log.Println("Skipping BytesSent report due to bad accounting", totalSent, reported.Sent, closed.Sent, svr.ClosingTotals.Sent, s4, s6)
+				log.Println("Skipping BytesSent report due to bad accounting", totalSent, reported.Sent, closed.Sent, svr.ClosingTotals.Sent, live.Sent)
 				if totalSent < reported.Sent {
 					metrics.ErrorCount.WithLabelValues("totalSent < reportedSent").Inc()
 				} else {
@@ -410,7 +735,7 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 
 			if totalReceived > 10*maxSwitchSpeed/8+reported.Received || totalReceived < reported.Received {
 				// Some bug in the accounting!!
-				log.Println("Skipping BytesReceived report due to bad accounting", totalReceived, reported.Received, closed.Received, svr.ClosingTotals.Received, r4, r6)
+				log.Println("Skipping BytesReceived report due to bad accounting", totalReceived, reported.Received, closed.Received, svr.ClosingTotals.Received, live.Received)
 				if totalReceived < reported.Received {
 					metrics.ErrorCount.WithLabelValues("totalReceived < reportedReceived").Inc()
 				} else {
@@ -427,9 +752,9 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 	svr.Close()
 }
 
-func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
+func (svr *Saver) swapAndQueue(c *cache.Cache, pm *netlink.ArchivalRecord) {
 	svr.stats.IncTotalCount() // TODO fix race
-	old, err := svr.cache.Update(pm)
+	old, err := c.Update(pm)
 	if err != nil {
 		// TODO metric
 		log.Println(err)
@@ -442,6 +767,7 @@ func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
 		if err != nil {
 			log.Println(err, "Connections", len(svr.Connections))
 		}
+		svr.observe(pm)
 	} else {
 		pmIDM, err := pm.RawIDM.Parse()
 		if err != nil {
@@ -449,25 +775,29 @@ func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
 			log.Println(err)
 			return
 		}
-		if !pm.HasDiagInfo() {
+		if pm.IsTCP() && !pm.HasDiagInfo() {
 			// If the previous record has DiagInfo, store the send/receive stats.
 			// We will use them when we close the connection.
 			if old.HasDiagInfo() {
 				sOld, rOld := old.GetStats()
-				svr.ClosingStats[pmIDM.ID.Cookie()] = TcpStats{Sent: sOld, Received: rOld}
+				svr.ClosingStats[ConnKey{Namespace: pm.Namespace, Cookie: pmIDM.ID.Cookie()}] = TcpStats{Sent: sOld, Received: rOld}
 				svr.ClosingTotals.Sent += sOld
 				svr.ClosingTotals.Received += rOld
 				log.Println("Closing:", pm.Timestamp.Format("15:04:05.000"), pmIDM.ID.Cookie(), tcp.State(pmIDM.IDiagState), TcpStats{sOld, rOld})
 			}
 		}
 
-		change, err := pm.Compare(old)
+		saved := old
+		if conn, ok := svr.Connections[ConnKey{Namespace: pm.Namespace, Cookie: pmIDM.ID.Cookie()}]; ok && conn.saved != nil {
+			saved = conn.saved
+		}
+		changed, err := svr.ChangeDetector.Changed(old, saved, pm)
 		if err != nil {
 			// TODO metric
 			log.Println(err)
 			return
 		}
-		if change > netlink.NoMajorChange {
+		if changed {
 			svr.stats.IncDiffCount()
 			metrics.SnapshotCount.Inc()
 			err := svr.queue(pm)
@@ -475,16 +805,32 @@ func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
 				// TODO metric
 				log.Println(err)
 			}
+		} else if svr.Heartbeat > 0 && pm.Timestamp.Sub(saved.Timestamp) >= svr.Heartbeat {
+			pm.Heartbeat = true
+			metrics.SnapshotCount.Inc()
+			metrics.HeartbeatCount.Inc()
+			err := svr.queue(pm)
+			if err != nil {
+				// TODO metric
+				log.Println(err)
+			}
 		}
+		svr.observe(pm)
 	}
 }
 
 // Close shuts down all the marshallers, and waits for all files to be closed.
+// The file of every connection that is still open ends with its summary, with
+// CloseReason set to shutdown, so that readers can tell it was not truncated.
 func (svr *Saver) Close() {
 	log.Println("Terminating Saver")
 	log.Println("Total of", len(svr.Connections), "connections active.")
-	for i := range svr.Connections {
-		svr.endConn(i)
+	for key := range svr.Connections {
+		svr.endConn(key, netlink.CloseReasonShutdown)
+	}
+	if svr.summaryWriter != nil {
+		svr.MarshalChans[0].send(Task{nil, svr.summaryWriter})
+		svr.summaryWriter = nil
 	}
 	log.Println("Closing Marshallers")
 	for i := range svr.MarshalChans {
@@ -493,6 +839,13 @@ func (svr *Saver) Close() {
 	svr.Done.Done()
 }
 
+// ChangeCount returns the total number of new and changed records queued for saving.
+// It is safe to call from other goroutines.
+func (svr *Saver) ChangeCount() int64 {
+	stats := svr.stats.Copy()
+	return stats.NewCount + stats.DiffCount
+}
+
 // LogCacheStats prints out some basic cache stats.
 // TODO(https://github.com/m-lab/tcp-info/issues/32) - should also export all of these as Prometheus metrics.
 func (svr *Saver) LogCacheStats(localCount, errCount int) {
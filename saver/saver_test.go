@@ -1,20 +1,28 @@
 package saver_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
+	"unsafe"
 
+	"github.com/go-test/deep"
 	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/prometheusx"
 
 	"github.com/m-lab/tcp-info/eventsocket"
 
@@ -23,6 +31,7 @@ import (
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -93,6 +102,19 @@ func (msg *TestMsg) setDPort(dport uint16) *TestMsg {
 	return msg
 }
 
+func (msg *TestMsg) setState(state tcp.State) *TestMsg {
+	raw, _ := inetdiag.SplitInetDiagMsg(msg.Data)
+	if raw == nil {
+		panic("setState failed")
+	}
+	idm, err := raw.Parse()
+	if err != nil {
+		panic("setState failed")
+	}
+	idm.IDiagState = uint8(state)
+	return msg
+}
+
 func (msg *TestMsg) mustAR() *netlink.ArchivalRecord {
 	ar, err := netlink.MakeArchivalRecord(&msg.NetlinkMessage, true)
 	if err != nil {
@@ -199,12 +221,20 @@ func counterValue(m prometheus.Metric) float64 {
 
 type countingEventSocket struct {
 	opens, closes int
+	states        []tcp.State
+	stats         []eventsocket.FlowStats
 }
 
 func (*countingEventSocket) Listen() error                                              { return nil }
 func (*countingEventSocket) Serve(context.Context) error                                { return nil }
 func (c *countingEventSocket) FlowCreated(t time.Time, uuid string, id inetdiag.SockID) { c.opens++ }
 func (c *countingEventSocket) FlowDeleted(t time.Time, uuid string)                     { c.closes++ }
+func (c *countingEventSocket) FlowStateChanged(t time.Time, uuid string, state tcp.State) {
+	c.states = append(c.states, state)
+}
+func (c *countingEventSocket) FlowStatsUpdated(t time.Time, uuid string, stats eventsocket.FlowStats) {
+	c.stats = append(c.stats, stats)
+}
 
 func TestHistograms(t *testing.T) {
 	dir, err := ioutil.TempDir("", "tcp-info_saver_TestBasic")
@@ -218,8 +248,7 @@ func TestHistograms(t *testing.T) {
 		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
 	}()
 	eventCounts := &countingEventSocket{}
-	anon := anonymize.New(anonymize.None)
-	svr := saver.NewSaver("foo", "bar", 1, eventCounts, anon)
+	svr := saver.NewSaver("foo", "bar", 1, eventCounts, anonymize.None)
 	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
 	go svr.MessageSaverLoop(svrChan)
 
@@ -317,6 +346,9 @@ func TestHistograms(t *testing.T) {
 	// We should have seen total of 4 snapshots.
 	metrics.SnapshotCount.Collect(c)
 	checkCounter(t, c, 4)
+	if svr.ChangeCount() != 4 {
+		t.Error("ChangeCount should be 4, not", svr.ChangeCount())
+	}
 
 	close(c)
 
@@ -324,23 +356,158 @@ func TestHistograms(t *testing.T) {
 	// zstd have slightly different compression ratios.
 	// The min/max criteria are based on zstd 1.3.8.
 	// These may change with different zstd versions.
-	verifySizeBetween(t, 380, 500, "2018/02/06/*_0000000000002BE2.00000.jsonl.zst")
-	verifySizeBetween(t, 350, 450, "2018/02/06/*_00000000000000EB.00000.jsonl.zst")
+	// The files end with the connection summaries, and the headers include the
+	// kernel release, which varies in length.
+	verifySizeBetween(t, 540, 760, "2018/02/06/*_0000000000002BE2.00000.jsonl.zst")
+	verifySizeBetween(t, 510, 730, "2018/02/06/*_00000000000000EB.00000.jsonl.zst")
+}
+
+func TestNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestNamespaces")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	eventCounts := &countingEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, eventCounts, anonymize.None)
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// The same cookie in two different namespaces must be two different connections.
+	m1 := msg(t, 1234, 1)
+	m2 := msg(t, 1234, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	svrChan <- netlink.MessageBlock{Namespace: "netns-42", V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m2.NetlinkMessage}}
+
+	// A second cycle for the default namespace must not close the connection in netns-42.
+	date = date.Add(time.Second)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	// An empty block marks netns-42 as gone.
+	svrChan <- netlink.MessageBlock{Namespace: "netns-42", V4Time: date, V6Time: date}
+	// Make sure the previous block is fully processed before checking the counts.
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	if eventCounts.opens != 2 || eventCounts.closes != 1 {
+		t.Errorf("Should have {opens:2, closes:1} not %+v", *eventCounts)
+	}
+
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Error("Expected one file for the default namespace, got", names)
+	}
+	names, err = filepath.Glob("2018/02/06/*_00000000000004D2_netns-42.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file for netns-42, got", names)
+	}
+	rdr, err := zstd.NewReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 3 || records[0].Metadata == nil || records[0].Metadata.Namespace != "netns-42" || records[1].Namespace != "netns-42" ||
+		records[2].Summary == nil || records[2].Summary.Namespace != "netns-42" {
+		t.Errorf("Records are not tagged with the namespace: %+v", records)
+	}
+}
+
+func TestProtocols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestProtocols")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	eventCounts := &countingEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, eventCounts, anonymize.None)
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	tcpMsg := msg(t, 1234, 1)
+	udpMsg := msg(t, 5678, 443)
+	udp := func(date time.Time, msgs ...*netlink.NetlinkMessage) netlink.MessageBlock {
+		return netlink.MessageBlock{Protocol: inetdiag.Protocol_IPPROTO_UDP, V4Time: date, V6Time: date, V4Messages: msgs}
+	}
+	svrChan <- netlink.MessageBlock{Protocol: inetdiag.Protocol_IPPROTO_TCP, V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&tcpMsg.NetlinkMessage}}
+	svrChan <- udp(date, &udpMsg.NetlinkMessage)
+	// Unchanged, so should not be saved again.
+	date = date.Add(time.Second)
+	svrChan <- udp(date, &udpMsg.NetlinkMessage)
+	// For other protocols, INET_DIAG_INFO is not TCPInfo, and any change is saved.
+	date = date.Add(time.Second)
+	changed := msg(t, 5678, 443).setByte(200, 1)
+	svrChan <- udp(date, &changed.NetlinkMessage)
+	// A UDP block without the connection closes it, but must not close TCP connections.
+	date = date.Add(time.Second)
+	svrChan <- udp(date)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&tcpMsg.NetlinkMessage}}
+	// Only the TCP connection has flow events.
+	if eventCounts.opens != 1 || eventCounts.closes != 0 {
+		t.Errorf("Should have {opens:1, closes:0} not %+v", *eventCounts)
+	}
+	if len(svr.ClosingStats) != 0 {
+		t.Error("UDP connections should have no closing stats", svr.ClosingStats)
+	}
+
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Error("Expected one TCP file, got", names)
+	}
+	names, err = filepath.Glob("udp/2018/02/06/*_000000000000162E.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one UDP file, got", names)
+	}
+	rdr, err := zstd.NewReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 4 {
+		t.Fatal("Expected header, two records and the summary, got", len(records))
+	}
+	if records[0].Metadata == nil || records[0].Metadata.Protocol != inetdiag.Protocol_IPPROTO_UDP {
+		t.Error("Header should have UDP protocol", records[0].Metadata)
+	}
+	for _, r := range records[1:3] {
+		if r.Protocol != inetdiag.Protocol_IPPROTO_UDP || r.IsTCP() {
+			t.Error("Record should have UDP protocol", r.Protocol)
+		}
+	}
+	if s := records[3].Summary; s == nil || s.Protocol != inetdiag.Protocol_IPPROTO_UDP || s.CloseReason != netlink.CloseReasonClosed || s.BytesSent != 0 {
+		t.Error("Bad summary", s)
+	}
 }
 
 // TODO - this file contains connection data from a connection with FIN_WAIT2 and no DiagInfo.
 // Need to create fake NetlinkMessage stream, and send to saver, and test behavior.
 func TestFinWait2NotImplemented(t *testing.T) {
 	source := "testdata/finwait2-sample_1554836592_unsafe_000000000135A272.00000.jsonl.zst"
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	defer rdr.Close()
 	msgs, err := netlink.LoadAllArchivalRecords(rdr)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	anon := anonymize.New(anonymize.None)
-	svr := saver.NewSaver("hostname", "fakePod", 1, eventsocket.NullServer(), anon)
+	svr := saver.NewSaver("hostname", "fakePod", 1, eventsocket.NullServer(), anonymize.None)
 	blockChan := make(chan netlink.MessageBlock, 0)
 	go svr.MessageSaverLoop(blockChan)
 	for i := range msgs {
@@ -363,3 +530,1213 @@ func TestFinWait2NotImplemented(t *testing.T) {
 func assertSaverIsACacheLogger(s *saver.Saver) {
 	func(csl saver.CacheLogger) {}(s)
 }
+
+// If this compiles, the "test" passes
+func assertSaverIsAChangeCounter(s *saver.Saver) {
+	func(cc saver.ChangeCounter) {}(s)
+}
+
+func TestBinaryFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestBinaryFormat")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	rtx.Must(saver.Format.Set("binary"), "Could not set format")
+	defer saver.Format.Set("jsonl")
+
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 1234, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	date = date.Add(time.Second)
+	m2 := msg(t, 1234, 1).setBytesReceived(1000)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m2.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.bin.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one binary file, got", names)
+	}
+	rdr, err := zstd.NewReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 4 {
+		t.Fatal("Expected header, two records and the close record, got", len(records))
+	}
+	if records[0].Metadata == nil || records[0].Metadata.StartTime != date.Add(-time.Second) {
+		t.Error("Bad header", records[0].Metadata)
+	}
+	if _, r := records[2].GetStats(); r != 1000 || !records[2].Timestamp.Equal(date) {
+		t.Error("Bad record", r, records[2].Timestamp)
+	}
+}
+
+func TestDeltaMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestDeltaMode")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	*saver.Delta = true
+	defer func() { *saver.Delta = false }()
+
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := uint64(0); i < 3; i++ {
+		m := msg(t, 1234, 1).setBytesReceived(1000 * i)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr, err := zstd.NewReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	raw, err := ioutil.ReadAll(rdr)
+	rtx.Must(err, "Could not read %s", names[0])
+	rdr.Close()
+	if strings.Count(string(raw), `"Delta"`) != 2 {
+		t.Errorf("Expected two delta records:\n%s", raw)
+	}
+
+	records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(raw))
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 5 {
+		t.Fatal("Expected header, three records and the close record, got", len(records))
+	}
+	for i, r := range records[1:4] {
+		if _, received := r.GetStats(); received != uint64(1000*i) || r.Delta != nil {
+			t.Error("Bad record", i, received, r.Delta)
+		}
+	}
+}
+
+// record returns a fresh record at the given time, with the given BytesReceived
+// and BytesAcked.
+func record(t *testing.T, when time.Time, received, acked uint64) *netlink.ArchivalRecord {
+	ar := msg(t, 1234, 1).setBytesReceived(received).mustAR()
+	ar.Timestamp = when
+	binary.LittleEndian.PutUint64(ar.Attributes[inetdiag.INET_DIAG_INFO][unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesAcked):], acked)
+	return ar
+}
+
+func TestChangeDetectors(t *testing.T) {
+	start := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	base := record(t, start, 1000, 1000)
+	later := func(d time.Duration, received, acked uint64) *netlink.ArchivalRecord {
+		return record(t, start.Add(d), received, acked)
+	}
+	caState := later(time.Millisecond, 1000, 1000)
+	caState.Attributes[inetdiag.INET_DIAG_INFO][1] = 4 // TCP_CA_Loss
+	closed := later(time.Millisecond, 1000, 1000)
+	closed.RawIDM[1] = uint8(tcp.CLOSE_WAIT)
+
+	tests := []struct {
+		name     string
+		detector saver.ChangeDetector
+		pm       *netlink.ArchivalRecord
+		want     bool
+	}{
+		{"default unchanged", saver.DefaultChangeDetector{}, later(time.Second, 1000, 1000), false},
+		{"default changed", saver.DefaultChangeDetector{}, later(time.Millisecond, 2000, 1000), true},
+		{"interval too soon", &saver.MinIntervalDetector{Interval: time.Second}, later(time.Millisecond, 2000, 1000), false},
+		{"interval elapsed", &saver.MinIntervalDetector{Interval: time.Second}, later(time.Second, 2000, 1000), true},
+		{"interval unchanged", &saver.MinIntervalDetector{Interval: time.Second}, later(time.Minute, 1000, 1000), false},
+		{"interval state change", &saver.MinIntervalDetector{Interval: time.Second}, closed, true},
+		{"state counters", saver.StateChangeDetector{}, later(time.Second, 2000, 2000), false},
+		{"state CA state", saver.StateChangeDetector{}, caState, true},
+		{"state TCP state", saver.StateChangeDetector{}, closed, true},
+		{"acked small", &saver.BytesAckedDetector{Percent: 10}, later(time.Second, 1000, 1099), false},
+		{"acked large", &saver.BytesAckedDetector{Percent: 10}, later(time.Second, 1000, 1100), true},
+		{"acked state change", &saver.BytesAckedDetector{Percent: 10}, caState, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.detector.Changed(base, base, tt.pm)
+		rtx.Must(err, "Changed failed for %s", tt.name)
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// BytesAckedDetector measures growth since the last saved record, not the
+	// previous observation.
+	prev := later(time.Second, 1000, 1090)
+	pm := later(2*time.Second, 1000, 1180)
+	if changed, _ := (&saver.BytesAckedDetector{Percent: 10}).Changed(prev, base, pm); !changed {
+		t.Error("Should measure BytesAcked growth from the saved record")
+	}
+
+	// Only it needs the Saver to keep a copy of the saved record.
+	if d, ok := saver.ChangeDetector(&saver.BytesAckedDetector{}).(saver.SavedRecordDetector); !ok || !d.NeedsSavedRecord() {
+		t.Error("BytesAckedDetector should need the saved record")
+	}
+	for _, d := range []saver.ChangeDetector{saver.DefaultChangeDetector{}, &saver.MinIntervalDetector{}, saver.StateChangeDetector{}} {
+		if _, ok := d.(saver.SavedRecordDetector); ok {
+			t.Errorf("%T should not need the saved record", d)
+		}
+	}
+}
+
+func TestChangePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestChangePolicy")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	rtx.Must(saver.ChangePolicy.Set("min-interval"), "Could not set flag")
+	defer saver.ChangePolicy.Set("default")
+
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	if _, ok := svr.ChangeDetector.(*saver.MinIntervalDetector); !ok {
+		t.Fatalf("Wrong ChangeDetector %T", svr.ChangeDetector)
+	}
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// Every record changes, but only one per second is saved.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := uint64(0); i < 10; i++ {
+		m := msg(t, 1234, 1).setBytesReceived(1000 * i)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(300 * time.Millisecond)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr, err := zstd.NewReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", names[0])
+	// Records at 0, 1.2 and 2.4 seconds, plus the header and the close record.
+	if len(records) != 5 {
+		t.Error("Expected header, three records and the close record, got", len(records))
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestHeartbeat")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	svr.Heartbeat = 3 * time.Second
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// Nothing changes, except at 7 seconds.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := uint64(0); i < 12; i++ {
+		m := msg(t, 1234, 1)
+		if i >= 7 {
+			m.setBytesReceived(1000)
+		}
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr, err := zstd.NewReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", names[0])
+	// The heartbeat interval restarts at the change.
+	want := []struct {
+		second    int
+		heartbeat bool
+	}{{0, false}, {3, true}, {6, true}, {7, false}, {10, true}}
+	if len(records) != len(want)+2 {
+		t.Fatal("Expected header and", len(want), "records and the close record, got", len(records))
+	}
+	for i, w := range want {
+		r := records[i+1]
+		if r.Timestamp.Second() != 13+w.second || r.Heartbeat != w.heartbeat {
+			t.Error("Wrong record", i, r.Timestamp, r.Heartbeat)
+		}
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestCloseReason")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m := msg(t, 1234, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one file, got", names)
+	}
+	rdr, err := zstd.NewReader(names[0])
+	rtx.Must(err, "Could not open %s", names[0])
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", names[0])
+	if len(records) != 3 {
+		t.Fatal("Expected header, record and close record, got", len(records))
+	}
+	if records[1].CloseReason != "" || records[2].CloseReason != netlink.CloseReasonShutdown || records[2].RawIDM != nil {
+		t.Error("Wrong close record", records[2])
+	}
+}
+
+func TestRecoverPartialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestRecoverPartialFiles")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	source := "../netlink/testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst"
+	data, err := ioutil.ReadFile(source)
+	rtx.Must(err, "Could not read %s", source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
+	all, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read %s", source)
+	rdr.Close()
+
+	rtx.Must(os.MkdirAll(dir+"/2019/06/05", 0777), "Could not create dir")
+	files := map[string][]byte{
+		"complete.00000.jsonl.zst":  data,
+		"truncated.00000.jsonl.zst": data[:len(data)/2],
+		"corrupt.00000.jsonl.zst":   []byte("not zstd"),
+	}
+	for name, content := range files {
+		fn := dir + "/2019/06/05/" + name + saver.PartialSuffix
+		rtx.Must(ioutil.WriteFile(fn, content, 0644), "Could not write %s", fn)
+	}
+	// A file that can not be renamed, as a directory has its final name, is
+	// skipped.
+	rtx.Must(os.MkdirAll(dir+"/2019/06/05/blocked.00000.jsonl.zst/dir", 0777), "Could not create dir")
+	rtx.Must(ioutil.WriteFile(dir+"/2019/06/05/blocked.00000.jsonl.zst"+saver.PartialSuffix, data, 0644), "Could not write file")
+	// Date directories that are too old are not searched.
+	rtx.Must(os.MkdirAll(dir+"/2019/05/01", 0777), "Could not create dir")
+	old := dir + "/2019/05/01/old.00000.jsonl.zst" + saver.PartialSuffix
+	rtx.Must(ioutil.WriteFile(old, data, 0644), "Could not write %s", old)
+
+	stats, err := saver.RecoverPartialFiles(dir, time.Date(2019, 6, 5, 12, 0, 0, 0, time.UTC))
+	rtx.Must(err, "Could not recover files")
+	if stats != (saver.RecoveryStats{Complete: 1, Truncated: 1, Corrupt: 1, Failed: 1}) {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	names, err := filepath.Glob(dir + "/2019/06/05/*")
+	rtx.Must(err, "Could not glob")
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	expected := []string{
+		"blocked.00000.jsonl.zst", "blocked.00000.jsonl.zst" + saver.PartialSuffix,
+		"complete.00000.jsonl.zst", "corrupt.00000.jsonl.zst" + saver.CorruptSuffix, "truncated.00000.jsonl.zst",
+	}
+	if diff := deep.Equal(names, expected); diff != nil {
+		t.Error(diff)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Error("Old partial file should be left alone:", err)
+	}
+	stats, err = saver.RecoverPartialFiles(dir, time.Time{})
+	rtx.Must(err, "Could not recover files")
+	if stats != (saver.RecoveryStats{Complete: 1, Failed: 1}) {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	if _, err := saver.RecoverPartialFiles(dir+"/missing", time.Time{}); err == nil {
+		t.Error("Should fail for a missing directory")
+	}
+
+	rdr, err = zstd.NewReader(dir + "/2019/06/05/truncated.00000.jsonl.zst")
+	rtx.Must(err, "Could not open recovered file")
+	defer rdr.Close()
+	recovered, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read recovered file")
+	last := recovered[len(recovered)-1]
+	if len(recovered) < 2 || len(recovered) >= len(all) || last.CloseReason != netlink.CloseReasonRecovered {
+		t.Error("Wrong recovered records", len(recovered), len(all), last.CloseReason)
+	}
+	if diff := deep.Equal(recovered[:len(recovered)-1], all[:len(recovered)-1]); diff != nil {
+		t.Error(diff)
+	}
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error { return nil }
+
+func TestSinks(t *testing.T) {
+	mem := saver.NewMemorySink()
+	stream := &bufferCloser{}
+	for _, sink := range []saver.Sink{mem, saver.NewStreamSink(stream)} {
+		svr := saver.NewSaver("foo", "bar", 2, &countingEventSocket{}, anonymize.None)
+		svr.Sink = sink
+		svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+		go svr.MessageSaverLoop(svrChan)
+		date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+		for i := uint64(0); i < 3; i++ {
+			m1 := msg(t, 1234, 1).setBytesReceived(1000 * i)
+			m2 := msg(t, 4321, 2).setBytesReceived(1000 * i)
+			svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage, &m2.NetlinkMessage}}
+			date = date.Add(time.Second)
+		}
+		close(svrChan)
+		svr.Done.Wait()
+		rtx.Must(sink.Close(), "Could not close sink")
+	}
+
+	// Nothing is written to the working directory.
+	if names, _ := filepath.Glob("2018"); len(names) != 0 {
+		t.Error("Sinks should not create files", names)
+	}
+
+	names := mem.Names()
+	if len(names) != 2 {
+		t.Fatal("Expected two files, got", names)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "2018/02/06/") || !strings.HasSuffix(name, ".00000.jsonl.zst") {
+			t.Error("Bad name", name)
+		}
+		records, closed := mem.Records(name)
+		// Header, three records, and the close record.
+		if len(records) != 5 || !closed || records[0].Metadata == nil {
+			t.Error("Bad records for", name, len(records), closed)
+		}
+		if _, r := records[3].GetStats(); r != 2000 {
+			t.Error("Bad record", r)
+		}
+	}
+
+	// The stream has the same records, interleaved, with a closing line per file.
+	counts := map[string]int{}
+	closed := map[string]bool{}
+	dec := json.NewDecoder(stream)
+	for dec.More() {
+		var sr saver.StreamRecord
+		rtx.Must(dec.Decode(&sr), "Could not decode stream")
+		if sr.Closed {
+			closed[sr.Name] = true
+			continue
+		}
+		if closed[sr.Name] || sr.Record == nil {
+			t.Error("Bad stream record", sr)
+		}
+		counts[sr.Name]++
+	}
+	for _, name := range names {
+		if counts[name] != 5 || !closed[name] {
+			t.Error("Bad stream for", name, counts[name], closed[name])
+		}
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	for _, spec := range []string{"files", "stdout"} {
+		_, err := saver.NewSink(spec)
+		rtx.Must(err, "Could not create %s sink", spec)
+	}
+	if _, err := saver.NewSink("s3://bucket"); err != saver.ErrUnknownSink {
+		t.Error("Expected ErrUnknownSink, got", err)
+	}
+	if _, err := saver.NewSink("unix:/this/does/not/exist"); err == nil {
+		t.Error("Should fail to connect to a nonexistent socket")
+	}
+
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestNewSink")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", dir+"/sink.sock")
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	sink, err := saver.NewSink("unix:" + dir + "/sink.sock")
+	rtx.Must(err, "Could not create unix sink")
+	c, err := l.Accept()
+	rtx.Must(err, "Could not accept")
+	defer c.Close()
+	w, err := sink.Open("foo")
+	rtx.Must(err, "Could not open")
+	rtx.Must(w.Write(&netlink.ArchivalRecord{Namespace: "bar"}), "Could not write")
+	rtx.Must(sink.Close(), "Could not close")
+	line, err := ioutil.ReadAll(c)
+	rtx.Must(err, "Could not read")
+	if string(line) != `{"Name":"foo","Record":{"Timestamp":"0001-01-01T00:00:00Z","Namespace":"bar"}}`+"\n" {
+		t.Errorf("Wrong stream %q", line)
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	mem := saver.NewMemorySink()
+	svr := saver.NewSaver("foo", "bar", 2, &countingEventSocket{}, anonymize.None)
+	svr.Sink = mem
+	svr.DailySummaries = true
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	rttOffset := unsafe.Offsetof(tcp.LinuxTCPInfo{}.RTT)
+	for i, rtt := range []uint32{5000, 9000, 7000} {
+		m := msg(t, 1234, 1).setBytesReceived(uint64(1000 * i))
+		binary.LittleEndian.PutUint32(m.mustAR().Attributes[inetdiag.INET_DIAG_INFO][rttOffset:], rtt)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	// The connection is gone in the next cycle.
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var conn, daily []*netlink.ArchivalRecord
+	for _, name := range mem.Names() {
+		records, closed := mem.Records(name)
+		if !closed {
+			t.Error("File was not closed", name)
+		}
+		if strings.HasPrefix(name, "summary/") {
+			daily = records
+		} else {
+			conn = records
+		}
+	}
+	if len(conn) != 5 || len(daily) != 1 {
+		t.Fatal("Expected five connection records and a daily summary, got", len(conn), len(daily))
+	}
+	last := conn[len(conn)-1]
+	if last.CloseReason != netlink.CloseReasonClosed || last.RawIDM != nil || last.Summary == nil {
+		t.Fatal("Last record should be the summary", last)
+	}
+	s := last.Summary
+	if s.UUID != conn[0].Metadata.UUID || !s.StartTime.Equal(conn[0].Metadata.StartTime) || s.Duration != 2*time.Second {
+		t.Error("Bad summary times", s)
+	}
+	if s.BytesReceived != 2000 || s.MaxRTT != 9000 || s.MinRTT == 0 || s.MinRTT > 5000 || s.LastState == "" {
+		t.Errorf("Bad summary %+v", s)
+	}
+	if diff := deep.Equal(daily[0], last); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// sizedWriter is an ArchiveWriter with a fixed size.
+type sizedWriter struct {
+	netlink.ArchiveWriter
+	size int64
+}
+
+func (sw *sizedWriter) Size() int64 { return sw.size }
+
+func TestRotationPolicies(t *testing.T) {
+	start := time.Date(2018, 02, 06, 23, 59, 0, 0, time.UTC)
+	conn := &saver.Connection{FileStart: start, FileRecords: 10, Writer: &sizedWriter{size: 5000}}
+	at := func(d time.Duration) *netlink.ArchivalRecord {
+		return &netlink.ArchivalRecord{Timestamp: start.Add(d)}
+	}
+	tests := []struct {
+		name   string
+		policy saver.RotationPolicy
+		pm     *netlink.ArchivalRecord
+		want   bool
+	}{
+		{"young", &saver.AgeRotation{MaxAge: time.Minute}, at(59 * time.Second), false},
+		{"old", &saver.AgeRotation{MaxAge: time.Minute}, at(time.Minute), true},
+		{"few records", &saver.RecordCountRotation{MaxRecords: 11}, at(0), false},
+		{"many records", &saver.RecordCountRotation{MaxRecords: 10}, at(0), true},
+		{"small", &saver.SizeRotation{MaxBytes: 5001}, at(0), false},
+		{"large", &saver.SizeRotation{MaxBytes: 5000}, at(0), true},
+		{"same hour", &saver.WallClockRotation{Boundary: time.Hour}, at(59 * time.Second), false},
+		{"next hour", &saver.WallClockRotation{Boundary: time.Hour}, at(time.Minute), true},
+		{"same day", &saver.WallClockRotation{Boundary: 24 * time.Hour}, at(59 * time.Second), false},
+		{"next day", &saver.WallClockRotation{Boundary: 24 * time.Hour}, at(time.Minute), true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.ShouldRotate(conn, tt.pm); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// Without a Sizer, the size is unknown.
+	conn.Writer = nil
+	if (&saver.SizeRotation{MaxBytes: 0}).ShouldRotate(conn, at(0)) {
+		t.Error("Should not rotate without a Sizer")
+	}
+
+	// Limits that are not positive would rotate on every record.
+	rtx.Must(saver.ValidateRotationFlags(), "The default flags should be valid")
+	for _, bad := range []struct{ name, value string }{
+		{"saver.rotation-age", "-1m"},
+		{"saver.rotation-records", "0"},
+		{"saver.rotation-size", "0"},
+		{"saver.rotation-boundary", "0"},
+	} {
+		f := flag.Lookup(bad.name)
+		old := f.Value.String()
+		rtx.Must(f.Value.Set(bad.value), "Could not set %s", bad.name)
+		if saver.ValidateRotationFlags() != saver.ErrBadRotation {
+			t.Errorf("-%s=%s should be rejected", bad.name, bad.value)
+		}
+		rtx.Must(f.Value.Set(old), "Could not reset %s", bad.name)
+	}
+}
+
+func TestRotationAcrossDays(t *testing.T) {
+	mem := saver.NewMemorySink()
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	svr.Sink = mem
+	svr.Rotation = &saver.WallClockRotation{Boundary: 24 * time.Hour}
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// A connection that spans three days, with a record every 12 hours.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := uint64(0); i < 5; i++ {
+		m := msg(t, 1234, 1).setBytesReceived(1000 * i)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(12 * time.Hour)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	counts := map[string]int{}
+	for _, name := range mem.Names() {
+		records, closed := mem.Records(name)
+		if !closed || records[0].Metadata == nil {
+			t.Error("Bad file", name)
+		}
+		counts[name[:10]+name[len(name)-16:]] = len(records)
+	}
+	// Each file has a header and two records, except that the last one has one
+	// record, and the summary.
+	expected := map[string]int{
+		"2018/02/06.00000.jsonl.zst": 3,
+		"2018/02/07.00001.jsonl.zst": 3,
+		"2018/02/08.00002.jsonl.zst": 3,
+	}
+	if diff := deep.Equal(counts, expected); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	for _, bad := range []saver.PathTemplate{"", "{date}/{uuid}", "{date}/{seq}"} {
+		if bad.Validate() != saver.ErrBadPathTemplate {
+			t.Error("Should reject", bad)
+		}
+	}
+	for _, bad := range []saver.PathTemplate{"/{uuid}.{seq}", "../{uuid}.{seq}", "{date}/../../{uuid}.{seq}"} {
+		if bad.Validate() != saver.ErrPathTemplateEscapes {
+			t.Error("Should reject", bad)
+		}
+	}
+	for _, good := range []saver.PathTemplate{saver.DefaultPathTemplate, "{host}/..{uuid}.{seq}"} {
+		if err := good.Validate(); err != nil {
+			t.Error(good, err)
+		}
+	}
+
+	mem := saver.NewMemorySink()
+	svr := saver.NewSaver("mlab1", "lga03", 1, &countingEventSocket{}, anonymize.None)
+	svr.Sink = mem
+	svr.PathTemplate = "{date}/{host}-{pod}/{uuid}.{seq}"
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m := msg(t, 1234, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names := mem.Names()
+	if len(names) != 1 {
+		t.Fatal("Expected one file:", names)
+	}
+	if !strings.HasPrefix(names[0], "2018/02/06/mlab1-lga03/") || !strings.HasSuffix(names[0], ".00000.jsonl.zst") {
+		t.Error("Bad file name", names[0])
+	}
+	records, _ := mem.Records(names[0])
+	if md := records[0].Metadata; md == nil || md.Host != "mlab1" || md.Pod != "lga03" {
+		t.Errorf("Bad header %+v", md)
+	}
+}
+
+func TestPathTemplateSanitizes(t *testing.T) {
+	conn := &saver.Connection{}
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for _, tt := range []struct{ host, pod, want string }{
+		{"mlab1.lga03", "pod-1_a", "mlab1.lga03/pod-1_a"},
+		{"../../etc", "a/b", "___.._etc/a_b"},
+		{"..", ".", "__/_"},
+		{"", "x y", "/x_y"},
+	} {
+		got := saver.PathTemplate("{host}/{pod}").Expand(conn, tt.host, tt.pod, date)
+		if got != tt.want {
+			t.Errorf("Expand(%q, %q) = %q, want %q", tt.host, tt.pod, got, tt.want)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	mem := saver.NewMemorySink()
+	// The header records the anonymization of the Saver, not that of the flag.
+	svr := saver.NewSaver("mlab1", "lga03", 1, &countingEventSocket{}, anonymize.Netblock)
+	svr.Sink = mem
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m := msg(t, 1234, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names := mem.Names()
+	if len(names) != 1 {
+		t.Fatal("Expected one file:", names)
+	}
+	records, _ := mem.Records(names[0])
+	md := records[0].Metadata
+	if md == nil {
+		t.Fatal("Missing header")
+	}
+	if md.ToolVersion != prometheusx.GitShortCommit {
+		t.Error("Bad ToolVersion", md.ToolVersion)
+	}
+	if md.ExtMask != inetdiag.RequestedExtensions || md.ExtMask&(1<<(inetdiag.INET_DIAG_INFO-1)) == 0 {
+		t.Errorf("Bad ExtMask %x", md.ExtMask)
+	}
+	if md.TCPInfoSize != int(unsafe.Sizeof(tcp.LinuxTCPInfo{})) {
+		t.Error("Bad TCPInfoSize", md.TCPInfoSize)
+	}
+	if md.Anonymization != string(anonymize.Netblock) {
+		t.Error("Bad Anonymization", md.Anonymization)
+	}
+	if _, err := os.Stat("/proc/sys/kernel/osrelease"); err == nil && md.KernelRelease == "" {
+		t.Error("Missing KernelRelease")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRetention")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	files := []string{
+		"2018/02/03/a.00000.jsonl.zst",
+		"2018/02/04/a.00001.jsonl.zst",
+		"2018/02/05/a.00002.jsonl.zst",
+		"udp/2018/02/05/b.00000.jsonl.zst",
+		"2018/02/06/a.00003.jsonl.zst.partial",
+		"2018/02/06/c.00000.jsonl.zst",
+		"other",
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		rtx.Must(os.MkdirAll(filepath.Dir(path), 0777), "Could not create dir")
+		rtx.Must(ioutil.WriteFile(path, make([]byte, 1000), 0666), "Could not write file")
+	}
+	exists := func(f string) bool {
+		_, err := os.Stat(filepath.Join(dir, f))
+		return err == nil
+	}
+
+	now := time.Date(2018, 02, 06, 12, 0, 0, 0, time.UTC)
+	// Nothing to do.
+	rm := &saver.RetentionManager{Dir: dir, Quota: 7000, MaxAge: 1000 * time.Hour}
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	for _, f := range files {
+		if !exists(f) {
+			t.Error("Should not have deleted", f)
+		}
+	}
+	if rm.Full() {
+		t.Error("Should not be full")
+	}
+
+	// 2018/02/03 ended 60 hours ago.
+	rm.MaxAge = 60 * time.Hour
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	if exists("2018/02/03") || !exists("2018/02/04") {
+		t.Error("Wrong directories deleted for age")
+	}
+
+	// Deleting 02/04 and both 02/05 directories leaves 3000 bytes.  The current
+	// date is never deleted, so a smaller quota can not be met.
+	rm.Quota = 3500
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	if exists("2018/02/05") || exists("udp/2018/02/05") || !exists("2018/02/06") || !exists("other") {
+		t.Error("Wrong directories deleted for quota")
+	}
+	if rm.Full() {
+		t.Error("Should not be full")
+	}
+	rm.Quota = 2000
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	if !exists("2018/02/06/c.00000.jsonl.zst") || !rm.Full() {
+		t.Error("Should be full, without deleting the current date")
+	}
+
+	// Admit samples new connections while full.
+	if rm.Admit() {
+		t.Error("Should not admit with a zero SampleRate")
+	}
+	rm.SampleRate = 1
+	if !rm.Admit() {
+		t.Error("Should admit with a SampleRate of 1")
+	}
+	rm.Quota = 0
+	rm.MinFree = math.MaxInt64
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	if !rm.Full() {
+		t.Error("Should be full for lack of disk space")
+	}
+}
+
+// gaugeValue returns the value of a gauge.
+func gaugeValue(m prometheus.Metric) float64 {
+	var mm dto.Metric
+	m.Write(&mm)
+	return mm.GetGauge().GetValue()
+}
+
+func TestRetentionOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRetentionOpenFiles")
+	rtx.Must(err, "Could not create tempdir")
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	defer func() {
+		os.RemoveAll(dir)
+		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
+	}()
+	rtx.Must(os.MkdirAll("2018/02/04", 0777), "Could not create dir")
+	rtx.Must(ioutil.WriteFile("2018/02/04/old.00000.jsonl.zst", make([]byte, 1000), 0666), "Could not write file")
+
+	now := time.Date(2018, 02, 06, 12, 0, 0, 0, time.UTC)
+	rm := &saver.RetentionManager{Dir: ".", Quota: 1000000}
+	rtx.Must(rm.Scan(), "Could not scan")
+	sink := saver.FileSink{Retention: rm}
+	// A long-lived connection still writes to the directory of its rotation time.
+	w, err := sink.Open("2018/02/04/a.00000.jsonl.zst")
+	rtx.Must(err, "Could not open")
+	rtx.Must(w.Write(msg(t, 1234, 1).mustAR()), "Could not write")
+
+	// The directory with the open file is not deleted, even over the quota.
+	rm.Quota = 1
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	if _, err := os.Stat("2018/02/04/a.00000.jsonl.zst.partial"); err != nil {
+		t.Error("Should not have deleted the open file", err)
+	}
+	if !rm.Full() {
+		t.Error("Should be full")
+	}
+
+	// Once closed, the bytes written are counted.
+	rtx.Must(w.Close(), "Could not close")
+	info, err := os.Stat("2018/02/04/a.00000.jsonl.zst")
+	rtx.Must(err, "Could not stat")
+	rm.Quota = 1000000
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	if got := gaugeValue(metrics.OutputBytes); got != float64(1000+info.Size()) {
+		t.Error("Wrong output bytes", got, 1000+info.Size())
+	}
+
+	// Then the directory can be deleted, and its bytes are freed.
+	rm.Quota = 1
+	rtx.Must(rm.Enforce(now), "Could not enforce")
+	if _, err := os.Stat("2018/02/04"); !os.IsNotExist(err) {
+		t.Error("Should have deleted 2018/02/04", err)
+	}
+	if got := gaugeValue(metrics.OutputBytes); got != 0 || rm.Full() {
+		t.Error("Should be empty, and not full", got)
+	}
+}
+
+func TestSamplingWhenFull(t *testing.T) {
+	mem := saver.NewMemorySink()
+	events := &countingEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, events, anonymize.None)
+	svr.Sink = mem
+	svr.Retention = &saver.RetentionManager{Dir: ".", MinFree: math.MaxInt64}
+	rtx.Must(svr.Retention.Enforce(time.Now()), "Could not enforce")
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := uint64(0); i < 3; i++ {
+		m := msg(t, 1234, 1).setBytesReceived(1000 * i)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if names := mem.Names(); len(names) != 0 {
+		t.Error("Should not save connections while full", names)
+	}
+	// Events are still reported for connections that are not saved.
+	if events.opens != 1 || events.closes != 1 {
+		t.Error("Wrong events", events.opens, events.closes)
+	}
+}
+
+// slowSink simulates writers that fall behind, e.g. because the disk is slow.
+// Writing each connection record waits until the gate is opened.  Headers and
+// summaries are written right away.
+type slowSink struct {
+	*saver.MemorySink
+	gate chan struct{}
+}
+
+func newSlowSink() *slowSink {
+	return &slowSink{MemorySink: saver.NewMemorySink(), gate: make(chan struct{})}
+}
+
+func (s *slowSink) Open(name string) (netlink.ArchiveWriter, error) {
+	w, err := s.MemorySink.Open(name)
+	return &slowWriter{ArchiveWriter: w, gate: s.gate}, err
+}
+
+type slowWriter struct {
+	netlink.ArchiveWriter
+	gate chan struct{}
+}
+
+func (sw *slowWriter) Write(pm *netlink.ArchivalRecord) error {
+	if pm.RawIDM != nil {
+		<-sw.gate
+	}
+	return sw.ArchiveWriter.Write(pm)
+}
+
+// block returns a MessageBlock with count connections, starting with the given cookie.
+func block(t *testing.T, date time.Time, cookie uint64, count int, received uint64) netlink.MessageBlock {
+	b := netlink.MessageBlock{V4Time: date, V6Time: date}
+	for i := 0; i < count; i++ {
+		m := msg(t, cookie+uint64(i), 1).setBytesReceived(received)
+		b.V4Messages = append(b.V4Messages, &m.NetlinkMessage)
+	}
+	return b
+}
+
+func TestOverloadSample(t *testing.T) {
+	drops := counterValue(metrics.DropCount.WithLabelValues("marshaller"))
+	sink := newSlowSink()
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	svr.Sink = sink
+	svr.Overload = saver.OverloadSample
+	svr.OverloadSampleRate = 0
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// The first connection's record is stuck in the writer, or first in the queue of
+	// 100 tasks, so connections after the first 100 or 101 are not saved.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	svrChan <- block(t, date, 1, 150, 1000)
+	// The second block is only received once the first one is handled.
+	svrChan <- block(t, date.Add(time.Second), 1, 150, 1000)
+	close(sink.gate)
+	close(svrChan)
+	svr.Done.Wait()
+
+	saved := len(sink.Names())
+	if saved < 100 || saved > 101 {
+		t.Error("Wrong number of connections saved:", saved)
+	}
+	if d := counterValue(metrics.DropCount.WithLabelValues("marshaller")) - drops; d != float64(150-saved) {
+		t.Error("Wrong number of drops:", d, "for", saved, "saved")
+	}
+}
+
+// sendFourthBlock sends a block, in a function that blockedIn can find.
+func sendFourthBlock(c chan<- netlink.MessageBlock, b netlink.MessageBlock) {
+	c <- b
+}
+
+// waitFor waits until done returns true, and fails the test if it takes too long.
+func waitFor(t *testing.T, done func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockedIn returns whether a goroutine is waiting to send on a channel in the
+// named function.
+func blockedIn(function string) bool {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "[chan send") && strings.Contains(g, "."+function+"(") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOverloadDrop(t *testing.T) {
+	drops := counterValue(metrics.DropCount.WithLabelValues("saver"))
+	blocked := counterValue(metrics.QueueBlockedSeconds.WithLabelValues("marshaller"))
+	sink := newSlowSink()
+	svr := saver.NewSaver("foo", "bar", 1, &countingEventSocket{}, anonymize.None)
+	svr.Sink = sink
+	svr.Overload = saver.OverloadDrop
+	svrChan := make(chan netlink.MessageBlock, 2)
+	go svr.MessageSaverLoop(svrChan)
+
+	// The Saver gets stuck on the first block, with more records than the
+	// marshaller can queue, while two more blocks fill its queue, and the
+	// collector waits to queue the fourth.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	svrChan <- block(t, date, 1, 102, 1000)
+	waitFor(t, func() bool { return len(svrChan) == 0 && blockedIn("MarshalChan.send") })
+	svrChan <- block(t, date.Add(1*time.Second), 1, 102, 2000)
+	svrChan <- block(t, date.Add(2*time.Second), 1, 102, 3000)
+	fourth := block(t, date.Add(3*time.Second), 1, 102, 4000)
+	sent := make(chan struct{})
+	go func() {
+		sendFourthBlock(svrChan, fourth)
+		close(sent)
+	}()
+	waitFor(t, func() bool { return len(svrChan) == cap(svrChan) && blockedIn("sendFourthBlock") })
+
+	// Once the writer catches up, the second block is dropped, as the collector is
+	// still waiting.  The third is not, as the fourth then fits in the queue.
+	close(sink.gate)
+	<-sent
+	close(svrChan)
+	svr.Done.Wait()
+
+	if d := counterValue(metrics.DropCount.WithLabelValues("saver")) - drops; d != 1 {
+		t.Error("Wrong number of drops:", d)
+	}
+	if counterValue(metrics.QueueBlockedSeconds.WithLabelValues("marshaller")) <= blocked {
+		t.Error("Waiting for the marshaller should be accounted for")
+	}
+	// Each file has the header, three records, and the summary.
+	for _, name := range sink.Names() {
+		records, closed := sink.Records(name)
+		if !closed || len(records) != 5 {
+			t.Error("Wrong records in", name, len(records))
+		}
+	}
+}
+
+func TestStateAndStatsEvents(t *testing.T) {
+	events := &countingEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, events, anonymize.None)
+	svr.Sink = saver.NewMemorySink()
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, state := range []tcp.State{tcp.ESTABLISHED, tcp.ESTABLISHED, tcp.FIN_WAIT1, tcp.FIN_WAIT1} {
+		m := msg(t, 1234, 1).setState(state).setBytesReceived(1000 * uint64(i))
+		// A UDP socket, which gets no events.
+		udp := msg(t, 5678, 2)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		svrChan <- netlink.MessageBlock{Protocol: inetdiag.Protocol_IPPROTO_UDP, V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&udp.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if diff := deep.Equal(events.states, []tcp.State{tcp.FIN_WAIT1}); diff != nil {
+		t.Error(diff)
+	}
+	if len(events.stats) != 4 {
+		t.Fatal("Expected a Stats event for each record:", len(events.stats))
+	}
+	for i, stats := range events.stats {
+		if stats.BytesReceived != 1000*uint64(i) || stats.RTT == 0 || stats.SndCwnd == 0 {
+			t.Errorf("Bad stats %+v", stats)
+		}
+	}
+}
+
+func TestNoEventsForUDP(t *testing.T) {
+	events := &countingEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, events, anonymize.None)
+	svr.Sink = saver.NewMemorySink()
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// A UDP socket that is seen, changes, and then goes away.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		udp := msg(t, 5678, 2).setBytesReceived(1000 * uint64(i))
+		svrChan <- netlink.MessageBlock{Protocol: inetdiag.Protocol_IPPROTO_UDP, V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&udp.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	svrChan <- netlink.MessageBlock{Protocol: inetdiag.Protocol_IPPROTO_UDP, V4Time: date, V6Time: date}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if events.opens != 0 || events.closes != 0 || len(events.states) != 0 || len(events.stats) != 0 {
+		t.Errorf("UDP sockets should have no events: %+v", events)
+	}
+}
+
+// basicEventSocket only implements eventsocket.Server, without the optional
+// interfaces.
+type basicEventSocket struct {
+	opens int
+}
+
+func (*basicEventSocket) Listen() error                                              { return nil }
+func (*basicEventSocket) Serve(context.Context) error                                { return nil }
+func (b *basicEventSocket) FlowCreated(t time.Time, uuid string, id inetdiag.SockID) { b.opens++ }
+func (*basicEventSocket) FlowDeleted(t time.Time, uuid string)                       {}
+
+func TestBasicEventServer(t *testing.T) {
+	events := &basicEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, events, anonymize.None)
+	svr.Sink = saver.NewMemorySink()
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// Servers without the optional interfaces still get Open events.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for _, state := range []tcp.State{tcp.ESTABLISHED, tcp.FIN_WAIT1} {
+		m := msg(t, 1234, 1).setState(state)
+		svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		date = date.Add(time.Second)
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if events.opens != 1 {
+		t.Error("Expected one Open event:", events.opens)
+	}
+}
+
+// gatedWriteCloser blocks every Write until the gate is opened.
+type gatedWriteCloser struct {
+	bufferCloser
+	gate chan struct{}
+}
+
+func (g *gatedWriteCloser) Write(b []byte) (int, error) {
+	<-g.gate
+	return g.bufferCloser.Write(b)
+}
+
+func TestStreamSinkDrops(t *testing.T) {
+	oldQueue := *saver.StreamQueue
+	*saver.StreamQueue = 1
+	defer func() { *saver.StreamQueue = oldQueue }()
+	w := &gatedWriteCloser{gate: make(chan struct{})}
+	sink := saver.NewStreamSink(w)
+	sw, err := sink.Open("foo")
+	rtx.Must(err, "Could not open")
+
+	// Writes do not wait for the reader.  At most one line is being written, and
+	// one queued, so the others are dropped.
+	drops := counterValue(metrics.DropCount.WithLabelValues("stream"))
+	for i := 0; i < 10; i++ {
+		rtx.Must(sw.Write(&netlink.ArchivalRecord{Namespace: "bar"}), "Could not write")
+	}
+	close(w.gate)
+	rtx.Must(sink.Close(), "Could not close")
+	lines := strings.Count(w.String(), "\n")
+	dropped := counterValue(metrics.DropCount.WithLabelValues("stream")) - drops
+	if lines < 1 || lines > 2 || float64(lines)+dropped != 10 {
+		t.Error("Wrong lines and drops:", lines, dropped)
+	}
+	if sw.Write(&netlink.ArchivalRecord{}) == nil {
+		t.Error("Writes should fail after Close")
+	}
+}
+
+func TestStreamSinkReconnects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestStreamSinkReconnects")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", dir+"/sink.sock")
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	sink, err := saver.NewSink("unix:" + dir + "/sink.sock")
+	rtx.Must(err, "Could not create unix sink")
+	c, err := l.Accept()
+	rtx.Must(err, "Could not accept")
+	w, err := sink.Open("foo")
+	rtx.Must(err, "Could not open")
+	rtx.Must(w.Write(&netlink.ArchivalRecord{Namespace: "first"}), "Could not write")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	rtx.Must(err, "Could not read")
+	if !strings.Contains(line, "first") {
+		t.Errorf("Wrong line %q", line)
+	}
+
+	// The reader restarts.  The line written to the old connection is lost, but
+	// the sink reconnects for the next one.
+	c.Close()
+	rtx.Must(w.Write(&netlink.ArchivalRecord{Namespace: "lost"}), "Could not write")
+	rtx.Must(w.Write(&netlink.ArchivalRecord{Namespace: "second"}), "Could not write")
+	c, err = l.Accept()
+	rtx.Must(err, "Could not accept")
+	defer c.Close()
+	line, err = bufio.NewReader(c).ReadString('\n')
+	rtx.Must(err, "Could not read")
+	if !strings.Contains(line, "second") {
+		t.Errorf("Wrong line %q", line)
+	}
+	rtx.Must(sink.Close(), "Could not close")
+}
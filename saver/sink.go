@@ -0,0 +1,345 @@
+package saver
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// SinkSpec is a command-line flag selecting where the Saver writes connection
+// records, as parsed by NewSink.
+var SinkSpec = flag.String("saver.sink", "files", "Where to write connection records: \"files\" for compressed files in date directories, \"stdout\" for a single JSONL stream on stdout, or \"unix:<path>\" for a single JSONL stream to the Unix socket at <path>.")
+
+// StreamQueue is a command-line flag setting how many lines a StreamSink queues
+// for a slow reader, or while it reconnects, before it drops them.
+var StreamQueue = flag.Int("saver.stream-queue", 10000, "For the stdout and unix: sinks, how many records to queue for a slow reader, or while reconnecting, before dropping them.")
+
+// streamRetryInterval is how long a StreamSink waits between attempts to reconnect.
+var streamRetryInterval = time.Second
+
+// ErrUnknownSink is returned by NewSink for specs it does not recognize.
+var ErrUnknownSink = errors.New("unknown sink")
+
+// Sink provides the writers the Saver writes the records of connections to.
+// Writers are used from the marshaller goroutines, so they must be safe to use
+// concurrently with each other.
+type Sink interface {
+	// Open returns a writer for the named connection file, e.g.
+	// 2006/01/02/<uuid>.00000.jsonl.zst.  The name is unique, and its extension
+	// reflects the Format flag.
+	Open(name string) (netlink.ArchiveWriter, error)
+	// Close releases the resources of the sink, after all writers are closed.
+	Close() error
+}
+
+// NewSink returns the Sink described by spec, which is "files", "stdout", or
+// "unix:" followed by the path of a Unix socket to connect to.  The socket must
+// accept the first connection, but if it is lost later, e.g. because the reader
+// restarted, the sink reconnects.
+func NewSink(spec string) (Sink, error) {
+	switch {
+	case spec == "files":
+		return FileSink{}, nil
+	case spec == "stdout":
+		return NewStreamSink(nopCloser{os.Stdout}), nil
+	case strings.HasPrefix(spec, "unix:"):
+		path := strings.TrimPrefix(spec, "unix:")
+		dial := func() (io.WriteCloser, error) {
+			return net.Dial("unix", path)
+		}
+		c, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		return newStreamSink(c, dial, *StreamQueue), nil
+	}
+	return nil, ErrUnknownSink
+}
+
+// Sizer is implemented by writers that can tell how many bytes they have written,
+// after compression.  SizeRotation uses it.
+type Sizer interface {
+	Size() int64
+}
+
+// FileSink writes each connection file to the named path, relative to the
+// working directory, creating directories as needed.  Files are compressed, and
+// have PartialSuffix until they are closed.  In delta mode, records are written
+// as deltas.  If Retention is set, the writers report the files they open, and
+// the bytes they write, to it.
+type FileSink struct {
+	Retention *RetentionManager
+}
+
+// Open creates the named file.
+func (fs FileSink) Open(name string) (netlink.ArchiveWriter, error) {
+	var dir *dateDir
+	if fs.Retention != nil {
+		var err error
+		dir, err = fs.Retention.opened(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := os.MkdirAll(filepath.Dir(name), 0777)
+	var w *finalizingWriter
+	if err == nil {
+		w, err = newFinalizingWriter(name)
+	}
+	if err != nil {
+		if fs.Retention != nil {
+			fs.Retention.closed(dir)
+		}
+		return nil, err
+	}
+	w.rm, w.dir = fs.Retention, dir
+	aw, err := newArchiveWriter(w, name)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if *Delta {
+		aw = netlink.NewDeltaWriter(aw, *KeyframeInterval)
+	}
+	return &fileWriter{aw, w}, nil
+}
+
+// Close does nothing, as each file is closed by its writer.
+func (FileSink) Close() error {
+	return nil
+}
+
+// fileWriter is the ArchiveWriter of a FileSink.
+type fileWriter struct {
+	netlink.ArchiveWriter
+	file *finalizingWriter
+}
+
+// Size returns the size of the file so far.  As the compressor buffers data, the
+// last few records are usually not included.
+func (fw *fileWriter) Size() int64 {
+	return fw.file.Size()
+}
+
+// StreamRecord is a line of the stream written by a StreamSink.  Every record of
+// a connection file is written with the Name of the file, followed by a line with
+// Closed set when the file is closed.
+type StreamRecord struct {
+	Name   string
+	Record *netlink.ArchivalRecord `json:",omitempty"`
+	Closed bool                    `json:",omitempty"`
+}
+
+// StreamSink multiplexes all connection files into a single JSONL stream of
+// StreamRecords.  Records are never written as deltas.  Lines are queued, and
+// written by a goroutine of its own, so that a slow reader does not hold up the
+// marshallers.  When the queue is full, lines are dropped.
+type StreamSink struct {
+	mutex  sync.RWMutex // Held for writing only to close lines.
+	closed bool
+	lines  chan []byte
+	stop   chan struct{} // Closed to stop reconnecting.
+	done   chan struct{} // Closed when all lines are written, or dropped.
+
+	w    io.WriteCloser                 // Only used by run, nil while disconnected.
+	dial func() (io.WriteCloser, error) // Reconnects after errors, if not nil.
+}
+
+// NewStreamSink returns a StreamSink writing to w, queueing up to the
+// -saver.stream-queue flag lines.
+func NewStreamSink(w io.WriteCloser) *StreamSink {
+	return newStreamSink(w, nil, *StreamQueue)
+}
+
+func newStreamSink(w io.WriteCloser, dial func() (io.WriteCloser, error), size int) *StreamSink {
+	s := &StreamSink{
+		lines: make(chan []byte, size),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		w:     w,
+		dial:  dial,
+	}
+	go s.run()
+	return s
+}
+
+func (s *StreamSink) write(sr *StreamRecord) error {
+	b, err := json.Marshal(sr)
+	if err != nil {
+		return err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return errors.New("stream sink closed")
+	}
+	select {
+	case s.lines <- append(b, '\n'):
+	default:
+		metrics.DropCount.WithLabelValues("stream").Inc()
+	}
+	return nil
+}
+
+// run writes the queued lines until the queue is closed.  After a write fails,
+// the line is dropped, and the sink reconnects, if it can, before writing more.
+func (s *StreamSink) run() {
+	defer close(s.done)
+	for line := range s.lines {
+		metrics.QueueDepth.WithLabelValues("stream").Set(float64(len(s.lines)))
+		if s.w == nil && !s.reconnect() {
+			metrics.DropCount.WithLabelValues("stream").Inc()
+			continue
+		}
+		_, err := s.w.Write(line)
+		if err != nil {
+			log.Println("Stream sink write failed:", err)
+			metrics.DropCount.WithLabelValues("stream").Inc()
+			if s.dial != nil {
+				s.w.Close()
+				s.w = nil
+			}
+		}
+	}
+}
+
+// reconnect waits until the sink is connected again, and returns true, or returns
+// false once the sink is closed.
+func (s *StreamSink) reconnect() bool {
+	for {
+		w, err := s.dial()
+		if err == nil {
+			log.Println("Stream sink reconnected")
+			s.w = w
+			return true
+		}
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(streamRetryInterval):
+		}
+	}
+}
+
+// Open returns a writer that writes records with the given name to the stream.
+func (s *StreamSink) Open(name string) (netlink.ArchiveWriter, error) {
+	return &streamWriter{sink: s, name: name}, nil
+}
+
+// Close writes the queued lines, and closes the underlying writer.  Lines still
+// queued while the sink is disconnected are dropped.
+func (s *StreamSink) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	close(s.lines)
+	s.mutex.Unlock()
+	<-s.done
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Close()
+}
+
+type streamWriter struct {
+	sink *StreamSink
+	name string
+}
+
+func (sw *streamWriter) Write(pm *netlink.ArchivalRecord) error {
+	return sw.sink.write(&StreamRecord{Name: sw.name, Record: pm})
+}
+
+func (sw *streamWriter) Close() error {
+	return sw.sink.write(&StreamRecord{Name: sw.name, Closed: true})
+}
+
+// MemorySink keeps all records in memory, by file name.  It is intended for tests.
+type MemorySink struct {
+	mutex  sync.Mutex
+	files  map[string][]*netlink.ArchivalRecord
+	closed map[string]bool
+}
+
+// NewMemorySink returns an empty MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{
+		files:  make(map[string][]*netlink.ArchivalRecord),
+		closed: make(map[string]bool),
+	}
+}
+
+// Open returns a writer that appends copies of the records to the named file.
+func (m *MemorySink) Open(name string) (netlink.ArchiveWriter, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.files[name] = []*netlink.ArchivalRecord{}
+	return &memoryWriter{sink: m, name: name}, nil
+}
+
+// Close does nothing.
+func (m *MemorySink) Close() error {
+	return nil
+}
+
+// Names returns the names of all the files opened so far.
+func (m *MemorySink) Names() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Records returns the records written to the named file, and whether its writer
+// has been closed.
+func (m *MemorySink) Records(name string) ([]*netlink.ArchivalRecord, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.files[name], m.closed[name]
+}
+
+type memoryWriter struct {
+	sink *MemorySink
+	name string
+}
+
+func (mw *memoryWriter) Write(pm *netlink.ArchivalRecord) error {
+	// The Saver may reuse the record data.
+	pm = pm.Clone()
+	mw.sink.mutex.Lock()
+	defer mw.sink.mutex.Unlock()
+	mw.sink.files[mw.name] = append(mw.sink.files[mw.name], pm)
+	return nil
+}
+
+func (mw *memoryWriter) Close() error {
+	mw.sink.mutex.Lock()
+	defer mw.sink.mutex.Unlock()
+	mw.sink.closed[mw.name] = true
+	return nil
+}
+
+// nopCloser keeps a StreamSink from closing stdout.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -43,7 +43,11 @@ func Decode(ar *netlink.ArchivalRecord) (*netlink.Metadata, *Snapshot, error) {
 		case inetdiag.INET_DIAG_MEMINFO:
 			result.MemInfo, ok = rta.toMemInfo()
 		case inetdiag.INET_DIAG_INFO:
-			result.TCPInfo, ok = rta.toLinuxTCPInfo()
+			// Other protocols have no TCPInfo.  Their protocol specific info, e.g.
+			// struct sctp_info, is not decoded.
+			if ar.IsTCP() {
+				result.TCPInfo, ok = rta.toLinuxTCPInfo()
+			}
 		case inetdiag.INET_DIAG_VEGASINFO:
 			result.VegasInfo, ok = rta.toVegasInfo()
 		case inetdiag.INET_DIAG_CONG:
@@ -86,6 +90,9 @@ func Decode(ar *netlink.ArchivalRecord) (*netlink.Metadata, *Snapshot, error) {
 			result.NotFullyParsed |= bit
 		}
 	}
+	if !ar.IsTCP() {
+		result.Protocol = ar.Protocol
+	}
 	return ar.Metadata, &result, nil
 }
 
@@ -240,7 +247,7 @@ type Snapshot struct {
 
 	Mark uint32 `csv:",omitempty"`
 
-	// TCPInfo contains data from struct tcp_info.
+	// TCPInfo contains data from struct tcp_info.  It is nil for protocols other than TCP.
 	TCPInfo *tcp.LinuxTCPInfo `csv:"-"`
 
 	// Data obtained from INET_DIAG_MEMINFO.
@@ -272,9 +279,13 @@ func NewReader(ar netlink.ArchiveReader) *Reader {
 
 var zeroTime = time.Time{}
 
-// Next reads, parses and returns the next Snapshot
+// Next reads, parses and returns the next Snapshot.  Records that only mark
+// the end of a file, with a CloseReason, are skipped.
 func (rdr Reader) Next() (*netlink.Metadata, *Snapshot, error) {
 	ar, err := rdr.archiveReader.Next()
+	for err == nil && ar.CloseReason != "" && ar.RawIDM == nil && ar.Metadata == nil {
+		ar, err = rdr.archiveReader.Next()
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -23,7 +23,8 @@ func init() {
 func TestRawReader(t *testing.T) {
 	source := "testdata/testdata.zst"
 	t.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	defer rdr.Close()
 	arReader := netlink.NewRawReader(rdr)
 	snReader := snapshot.NewReader(arReader)
@@ -56,7 +57,8 @@ func TestRawReader(t *testing.T) {
 func TestDecodeArchiveRecords(t *testing.T) {
 	source := "testdata/archiveRecords.zst"
 	t.Log("Reading messages from", source)
-	rdr := zstd.NewReader(source)
+	rdr, err := zstd.NewReader(source)
+	rtx.Must(err, "Could not open %s", source)
 	defer rdr.Close()
 	arReader := netlink.NewArchiveReader(rdr)
 	snapReader := snapshot.NewReader(arReader)
@@ -92,7 +94,8 @@ func TestBCNFile(t *testing.T) {
 	src := "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"
 
 	log.Println("Reading messages from", src)
-	rdr := zstd.NewReader(src)
+	rdr, err := zstd.NewReader(src)
+	rtx.Must(err, "Could not open %s", src)
 	defer rdr.Close()
 	arReader := netlink.NewArchiveReader(rdr)
 	snapReader := snapshot.NewReader(arReader)
@@ -132,7 +135,8 @@ func TestLoadAll(t *testing.T) {
 	src := "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"
 
 	log.Println("Reading messages from", src)
-	rdr := zstd.NewReader(src)
+	rdr, err := zstd.NewReader(src)
+	rtx.Must(err, "Could not open %s", src)
 	defer rdr.Close()
 	arReader := netlink.NewArchiveReader(rdr)
 
@@ -149,3 +153,68 @@ func TestLoadAll(t *testing.T) {
 	}
 
 }
+
+// recordReader is an ArchiveReader for a slice of records.
+type recordReader []*netlink.ArchivalRecord
+
+func (rr *recordReader) Next() (*netlink.ArchivalRecord, error) {
+	if len(*rr) == 0 {
+		return nil, io.EOF
+	}
+	ar := (*rr)[0]
+	*rr = (*rr)[1:]
+	return ar, nil
+}
+
+func TestLoadAllSkipsCloseRecords(t *testing.T) {
+	src := "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"
+	rdr, err := zstd.NewReader(src)
+	rtx.Must(err, "Could not open %s", src)
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read records")
+	rr := recordReader(append(records, &netlink.ArchivalRecord{CloseReason: netlink.CloseReasonShutdown}))
+
+	_, all, err := snapshot.LoadAll(&rr)
+	rtx.Must(err, "Could not load snapshots")
+	if len(all) != 151 {
+		t.Error("Wrong count:", len(all))
+	}
+}
+
+func TestDecodeOtherProtocols(t *testing.T) {
+	src := "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"
+	rdr, err := zstd.NewReader(src)
+	rtx.Must(err, "Could not open %s", src)
+	defer rdr.Close()
+	records, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not read records")
+	ar := records[1]
+	if !ar.HasDiagInfo() || ar.Attributes[inetdiag.INET_DIAG_INFO] == nil {
+		t.Fatal("Test record should have TCPInfo")
+	}
+
+	// SCTP has a protocol specific INET_DIAG_INFO, which must not be decoded as TCPInfo.
+	ar.Protocol = inetdiag.Protocol_IPPROTO_SCTP
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode SCTP record")
+	if snap.TCPInfo != nil || snap.Protocol != inetdiag.Protocol_IPPROTO_SCTP {
+		t.Error("Bad SCTP snapshot", snap.TCPInfo, snap.Protocol)
+	}
+	infoBit := uint32(1) << (inetdiag.INET_DIAG_INFO - 1)
+	if snap.Observed&infoBit == 0 || snap.NotFullyParsed&infoBit == 0 {
+		t.Errorf("INET_DIAG_INFO should be observed but not parsed %x %x", snap.Observed, snap.NotFullyParsed)
+	}
+
+	// UDP has no INET_DIAG_INFO at all.
+	ar.Protocol = inetdiag.Protocol_IPPROTO_UDP
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = nil
+	_, snap, err = snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode UDP record")
+	if snap.TCPInfo != nil || snap.Protocol != inetdiag.Protocol_IPPROTO_UDP || snap.InetDiagMsg == nil {
+		t.Error("Bad UDP snapshot", snap)
+	}
+	if snap.NotFullyParsed != 0 {
+		t.Errorf("Problems %0X\n", snap.NotFullyParsed)
+	}
+}
@@ -129,3 +129,26 @@ type LinuxTCPInfo struct {
 	DSackDups uint32 `csv:"TCP.DSackDups"` /* RFC4898 tcpEStatsStackDSACKDups */
 	ReordSeen uint32 `csv:"TCP.ReordSeen"` /* reordering events seen */
 }
+
+// Counters are the counters of a LinuxTCPInfo that are unsigned in linux, but
+// signed in LinuxTCPInfo.
+type Counters struct {
+	BytesAcked    uint64
+	BytesReceived uint64
+	BytesSent     uint64
+	DeliveryRate  uint64
+	SegsOut       uint32
+	SegsIn        uint32
+}
+
+// Counters returns the unsigned values of the counters, as linux reports them.
+func (info *LinuxTCPInfo) Counters() Counters {
+	return Counters{
+		BytesAcked:    uint64(info.BytesAcked),
+		BytesReceived: uint64(info.BytesReceived),
+		BytesSent:     uint64(info.BytesSent),
+		DeliveryRate:  uint64(info.DeliveryRate),
+		SegsOut:       uint32(info.SegsOut),
+		SegsIn:        uint32(info.SegsIn),
+	}
+}
@@ -35,3 +35,12 @@ func TestState_String(t *testing.T) {
 		})
 	}
 }
+
+func TestLinuxTCPInfo_Counters(t *testing.T) {
+	// Counters past the int64 range are reported as negative in LinuxTCPInfo.
+	info := tcp.LinuxTCPInfo{BytesAcked: -1, BytesReceived: 2, BytesSent: 3, DeliveryRate: 4, SegsOut: -1, SegsIn: 6}
+	want := tcp.Counters{BytesAcked: ^uint64(0), BytesReceived: 2, BytesSent: 3, DeliveryRate: 4, SegsOut: ^uint32(0), SegsIn: 6}
+	if got := info.Counters(); got != want {
+		t.Errorf("LinuxTCPInfo.Counters() = %+v, want %+v", got, want)
+	}
+}
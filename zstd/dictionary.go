@@ -0,0 +1,179 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/m-lab/go/flagx"
+)
+
+// DictionaryID is the zstd dictionary ID written in the frame header of files
+// compressed with the built-in dictionary, which is dictionary version 0.
+// Trained dictionaries have later versions, and the ID of version v is
+// DictionaryID + v.  IDs below 32768 are reserved by the zstd format for
+// registered dictionaries.
+const DictionaryID uint32 = 32768
+
+const (
+	// dictionaryMagic starts every dictionary in the zstd dictionary format.
+	dictionaryMagic = 0xEC30A437
+	// maxDictionaryVersion keeps dictionary IDs below 2^31, as recommended by
+	// the zstd format.
+	maxDictionaryVersion = 1<<31 - 1 - int(DictionaryID)
+)
+
+// Errors returned when adding or using dictionaries.
+var (
+	ErrNotDictionary        = errors.New("not a zstd dictionary")
+	ErrBadDictionaryVersion = errors.New("dictionary ID is not a valid dictionary version")
+	ErrDuplicateDictionary  = errors.New("a different dictionary with the same version was already added")
+	ErrUnknownDictionary    = errors.New("file was compressed with an unknown dictionary version")
+	ErrNoTrainingSamples    = errors.New("no samples to train the dictionary")
+	ErrTrainingFailed       = errors.New("the trained dictionary is unusable")
+)
+
+// DictionaryFiles is a command-line flag listing trained dictionaries, made by
+// cmd/dicttool, that are loaded by LoadDictionaries.
+var DictionaryFiles flagx.StringArray
+
+// dictionaries holds the trained dictionaries by version.
+var dictionaries = struct {
+	sync.Mutex
+	byVersion map[int][]byte
+	newest    int
+}{byVersion: map[int][]byte{}}
+
+func init() {
+	flag.Var(&DictionaryFiles, "zstd.dictionary-file", "A trained dictionary, made by cmd/dicttool, used to read files.  The newest version is also used to write files when -zstd.dictionary is set.  May be repeated.")
+}
+
+// DictionaryIDForVersion returns the dictionary ID of a dictionary version.
+func DictionaryIDForVersion(version int) uint32 {
+	return DictionaryID + uint32(version)
+}
+
+// DictionaryVersion returns the version of a dictionary ID, or false if it is
+// not one of ours.
+func DictionaryVersion(id uint32) (int, bool) {
+	if id < DictionaryID || int(id-DictionaryID) > maxDictionaryVersion {
+		return 0, false
+	}
+	return int(id - DictionaryID), true
+}
+
+// AddDictionary makes a trained dictionary, in the zstd dictionary format,
+// available for reading, and for writing if it is the newest version.  It
+// returns the dictionary version.
+func AddDictionary(d []byte) (int, error) {
+	if len(d) < 8 || binary.LittleEndian.Uint32(d) != dictionaryMagic {
+		return 0, ErrNotDictionary
+	}
+	version, ok := DictionaryVersion(binary.LittleEndian.Uint32(d[4:]))
+	if !ok || version == 0 {
+		return 0, ErrBadDictionaryVersion
+	}
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	if old, ok := dictionaries.byVersion[version]; ok && string(old) != string(d) {
+		return 0, ErrDuplicateDictionary
+	}
+	dictionaries.byVersion[version] = d
+	if version > dictionaries.newest {
+		dictionaries.newest = version
+	}
+	return version, nil
+}
+
+// LoadDictionaries adds the dictionaries listed by the -zstd.dictionary-file
+// flag.  It should be called after flag parsing.
+func LoadDictionaries() error {
+	for _, fn := range DictionaryFiles {
+		d, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		_, err = AddDictionary(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newestDictionary returns the trained dictionary with the highest version, or
+// nil if there are none.
+func newestDictionary() []byte {
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	return dictionaries.byVersion[dictionaries.newest]
+}
+
+// knownDictionary returns whether files using the dictionary ID can be read.
+func knownDictionary(id uint32) bool {
+	if id == 0 || id == DictionaryID {
+		return true
+	}
+	version, ok := DictionaryVersion(id)
+	if !ok {
+		return false
+	}
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	_, ok = dictionaries.byVersion[version]
+	return ok
+}
+
+// trainedDictionaries returns all trained dictionaries.
+func trainedDictionaries() [][]byte {
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	all := make([][]byte, 0, len(dictionaries.byVersion))
+	for _, d := range dictionaries.byVersion {
+		all = append(all, d)
+	}
+	return all
+}
+
+// TrainDictionary trains a dictionary with at most size bytes of content from
+// samples, which should be the uncompressed contents of typical connection
+// files.  The
+// returned dictionary is in the zstd dictionary format, so it can also be used
+// with the zstd command, e.g. zstd -D.
+func TrainDictionary(samples [][]byte, version int, size int) ([]byte, error) {
+	if version < 1 || version > maxDictionaryVersion {
+		return nil, ErrBadDictionaryVersion
+	}
+	if len(samples) == 0 {
+		return nil, ErrNoTrainingSamples
+	}
+	d, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: size,
+		HashBytes:   6,
+		ZstdDictID:  DictionaryIDForVersion(version),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(d) < 8 {
+		return nil, ErrTrainingFailed
+	}
+	return d, nil
+}
+
+// dictionary is the content of the built-in raw dictionary.  It holds a
+// connection file header and two ArchivalRecord lines, taken from
+// netlink/testdata with the addresses and ports removed, which lets the first
+// lines of a new file refer back to the field names and common attribute
+// encodings instead of spelling them out.
+//
+// The content must never change, as files that were written with it can only
+// be read with the same content.  New dictionaries are trained ones, with later
+// versions.
+var dictionary = []byte(`{"Timestamp":"0001-01-01T00:00:00Z","Metadata":{"UUID":"host_1500000000_0000000000000000","Sequence":0,"StartTime":"2019-07-01T00:00:12.092Z"}}
+{"Timestamp":"2019-07-01T00:00:12.092Z","RawIDM":"CgEBAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAFYBAAAAAAAA5hcAAAAAAABZMC1W","Attributes":[null,"AAAAAPYkAAAKCwAAAAAAAA==","AQAAAAAGeACI4wcAQJwAALQFAAAYAgAABQAAAAAAAAAAAAAAAAAAAAAAAAAFAAAAAAAAAAgAAAAIAAAA3AUAAEB2AADDoAIAYVABAP///38KAAAAtAUAAAMAAAAAAAAAEHIAAAAAAABHlgIAAAAAAP//////////AAAAAAAAAAAFAgAAAAAAAAYAAAADAAAAAAAAAMOgAgABAAAABQAAAAAAAAAAAAAAiBMAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAAAAAAAADmFwAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",null,"Y3ViaWMA","AA==","AA==","AAAAAIB6BQAAAAAAALQAAAoLAAD2JAAAAAAAAAAAAAAAAAAA","AA=="]}
+{"Timestamp":"2019-07-01T00:00:17.662Z","RawIDM":"CgEBAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAEsAAAAAAAAAtGsCAAAAAABZMC1W","Attributes":[null,"AAAAALSdAgBM0gAAAAAAAA==","AQAAAAAGeABorQMAQJwAALQFAABXAgAACgAAAAAAAAAAAAAAAAAAAAAAAAAJAAAAAAAAAMMUAAAJAAAA3AUAAO56AACOnwAAww0AACYAAAApAAAAtAUAAAMAAAAAAAAAEHIAAAIAAABn1RoAAAAAAP//////////RjUaAAAAAAC5BAAAAAAAAD8FAAB7AgAArDICACQlAAADAAAAPgUAAOzCBQAAAAAAiAlVAAAAAAAg8U0AAAAAAAAAAAAAAAAANQUAAAAAAACadBoAAAAAAEwGAAAAAAAAAgAAAAAAAAA=",null,"Y3ViaWMA","AA==","AA==","AAAAAIB6BQAAAAAAAOICAEzSAAC0nQIAAAAAAAAAAAAAAAAA","AA=="]}
+`)
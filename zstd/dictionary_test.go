@@ -0,0 +1,164 @@
+package zstd_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	kzstd "github.com/klauspost/compress/zstd"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// samples splits a file of records from many connections into short ones of
+// three lines each, as most connection files are short.  The records are not
+// those the built-in dictionary was taken from, so that a dictionary trained on
+// them should do better.
+func samples() [][]byte {
+	r, err := zstd.NewReader("../netlink/testdata/archiveRecords.jsonl.zst")
+	rtx.Must(err, "Could not open testdata")
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	rtx.Must(err, "Could not read testdata")
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	result := [][]byte{}
+	for i := 0; i+3 < len(lines); i += 3 {
+		result = append(result, bytes.Join(lines[i:i+3], nil))
+	}
+	return result
+}
+
+// dictionaryID returns the dictionary ID in the frame header of fn.
+func dictionaryID(fn string) uint32 {
+	b, err := ioutil.ReadFile(fn)
+	rtx.Must(err, "Could not read %s", fn)
+	var h kzstd.Header
+	rtx.Must(h.Decode(b), "Could not decode header of %s", fn)
+	return h.DictionaryID
+}
+
+func TestTrainedDictionary(t *testing.T) {
+	zstd.ResetDictionaries()
+	defer zstd.ResetDictionaries()
+	tmpdir, err := ioutil.TempDir("", "TestTrainedDictionary")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tmpdir)
+
+	s := samples()
+	// Test on every tenth sample, and train on the others.  A single sample is
+	// too small for the sizes to reliably differ, as training is not
+	// deterministic.
+	var training, heldOut [][]byte
+	for i := range s {
+		if i%10 == 9 {
+			heldOut = append(heldOut, s[i])
+		} else {
+			training = append(training, s[i])
+		}
+	}
+	dict, err := zstd.TrainDictionary(training, 1, 4096)
+	rtx.Must(err, "Could not train dictionary")
+	data := heldOut[0]
+
+	// write writes each held out sample to fn, and returns their total compressed
+	// size.  The first one is left in fn.
+	write := func(fn string) int64 {
+		total := int64(0)
+		for i := len(heldOut) - 1; i >= 0; i-- {
+			w, err := zstd.NewWriter(fn)
+			rtx.Must(err, "Could not create %s", fn)
+			_, err = w.Write(heldOut[i])
+			rtx.Must(err, "Could not write %s", fn)
+			rtx.Must(w.Close(), "Could not close %s", fn)
+			info, err := os.Stat(fn)
+			rtx.Must(err, "Could not stat %s", fn)
+			total += info.Size()
+		}
+		return total
+	}
+	plain := write(tmpdir + "/plain.zst")
+	*zstd.UseDictionary = true
+	defer func() { *zstd.UseDictionary = false }()
+	builtin := write(tmpdir + "/builtin.zst")
+	if dictionaryID(tmpdir+"/builtin.zst") != zstd.DictionaryID {
+		t.Error("Should use the built-in dictionary before any are added")
+	}
+
+	// Dictionaries are loaded from the files named by the flag.
+	rtx.Must(ioutil.WriteFile(tmpdir+"/v1.dict", dict, 0644), "Could not write dictionary")
+	rtx.Must(zstd.DictionaryFiles.Set(tmpdir+"/v1.dict"), "Could not set flag")
+	defer func() { zstd.DictionaryFiles = nil }()
+	rtx.Must(zstd.LoadDictionaries(), "Could not load dictionaries")
+
+	trained := write(tmpdir + "/trained.zst")
+	if id := dictionaryID(tmpdir + "/trained.zst"); id != zstd.DictionaryIDForVersion(1) {
+		t.Error("Wrong dictionary ID", id)
+	}
+	if version, ok := zstd.DictionaryVersion(zstd.DictionaryIDForVersion(1)); !ok || version != 1 {
+		t.Error("Wrong version", version, ok)
+	}
+	if builtin >= plain {
+		t.Errorf("The built-in dictionary should help: %d bytes with it, %d without", builtin, plain)
+	}
+	if trained >= builtin {
+		t.Errorf("The trained dictionary should be better: %d bytes with it, %d with the built-in one", trained, builtin)
+	}
+
+	for _, fn := range []string{"/builtin.zst", "/trained.zst"} {
+		r, err := zstd.NewReader(tmpdir + fn)
+		rtx.Must(err, "Could not open %s", fn)
+		read, err := ioutil.ReadAll(r)
+		rtx.Must(err, "Could not read %s", fn)
+		r.Close()
+		if !bytes.Equal(read, data) {
+			t.Error("Data mismatch in", fn)
+		}
+	}
+
+	// Adding the same dictionary again is fine, but not a different one with
+	// the same version.
+	_, err = zstd.AddDictionary(dict)
+	rtx.Must(err, "Could not add the dictionary again")
+	other, err := zstd.TrainDictionary(s[:2], 1, 4096)
+	rtx.Must(err, "Could not train dictionary")
+	if _, err = zstd.AddDictionary(other); err != zstd.ErrDuplicateDictionary {
+		t.Error("Expected ErrDuplicateDictionary, got", err)
+	}
+
+	// A file using a dictionary that has not been added can not be read.
+	unknown, err := zstd.TrainDictionary(s[:2], 2, 4096)
+	rtx.Must(err, "Could not train dictionary")
+	enc, err := kzstd.NewWriter(nil, kzstd.WithEncoderDict(unknown))
+	rtx.Must(err, "Could not create encoder")
+	rtx.Must(ioutil.WriteFile(tmpdir+"/unknown.zst", enc.EncodeAll(data, nil), 0644), "Could not write file")
+	if _, err = zstd.NewReader(tmpdir + "/unknown.zst"); err != zstd.ErrUnknownDictionary {
+		t.Error("Expected ErrUnknownDictionary, got", err)
+	}
+}
+
+func TestDictionaryErrors(t *testing.T) {
+	if _, err := zstd.TrainDictionary(nil, 1, 4096); err != zstd.ErrNoTrainingSamples {
+		t.Error("Expected ErrNoTrainingSamples, got", err)
+	}
+	if _, err := zstd.TrainDictionary(samples(), 0, 4096); err != zstd.ErrBadDictionaryVersion {
+		t.Error("Expected ErrBadDictionaryVersion, got", err)
+	}
+	if _, err := zstd.AddDictionary([]byte("not a dictionary")); err != zstd.ErrNotDictionary {
+		t.Error("Expected ErrNotDictionary, got", err)
+	}
+	// A dictionary with the ID of the built-in one.
+	d := []byte{0x37, 0xA4, 0x30, 0xEC, 0x00, 0x80, 0x00, 0x00}
+	if _, err := zstd.AddDictionary(d); err != zstd.ErrBadDictionaryVersion {
+		t.Error("Expected ErrBadDictionaryVersion, got", err)
+	}
+	if _, ok := zstd.DictionaryVersion(12345); ok {
+		t.Error("IDs below DictionaryID are not versions")
+	}
+
+	zstd.DictionaryFiles = []string{"/this/file/does/not/exist"}
+	defer func() { zstd.DictionaryFiles = nil }()
+	if zstd.LoadDictionaries() == nil {
+		t.Error("Should fail to load a nonexistent file")
+	}
+}
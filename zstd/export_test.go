@@ -0,0 +1,9 @@
+package zstd
+
+// ResetDictionaries removes all trained dictionaries, for tests.
+func ResetDictionaries() {
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	dictionaries.byVersion = map[int][]byte{}
+	dictionaries.newest = 0
+}
@@ -1,14 +1,21 @@
-// Package zstd provides utilities for connecting to external zStandard compression tasks.
+// Package zstd provides zStandard compressed readers and writers for files.
+// By default the compression runs in-process, using a pure Go implementation.
+// The original implementation, piping through an external zstd process, can
+// still be selected with the -zstd.implementation flag.
 package zstd
 
 import (
+	"errors"
+	"flag"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
 
-	"github.com/m-lab/go/rtx"
+	kzstd "github.com/klauspost/compress/zstd"
+	"github.com/m-lab/go/flagx"
 )
 
 // Variables to allow whitebox mocking for testing error conditions.
@@ -17,29 +24,203 @@ var (
 	zstdCommand = "zstd"
 )
 
-// NewReader creates a reader piped to external zstd process reading from file.
-// This function is only expected to be used for tests, so all errors are fatal.
+var (
+	// Implementation is a command-line flag selecting whether files are
+	// compressed in-process ("go"), or by an external zstd process ("external").
+	Implementation = flagx.Enum{
+		Options: []string{"go", "external"},
+		Value:   "go",
+	}
+
+	// UseDictionary is a command-line flag enabling compression with a
+	// dictionary for ArchivalRecord JSONL.  The newest trained dictionary is
+	// used, or the built-in one if none were loaded.
+	UseDictionary = flag.Bool("zstd.dictionary", false, "Compress new files with the newest dictionary for ArchivalRecord JSONL, from -zstd.dictionary-file, or the built-in one.  Such files can only be read by the go implementation, or with the dictionary, e.g. zstd -D.")
+
+	// ErrDictionaryNotSupported is returned when the external implementation is
+	// asked to use the dictionary.
+	ErrDictionaryNotSupported = errors.New("the external zstd implementation does not support the dictionary")
+)
+
+// windowSize limits the memory used by each writer, as there is one writer for
+// every open connection.  Connection files are rarely larger than this.
+const windowSize = 256 * 1024
+
+func init() {
+	flag.Var(&Implementation, "zstd.implementation", "Which zstd implementation to use, \"go\" for in-process compression, or \"external\" to pipe through the zstd binary.")
+}
+
+func external() bool {
+	return Implementation.Value == "external"
+}
+
+// NewReader opens filename and returns a reader of the decompressed contents.
+// Files written with the built-in dictionary, or a dictionary that was added,
+// are decompressed using it.  ErrUnknownDictionary is returned for files that
+// need some other dictionary.
 //
-// Users of this function should read from the returned pipe and close it when
+// Users of this function should read from the returned reader and close it when
 // done.
-// TODO return errors
-func NewReader(filename string) io.ReadCloser {
-	pipeR, pipeW, err := osPipe()
-	rtx.Must(err, "Could not call os.Pipe. Something is very wrong.")
+func NewReader(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if external() {
+		return newProcessReader(f)
+	}
+	// Check the dictionary ID in the frame header, so that a missing dictionary
+	// is reported here rather than on the first read.
+	var h kzstd.Header
+	buf := make([]byte, kzstd.HeaderMaxSize)
+	n, _ := f.ReadAt(buf, 0)
+	if h.Decode(buf[:n]) == nil && !knownDictionary(h.DictionaryID) {
+		f.Close()
+		return nil, ErrUnknownDictionary
+	}
+	d, err := kzstd.NewReader(f,
+		kzstd.WithDecoderConcurrency(1),
+		kzstd.WithDecoderLowmem(true),
+		kzstd.WithDecoderDictRaw(DictionaryID, dictionary),
+		kzstd.WithDecoderDicts(trainedDictionaries()...))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &decoder{d, f}, nil
+}
 
-	cmd := exec.Command(zstdCommand, "-d", "-c", filename)
-	cmd.Stdout = pipeW
+// decoder closes the file along with the decoder.
+type decoder struct {
+	*kzstd.Decoder
+	f *os.File
+}
 
-	f, err := os.Open(filename)
-	rtx.Must(err, "Cloud not open file %q for zstd", filename)
-	f.Close()
+func (d *decoder) Close() error {
+	d.Decoder.Close()
+	return d.f.Close()
+}
 
-	go func() {
-		rtx.Must(cmd.Run(), "ZSTD error for file %q", filename)
-		pipeW.Close()
-	}()
+// processReader reads the output of an external zstd process.
+type processReader struct {
+	io.ReadCloser
+	f    *os.File
+	cmd  *exec.Cmd
+	once sync.Once
+	err  error
+}
+
+func newProcessReader(f *os.File) (io.ReadCloser, error) {
+	cmd := exec.Command(zstdCommand, "-d", "-c")
+	cmd.Stdin = f
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &processReader{ReadCloser: out, f: f, cmd: cmd}, nil
+}
 
-	return pipeR
+func (p *processReader) wait() error {
+	p.once.Do(func() {
+		p.err = p.cmd.Wait()
+		p.f.Close()
+	})
+	return p.err
+}
+
+// Read returns the error from the zstd process, if any, in place of io.EOF.
+func (p *processReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	if err == io.EOF {
+		if werr := p.wait(); werr != nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// Close stops reading, and waits for the zstd process to exit.  The process
+// fails if it still had output to write, so its error is not reported here.
+func (p *processReader) Close() error {
+	err := p.ReadCloser.Close()
+	p.wait()
+	return err
+}
+
+// encoder closes the file after flushing the encoder.
+type encoder struct {
+	*kzstd.Encoder
+	f *countingFile
+}
+
+// countingFile counts the bytes written to a file.
+type countingFile struct {
+	n int64 // Accessed atomically, and first, so that it is aligned.
+	*os.File
+}
+
+func (cf *countingFile) Write(b []byte) (int, error) {
+	n, err := cf.File.Write(b)
+	atomic.AddInt64(&cf.n, int64(n))
+	return n, err
+}
+
+// Size returns the compressed bytes written to the file so far.  As the encoder
+// buffers data, the last few writes are usually not included.  It is safe to
+// call concurrently with Write.
+func (e *encoder) Size() int64 {
+	return atomic.LoadInt64(&e.f.n)
+}
+
+func (e *encoder) Close() error {
+	err := e.Encoder.Close()
+	ferr := e.f.Close()
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+// NewWriter creates a writer that compresses all writes to filename.  Upon
+// Close(), the returned WriteCloser flushes the remaining data and closes the
+// file.  With the go implementation, the writer also has a Size() int64 method,
+// returning the compressed size so far.
+func NewWriter(filename string) (io.WriteCloser, error) {
+	if external() {
+		if *UseDictionary {
+			return nil, ErrDictionaryNotSupported
+		}
+		return newProcessWriter(filename)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	opts := []kzstd.EOption{
+		kzstd.WithEncoderConcurrency(1),
+		kzstd.WithLowerEncoderMem(true),
+		kzstd.WithWindowSize(windowSize),
+	}
+	if *UseDictionary {
+		if d := newestDictionary(); d != nil {
+			opts = append(opts, kzstd.WithEncoderDict(d))
+		} else {
+			opts = append(opts, kzstd.WithEncoderDictRaw(DictionaryID, dictionary))
+		}
+	}
+	cf := &countingFile{File: f}
+	e, err := kzstd.NewWriter(cf, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encoder{e, cf}, nil
 }
 
 type waitingWriteCloser struct {
@@ -56,11 +237,11 @@ func (w waitingWriteCloser) Close() error {
 	return nil
 }
 
-// NewWriter creates a writer piped to an external zstd process writing to
-// filename. It returns a WriteCloser that pipes all writes through a zstd
+// newProcessWriter creates a writer piped to an external zstd process writing
+// to filename. It returns a WriteCloser that pipes all writes through a zstd
 // compression process. Upon Close(), the returned WriteCloser will wait for the
 // zstd process to finish writing to disk.
-func NewWriter(filename string) (io.WriteCloser, error) {
+func newProcessWriter(filename string) (io.WriteCloser, error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	pipeR, pipeW, err := osPipe()
@@ -81,6 +262,7 @@ func NewWriter(filename string) (io.WriteCloser, error) {
 			log.Println("ZSTD error", filename, err)
 		}
 		pipeR.Close()
+		f.Close()
 		wg.Done()
 	}()
 
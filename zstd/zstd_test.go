@@ -3,12 +3,21 @@ package zstd_test
 import (
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"testing"
 
+	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/zstd"
 )
 
+// withImplementation runs f with the named zstd implementation selected.
+func withImplementation(impl string, f func()) {
+	rtx.Must(zstd.Implementation.Set(impl), "Could not select %s", impl)
+	defer zstd.Implementation.Set("go")
+	f()
+}
+
 func TestWriterReader(t *testing.T) {
 	tmpdir, err := ioutil.TempDir(".", "tmp")
 	if err != nil {
@@ -27,30 +36,127 @@ func TestWriterReader(t *testing.T) {
 		data[i] = byte((i * 37) % 256)
 	}
 
-	w, err := zstd.NewWriter(tmpdir + "/test.zst")
-	if err != nil {
-		t.Fatal(err)
-	}
-	n, err := w.Write(data)
-	if err != nil {
-		t.Fatal(err)
+	// Files written by either implementation must be readable by both.
+	impls := []string{"go", "external"}
+	for _, writer := range impls {
+		for _, reader := range impls {
+			fn := tmpdir + "/" + writer + "-" + reader + ".zst"
+			withImplementation(writer, func() {
+				w, err := zstd.NewWriter(fn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = w.Write(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rtx.Must(w.Close(), "Could not close %s", fn)
+				// The go implementation counts the compressed bytes.
+				if s, ok := w.(interface{ Size() int64 }); ok {
+					info, err := os.Stat(fn)
+					rtx.Must(err, "Could not stat %s", fn)
+					if s.Size() != info.Size() {
+						t.Error("Wrong size", s.Size(), info.Size())
+					}
+				} else if writer == "go" {
+					t.Error("The go implementation should have a Size")
+				}
+			})
+
+			withImplementation(reader, func() {
+				read := make([]byte, 20000)
+				r, err := zstd.NewReader(fn)
+				rtx.Must(err, "Could not open %s", fn)
+				defer r.Close()
+				// Interesting...  Sometimes this requires multiple calls to read.
+				n, err := io.ReadAtLeast(r, read, 10000)
+				if err != nil {
+					t.Error(writer, reader, err)
+				}
+				if n != 10000 {
+					t.Error(writer, reader, "Wrong number of bytes", n)
+				}
+
+				for i := range data {
+					if data[i] != read[i] {
+						t.Fatal(writer, reader, "Data mismatch at", i)
+					}
+				}
+			})
+		}
 	}
-	w.Close()
+}
 
-	read := make([]byte, 20000)
-	r := zstd.NewReader(tmpdir + "/test.zst")
-	// Interesting...  Sometimes this requires multiple calls to read.
-	n, err = io.ReadAtLeast(r, read, 10000)
-	if err != nil {
-		t.Error(err)
+func TestDictionary(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestDictionary")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tmpdir)
+
+	// The uncompressed contents of a real connection file.
+	r, err := zstd.NewReader("../netlink/testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	rtx.Must(err, "Could not open testdata")
+	data, err := ioutil.ReadAll(r)
+	rtx.Must(err, "Could not read testdata")
+	r.Close()
+	// Just the first few records, as most connections are short.
+	data = data[:4000]
+
+	write := func(fn string) int64 {
+		w, err := zstd.NewWriter(fn)
+		rtx.Must(err, "Could not create %s", fn)
+		_, err = w.Write(data)
+		rtx.Must(err, "Could not write %s", fn)
+		rtx.Must(w.Close(), "Could not close %s", fn)
+		info, err := os.Stat(fn)
+		rtx.Must(err, "Could not stat %s", fn)
+		return info.Size()
 	}
-	if n != 10000 {
-		t.Error("Wrong number of bytes", n)
+	plain := write(tmpdir + "/plain.zst")
+	*zstd.UseDictionary = true
+	defer func() { *zstd.UseDictionary = false }()
+	dict := write(tmpdir + "/dict.zst")
+	if dict >= plain {
+		t.Errorf("The dictionary should help: %d bytes with it, %d without", dict, plain)
 	}
 
-	for i := range data {
-		if data[i] != read[i] {
-			t.Fatal("Data mismatch at", i)
+	r, err = zstd.NewReader(tmpdir + "/dict.zst")
+	rtx.Must(err, "Could not open dict.zst")
+	read, err := ioutil.ReadAll(r)
+	rtx.Must(err, "Could not read dict.zst")
+	rtx.Must(r.Close(), "Could not close dict.zst")
+	if string(read) != string(data) {
+		t.Error("Data mismatch")
+	}
+
+	withImplementation("external", func() {
+		_, err := zstd.NewWriter(tmpdir + "/external.zst")
+		if err != zstd.ErrDictionaryNotSupported {
+			t.Error("Expected ErrDictionaryNotSupported, got", err)
 		}
+	})
+}
+
+func TestNewReaderErrors(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestNewReaderErrors")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(tmpdir)
+	garbage := tmpdir + "/garbage.zst"
+	rtx.Must(ioutil.WriteFile(garbage, []byte("this is not zstd data"), 0644), "Could not write file")
+
+	for _, impl := range []string{"go", "external"} {
+		withImplementation(impl, func() {
+			_, err := zstd.NewReader(tmpdir + "/nonexistent.zst")
+			if err == nil {
+				t.Error(impl, "should fail to open a nonexistent file")
+			}
+
+			r, err := zstd.NewReader(garbage)
+			rtx.Must(err, "Could not open %s", garbage)
+			defer r.Close()
+			_, err = ioutil.ReadAll(r)
+			if err == nil {
+				t.Error(impl, "should fail to read a file that is not zstd")
+			}
+		})
 	}
 }
@@ -9,7 +9,15 @@ import (
 	"github.com/m-lab/go/rtx"
 )
 
+// useExternal selects the external implementation until the returned function
+// is called.
+func useExternal() func() {
+	Implementation.Value = "external"
+	return func() { Implementation.Value = "go" }
+}
+
 func TestNewWriterErrorOnOsPipe(t *testing.T) {
+	defer useExternal()()
 	osPipe = func() (*os.File, *os.File, error) {
 		return nil, nil, errors.New("Eror for testing")
 	}
@@ -28,6 +36,11 @@ func TestNewWriterErrorOnUncreatableFile(t *testing.T) {
 	if err == nil {
 		t.Error("Should have had an error on an uncreateable file")
 	}
+	defer useExternal()()
+	_, err = NewWriter("/this/file/is/uncreateable")
+	if err == nil {
+		t.Error("Should have had an error on an uncreateable file")
+	}
 }
 
 func TestZstdFailure(t *testing.T) {
@@ -35,11 +48,17 @@ func TestZstdFailure(t *testing.T) {
 	rtx.Must(err, "Could not create tempdir")
 	defer os.RemoveAll(dir)
 
+	defer useExternal()()
 	zstdCommand = "/this/binary/is/nonexistent"
 	defer func() {
 		zstdCommand = "zstd"
 	}()
 
+	_, err = NewReader(dir + "/file.zst")
+	if err == nil {
+		t.Error("Should have had an error reading a nonexistent file")
+	}
+
 	wc, err := NewWriter(dir + "/file.zst")
 	rtx.Must(err, "WriteCloser could not be created")
 	wc.Close()
@@ -48,3 +67,21 @@ func TestZstdFailure(t *testing.T) {
 		t.Error("Closing the pipe twice is not a failure?")
 	}
 }
+
+func TestNewReaderZstdFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNewReaderZstdFailure")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	rtx.Must(ioutil.WriteFile(dir+"/file.zst", nil, 0644), "Could not create file")
+
+	defer useExternal()()
+	zstdCommand = "/this/binary/is/nonexistent"
+	defer func() {
+		zstdCommand = "zstd"
+	}()
+
+	_, err = NewReader(dir + "/file.zst")
+	if err == nil {
+		t.Error("Should have had an error when zstd can not run")
+	}
+}